@@ -15,18 +15,80 @@ var LbService LoadBalancerService
 
 func main() {
 
-	LbService = LoadBalancerService{}
+	params := LoadFlags()
 
-	LbService.SetParams(LoadFlags())
+	switch params.Command {
+	case CMD_VALIDATE:
+		validate(params)
+	case CMD_DUMP:
+		dump(params)
+	case CMD_SCHEMA:
+		os.Stdout.Write(ConfigSchema())
+	default:
+		run(params)
+	}
+}
 
-	fmt.Println(PrettyPrint(LbService.Config))
+func run(params *LoadBalancerServiceParams) {
+	LbService = LoadBalancerService{}
+
+	if err := LbService.SetParams(params); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	LbService.Apply()
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
-	select {
-	case <-done:
-		LbService.Stop()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for {
+		select {
+		case <-reload:
+			LbService.Reload()
+		case <-done:
+			LbService.Stop()
+			return
+		}
+	}
+}
+
+// Loads configuration file given to `validate` or `dump`, exiting with every problem found
+func loadConfig(params *LoadBalancerServiceParams) *LoadBalancerYAMLConfiguration {
+	if params.YAMLConfigFilePath == "" {
+		fmt.Fprintf(os.Stderr, "usage: %v %v <config file>\n", os.Args[0], params.Command)
+		os.Exit(2)
+	}
+	ConfigureLogging(params.DebugMode)
+	cnf, err := params.LoadConfigFile()
+	if configErrors, ok := err.(ConfigErrors); ok {
+		for _, configError := range configErrors {
+			fmt.Fprintln(os.Stderr, configError)
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return cnf
+}
+
+func validate(params *LoadBalancerServiceParams) {
+	loadConfig(params)
+	fmt.Printf("%v: configuration is valid\n", params.YAMLConfigFilePath)
+}
+
+func dump(params *LoadBalancerServiceParams) {
+	if !IsValidDumpFormat(params.DumpFormat) {
+		fmt.Fprintf(os.Stderr, "dump format '%v' is invalid\n", params.DumpFormat)
+		os.Exit(2)
+	}
+	contents, err := DumpConfig(loadConfig(params), params.DumpFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	os.Stdout.Write(contents)
 }
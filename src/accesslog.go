@@ -0,0 +1,264 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Access log formats and outputs
+const (
+	ACCESS_LOG_FORMAT_JSON     = "json"
+	ACCESS_LOG_FORMAT_COMMON   = "common"
+	ACCESS_LOG_FORMAT_COMBINED = "combined"
+	ACCESS_LOG_FORMAT_TEMPLATE = "template"
+
+	ACCESS_LOG_OUTPUT_STDOUT = "stdout"
+	ACCESS_LOG_OUTPUT_FILE   = "file"
+	ACCESS_LOG_OUTPUT_SYSLOG = "syslog"
+
+	DEFAULT_ACCESS_LOG_FORMAT = ACCESS_LOG_FORMAT_JSON
+	DEFAULT_ACCESS_LOG_OUTPUT = ACCESS_LOG_OUTPUT_STDOUT
+	DEFAULT_ACCESS_LOG_TAG    = "loadbalancer"
+
+	commonLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+var supportedAccessLogFormats []string = []string{
+	ACCESS_LOG_FORMAT_JSON,
+	ACCESS_LOG_FORMAT_COMMON,
+	ACCESS_LOG_FORMAT_COMBINED,
+	ACCESS_LOG_FORMAT_TEMPLATE,
+}
+
+var supportedAccessLogOutputs []string = []string{
+	ACCESS_LOG_OUTPUT_STDOUT,
+	ACCESS_LOG_OUTPUT_FILE,
+	ACCESS_LOG_OUTPUT_SYSLOG,
+}
+
+func IsValidAccessLogFormat(format string) bool {
+	for _, val := range supportedAccessLogFormats {
+		if val == format {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidAccessLogOutput(output string) bool {
+	for _, val := range supportedAccessLogOutputs {
+		if val == output {
+			return true
+		}
+	}
+	return false
+}
+
+type AccessLogYAMLConfig struct {
+	Format string `yaml:"format"`
+	// text/template over `AccessLogEntry`, used with `template` format
+	Template string `yaml:"template"`
+	Output   string `yaml:"output"`
+	File     string `yaml:"file"`
+	// File rotation settings. 0 disables rotation by size or time.
+	MaxSizeMb             int `yaml:"maxSizeMb"`
+	RotateIntervalMinutes int `yaml:"rotateIntervalMinutes"`
+	MaxBackups            int `yaml:"maxBackups"`
+	// Local syslog socket. If not set, default system socket is used.
+	SyslogAddress string `yaml:"syslogAddress"`
+	SyslogTag     string `yaml:"syslogTag"`
+	// Fraction of requests to log, between 0 and 1. Routes may override it.
+	SampleRate *float64 `yaml:"sampleRate"`
+}
+
+type AccessLogEntry struct {
+	Time              time.Time `json:"time"`
+	RequestID         string    `json:"request_id,omitempty"`
+	ClientIP          string    `json:"client_ip"`
+	Method            string    `json:"method"`
+	URI               string    `json:"uri"`
+	Proto             string    `json:"proto"`
+	Referer           string    `json:"referer,omitempty"`
+	UserAgent         string    `json:"user_agent,omitempty"`
+	Listener          string    `json:"listener"`
+	Balancer          string    `json:"balancer"`
+	Target            string    `json:"target"`
+	Status            int       `json:"status"`
+	UpstreamStatus    int       `json:"upstream_status"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+	UpstreamLatencyMs float64   `json:"upstream_latency_ms"`
+	LatencyMs         float64   `json:"latency_ms"`
+	Hedges            int       `json:"hedges"`
+}
+
+func NewAccessLogEntry(record *RequestRecord, req *http.Request) *AccessLogEntry {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	return &AccessLogEntry{
+		Time:              record.Start,
+		RequestID:         record.RequestID,
+		ClientIP:          clientIP,
+		Method:            req.Method,
+		URI:               req.RequestURI,
+		Proto:             req.Proto,
+		Referer:           req.Referer(),
+		UserAgent:         req.UserAgent(),
+		Listener:          record.Listener,
+		Balancer:          record.Balancer,
+		Target:            record.Target,
+		Status:            record.Status,
+		UpstreamStatus:    record.UpstreamStatus,
+		BytesIn:           atomic.LoadInt64(&record.BytesIn),
+		BytesOut:          record.BytesOut,
+		UpstreamLatencyMs: float64(record.UpstreamDuration.Microseconds()) / 1000,
+		LatencyMs:         float64(record.Duration.Microseconds()) / 1000,
+		Hedges:            record.Hedges,
+	}
+}
+
+// Returns `value`, or "-" if it is empty as in Common Log Format
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func (entry *AccessLogEntry) commonFormat() string {
+	return fmt.Sprintf(`%v - - [%v] "%v %v %v" %v %v`,
+		clfField(entry.ClientIP),
+		entry.Time.Format(commonLogTimeFormat),
+		entry.Method, entry.URI, entry.Proto,
+		entry.Status,
+		entry.BytesOut,
+	)
+}
+
+func (entry *AccessLogEntry) combinedFormat() string {
+	return fmt.Sprintf(`%v "%v" "%v"`, entry.commonFormat(), clfField(entry.Referer), clfField(entry.UserAgent))
+}
+
+// Writes one line per proxied request to configured output
+type AccessLogger struct {
+	mu         sync.Mutex
+	format     string
+	template   *template.Template
+	out        io.Writer
+	SampleRate float64
+	// Set once write failed, so that failure is reported once until writes succeed again
+	failing bool
+}
+
+func NewAccessLogger(cnf *AccessLogYAMLConfig) (*AccessLogger, error) {
+	logger := &AccessLogger{
+		format:     cnf.Format,
+		SampleRate: 1,
+	}
+	if logger.format == "" {
+		logger.format = DEFAULT_ACCESS_LOG_FORMAT
+	}
+	if cnf.SampleRate != nil {
+		logger.SampleRate = *cnf.SampleRate
+	}
+	if logger.format == ACCESS_LOG_FORMAT_TEMPLATE {
+		tmpl, err := template.New("accesslog").Parse(cnf.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+		logger.template = tmpl
+	}
+
+	switch cnf.Output {
+	case "", ACCESS_LOG_OUTPUT_STDOUT:
+		logger.out = os.Stdout
+	case ACCESS_LOG_OUTPUT_FILE:
+		file, err := NewRotatingFile(
+			cnf.File,
+			int64(cnf.MaxSizeMb)*1024*1024,
+			time.Duration(cnf.RotateIntervalMinutes)*time.Minute,
+			cnf.MaxBackups,
+		)
+		if err != nil {
+			return nil, err
+		}
+		logger.out = file
+	case ACCESS_LOG_OUTPUT_SYSLOG:
+		tag := cnf.SyslogTag
+		if tag == "" {
+			tag = DEFAULT_ACCESS_LOG_TAG
+		}
+		writer, err := newSyslogWriter(cnf.SyslogAddress, tag)
+		if err != nil {
+			return nil, err
+		}
+		logger.out = writer
+	default:
+		return nil, fmt.Errorf("access log output '%v' is not supported", cnf.Output)
+	}
+	return logger, nil
+}
+
+// Returns true if request should be logged for given sample rate
+func (al *AccessLogger) sampled(sampleRate float64) bool {
+	return sampleRate >= 1 || (sampleRate > 0 && rand.Float64() < sampleRate)
+}
+
+func (al *AccessLogger) formatEntry(entry *AccessLogEntry) (string, error) {
+	switch al.format {
+	case ACCESS_LOG_FORMAT_COMMON:
+		return entry.commonFormat(), nil
+	case ACCESS_LOG_FORMAT_COMBINED:
+		return entry.combinedFormat(), nil
+	case ACCESS_LOG_FORMAT_TEMPLATE:
+		buf := &bytes.Buffer{}
+		err := al.template.Execute(buf, entry)
+		return strings.TrimRight(buf.String(), "\n"), err
+	default:
+		line, err := json.Marshal(entry)
+		return string(line), err
+	}
+}
+
+// Writes entry if it falls within `sampleRate`. Safe to call on nil logger.
+func (al *AccessLogger) Log(entry *AccessLogEntry, sampleRate float64) {
+	if al == nil || !al.sampled(sampleRate) {
+		return
+	}
+	line, err := al.formatEntry(entry)
+	if err != nil {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := io.WriteString(al.out, line+"\n"); err != nil {
+		if !al.failing {
+			log.Error().Err(err).Msg("Failed to write access log")
+		}
+		al.failing = true
+		return
+	}
+	al.failing = false
+}
+
+func (al *AccessLogger) Close() error {
+	if closer, ok := al.out.(io.Closer); ok && al.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
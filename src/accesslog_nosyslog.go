@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package src
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter(address string, tag string) (io.Writer, error) {
+	return nil, errors.New("syslog access log output is not supported on this platform")
+}
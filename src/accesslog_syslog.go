@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package src
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// Connects to local syslog socket at `address`, or to the default system socket if empty
+func newSyslogWriter(address string, tag string) (io.Writer, error) {
+	network := ""
+	if address != "" {
+		network = "unixgram"
+	}
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
@@ -0,0 +1,72 @@
+package src
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+type AdminYAMLConfig struct {
+	Port        string `yaml:"port"`
+	MetricsPath string `yaml:"metricsPath"`
+	// If set, every admin request must carry `Authorization: Bearer <token>` header
+	Token string `yaml:"token"`
+}
+
+// HTTP server for runtime inspection of the service, running on its own port
+type AdminServer struct {
+	Srv   http.Server
+	Port  string
+	token string
+	mux   *http.ServeMux
+}
+
+func NewAdminServer(cnf *AdminYAMLConfig) *AdminServer {
+	admin := &AdminServer{
+		Port:  cnf.Port,
+		token: cnf.Token,
+		mux:   http.NewServeMux(),
+	}
+	admin.Srv = http.Server{
+		Addr:              ":" + cnf.Port,
+		Handler:           admin,
+		ReadHeaderTimeout: DEFAULT_LISTENER_READ_HEADER_TIMEOUT,
+	}
+	return admin
+}
+
+// Checks bearer token, if configured, before passing request to registered handlers
+func (as *AdminServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if as.token != "" {
+		auth := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(as.token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	as.mux.ServeHTTP(rw, req)
+}
+
+func (as *AdminServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	as.mux.HandleFunc(pattern, handler)
+}
+
+func (as *AdminServer) Start() {
+	go func() {
+		log.Info().Str("port", as.Port).Msg("Starting admin server")
+		err := as.Srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Str("port", as.Port).Err(err).Msg("Admin server failed to start.")
+		}
+	}()
+}
+
+func (as *AdminServer) Shutdown() {
+	_ = as.Srv.Shutdown(context.Background())
+	log.Info().Str("port", as.Port).Msg("Admin server stopped")
+}
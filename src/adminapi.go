@@ -0,0 +1,281 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JSON views of service components returned by admin API
+
+type ListenerView struct {
+	Name      string   `json:"name"`
+	Protocol  string   `json:"protocol"`
+	Port      string   `json:"port"`
+	State     string   `json:"state"`
+	Balancers []string `json:"balancers"`
+	// Set for udp listeners only
+	Sessions          []UDPSessionView `json:"sessions,omitempty"`
+	RejectedDatagrams int64            `json:"rejectedDatagrams,omitempty"`
+}
+
+// Counters of udp listener session
+type UDPSessionView struct {
+	Client     string    `json:"client"`
+	Target     string    `json:"target"`
+	Started    time.Time `json:"started"`
+	LastActive time.Time `json:"lastActive"`
+	PacketsIn  int64     `json:"packetsIn"`
+	PacketsOut int64     `json:"packetsOut"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+}
+
+type BalancerView struct {
+	Id          string       `json:"id"`
+	Listener    string       `json:"listener"`
+	Mode        string       `json:"mode"`
+	RoutePrefix string       `json:"routePrefix"`
+	ServerNames []string     `json:"serverNames,omitempty"`
+	Upstream    string       `json:"upstream,omitempty"`
+	State       string       `json:"state"`
+	InFlight    int64        `json:"inFlight"`
+	QueueDepth  int          `json:"queueDepth"`
+	Targets     []TargetView `json:"targets"`
+}
+
+type TargetView struct {
+	Address        string `json:"address"`
+	Weight         int    `json:"weight"`
+	Alive          bool   `json:"alive"`
+	Connections    int64  `json:"connections"`
+	MaxConnections int64  `json:"maxConnections"`
+	RecentErrors   int64  `json:"recentErrors"`
+	Draining       bool   `json:"draining"`
+	// Set once draining target has no requests in flight
+	Drained bool              `json:"drained"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func NewListenerView(listener *Listener) ListenerView {
+	view := ListenerView{
+		Name:      listener.Name(),
+		Protocol:  listener.Protocol,
+		Port:      listener.Port,
+		State:     listener.GetState(),
+		Balancers: []string{},
+	}
+	for _, balancer := range listener.GetBalancers() {
+		view.Balancers = append(view.Balancers, balancer.Id)
+	}
+	view.Sessions = listener.UDPSessions()
+	view.RejectedDatagrams = listener.RejectedDatagrams()
+	return view
+}
+
+func NewBalancerView(listener *Listener, balancer *Balancer) BalancerView {
+	view := BalancerView{
+		Id:          balancer.Id,
+		Listener:    listener.Name(),
+		Mode:        balancer.Mode,
+		RoutePrefix: balancer.RoutePrefix,
+		ServerNames: balancer.ServerNames,
+		State:       balancer.GetState(),
+		InFlight:    balancer.InFlight(),
+		QueueDepth:  balancer.Admission.QueueDepth(),
+		Targets:     []TargetView{},
+	}
+	if balancer.Upstream != nil {
+		view.Upstream = balancer.Upstream.Name
+	}
+	for _, target := range balancer.GetTargets() {
+		view.Targets = append(view.Targets, NewTargetView(balancer, target))
+	}
+	return view
+}
+
+func NewTargetView(balancer *Balancer, target *Target) TargetView {
+	// Weight is changed while holding `targetsMu`
+	balancer.targetsMu.RLock()
+	weight := target.Weight
+	balancer.targetsMu.RUnlock()
+	return TargetView{
+		Address:        target.Address,
+		Weight:         weight,
+		Alive:          target.IsAlive(),
+		Connections:    target.ActiveConnections(),
+		MaxConnections: target.MaxConnections,
+		RecentErrors:   target.RecentErrors(),
+		Draining:       target.IsDraining(),
+		Drained:        target.IsDrained(),
+		Labels:         target.Labels,
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(value)
+}
+
+func writeJSONError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, map[string]string{"error": message})
+}
+
+// Lists listeners with their states
+func (lbs *LoadBalancerService) serveListenersAPI(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	views := []ListenerView{}
+	for _, listener := range lbs.GetListeners() {
+		views = append(views, NewListenerView(listener))
+	}
+	writeJSON(rw, http.StatusOK, views)
+}
+
+// Lists balancers of all listeners along with their targets
+func (lbs *LoadBalancerService) serveBalancersAPI(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	views := []BalancerView{}
+	for _, listener := range lbs.GetListeners() {
+		for _, balancer := range listener.GetBalancers() {
+			views = append(views, NewBalancerView(listener, balancer))
+		}
+	}
+	writeJSON(rw, http.StatusOK, views)
+}
+
+// Serves `/api/balancers/<id>` and `/api/balancers/<id>/targets`
+func (lbs *LoadBalancerService) serveBalancerAPI(rw http.ResponseWriter, req *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/balancers/"), "/")
+	switch resource {
+	case "":
+		lbs.serveBalancerDetails(rw, req, id)
+	case "targets":
+		lbs.serveTargetsAPI(rw, req, id)
+	default:
+		writeJSONError(rw, http.StatusNotFound, "resource '"+resource+"' not found")
+	}
+}
+
+func (lbs *LoadBalancerService) serveBalancerDetails(rw http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != http.MethodGet {
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	for _, listener := range lbs.GetListeners() {
+		for _, balancer := range listener.GetBalancers() {
+			if balancer.Id == id {
+				writeJSON(rw, http.StatusOK, NewBalancerView(listener, balancer))
+				return
+			}
+		}
+	}
+	writeJSONError(rw, http.StatusNotFound, "balancer '"+id+"' not found")
+}
+
+// Changes to target, fields which are not set are left as they are
+type TargetUpdate struct {
+	Weight   *int  `json:"weight"`
+	Alive    *bool `json:"alive"`
+	Draining *bool `json:"draining"`
+	// Used when draining starts, 0 waits for in-flight requests indefinitely
+	DrainTimeoutMs int `json:"drainTimeoutMs"`
+}
+
+// Lists, adds, updates and removes targets of balancer. Existing targets are addressed
+// by `address` query parameter.
+func (lbs *LoadBalancerService) serveTargetsAPI(rw http.ResponseWriter, req *http.Request, id string) {
+	balancer := lbs.GetBalancer(id)
+	if balancer == nil {
+		writeJSONError(rw, http.StatusNotFound, "balancer '"+id+"' not found")
+		return
+	}
+	address := req.URL.Query().Get("address")
+
+	switch req.Method {
+	case http.MethodGet:
+		views := []TargetView{}
+		for _, target := range balancer.GetTargets() {
+			views = append(views, NewTargetView(balancer, target))
+		}
+		writeJSON(rw, http.StatusOK, views)
+
+	case http.MethodPost:
+		targetConfig := &TargetYAMLConfig{}
+		if err := json.NewDecoder(req.Body).Decode(targetConfig); err != nil {
+			writeJSONError(rw, http.StatusBadRequest, "invalid target: "+err.Error())
+			return
+		}
+		target, err := balancer.AddTarget(targetConfig)
+		if err != nil {
+			writeTargetError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusCreated, NewTargetView(balancer, target))
+
+	case http.MethodPatch:
+		update := &TargetUpdate{}
+		if err := json.NewDecoder(req.Body).Decode(update); err != nil {
+			writeJSONError(rw, http.StatusBadRequest, "invalid update: "+err.Error())
+			return
+		}
+		target := balancer.FindTarget(address)
+		if target == nil {
+			writeTargetError(rw, ErrTargetNotFound)
+			return
+		}
+		if update.Weight != nil {
+			if err := balancer.SetTargetWeight(address, *update.Weight); err != nil {
+				writeTargetError(rw, err)
+				return
+			}
+		}
+		if update.Alive != nil {
+			if err := balancer.SetTargetAlive(address, *update.Alive); err != nil {
+				writeTargetError(rw, err)
+				return
+			}
+		}
+		if update.Draining != nil {
+			var err error
+			if *update.Draining {
+				err = balancer.DrainTarget(address, time.Duration(update.DrainTimeoutMs)*time.Millisecond)
+			} else {
+				err = balancer.UndrainTarget(address)
+			}
+			if err != nil {
+				writeTargetError(rw, err)
+				return
+			}
+		}
+		writeJSON(rw, http.StatusOK, NewTargetView(balancer, target))
+
+	case http.MethodDelete:
+		if err := balancer.RemoveTarget(address); err != nil {
+			writeTargetError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeTargetError(rw http.ResponseWriter, err error) {
+	switch err {
+	case ErrTargetNotFound:
+		writeJSONError(rw, http.StatusNotFound, err.Error())
+	case ErrTargetExists:
+		writeJSONError(rw, http.StatusConflict, err.Error())
+	default:
+		writeJSONError(rw, http.StatusBadRequest, err.Error())
+	}
+}
@@ -0,0 +1,247 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned when a request could not be admitted to a balancer
+var (
+	ErrNoTargetsAvailable  = errors.New("notfound")
+	ErrQueueFull           = errors.New("route queue is full")
+	ErrQueueTimeout        = errors.New("timed out waiting in route queue")
+	ErrConcurrencyLimited  = errors.New("concurrency limit exceeded")
+	ErrRequestBodyTooLarge = errors.New("request body too large")
+)
+
+type admissionWaiter struct {
+	ready chan struct{}
+}
+
+// Snapshot of admission controller counters
+type AdmissionStats struct {
+	InFlight      int64
+	QueueDepth    int
+	Admitted      int64
+	Queued        int64
+	Rejected      int64
+	TimedOut      int64
+	TotalWaitTime time.Duration
+	MaxWaitTime   time.Duration
+}
+
+// Limits in-flight requests of a balancer and its targets. Requests which cannot be
+// served immediately wait in a bounded FIFO queue for at most `MaxQueueTime`.
+type AdmissionController struct {
+	mu sync.Mutex
+	// Maximum in-flight requests for the route. 0 means unlimited.
+	MaxConnections int64
+	// Maximum in-flight requests per target, unless overridden by target. 0 means unlimited.
+	MaxTargetConnections int64
+	// Maximum number of waiting requests. 0 means unlimited.
+	MaxQueueSize  int
+	MaxQueueTime  time.Duration
+	inFlight      int64
+	queue         []*admissionWaiter
+	admitted      int64
+	queued        int64
+	rejected      int64
+	timedOut      int64
+	totalWaitTime time.Duration
+	maxWaitTime   time.Duration
+}
+
+// Applies the per target limit to targets which don't specify their own
+func (ac *AdmissionController) applyTargetLimit(target *Target) {
+	if target.MaxConnections == 0 {
+		target.MaxConnections = ac.MaxTargetConnections
+	}
+}
+
+// Returns true if route's in-flight requests reached the limit of balancer's adaptive
+// limiter. Must be called with lock held.
+func (ac *AdmissionController) concurrencyLimited(lb *Balancer) bool {
+	return lb.Limiter != nil && ac.inFlight >= int64(lb.Limiter.Limit())
+}
+
+// Reserves a slot on the route and on the selected target, which is never `exclude`. Must be
+// called with lock held.
+func (ac *AdmissionController) tryAcquire(lb *Balancer, exclude *Target) *Target {
+	if (ac.MaxConnections > 0 && ac.inFlight >= ac.MaxConnections) || ac.concurrencyLimited(lb) {
+		return nil
+	}
+	for {
+		target := lb.nextTarget(exclude)
+		if target == nil {
+			return nil
+		}
+		if target.reserve() {
+			ac.inFlight++
+			ac.admitted++
+			return target
+		}
+		// Target started draining while being selected, it is not selected again
+	}
+}
+
+func (ac *AdmissionController) removeWaiter(w *admissionWaiter) {
+	for index, waiter := range ac.queue {
+		if waiter == w {
+			ac.queue = append(ac.queue[:index], ac.queue[index+1:]...)
+			return
+		}
+	}
+}
+
+// Wakes up the request at the head of the queue. Must be called with lock held.
+func (ac *AdmissionController) wakeHead() {
+	if len(ac.queue) > 0 {
+		select {
+		case ac.queue[0].ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (ac *AdmissionController) recordWait(waited time.Duration) {
+	ac.totalWaitTime += waited
+	if waited > ac.maxWaitTime {
+		ac.maxWaitTime = waited
+	}
+}
+
+// Returns a target for the request, waiting in queue if the route or all targets are at capacity
+// or no target is alive
+func (ac *AdmissionController) Acquire(ctx context.Context, lb *Balancer) (*Target, error) {
+	ac.mu.Lock()
+	if len(ac.queue) == 0 {
+		if target := ac.tryAcquire(lb, nil); target != nil {
+			ac.mu.Unlock()
+			return target, nil
+		}
+	}
+	// Requests over the adaptive limit are shed rather than queued
+	if ac.concurrencyLimited(lb) {
+		ac.rejected++
+		ac.mu.Unlock()
+		requestLogger(ctx).Info().Str("balancer", lb.Id).Int("limit", lb.Limiter.Limit()).Msg("Request rejected. Concurrency limit reached.")
+		return nil, ErrConcurrencyLimited
+	}
+	if ac.MaxQueueSize > 0 && len(ac.queue) >= ac.MaxQueueSize {
+		ac.rejected++
+		ac.mu.Unlock()
+		requestLogger(ctx).Info().Str("balancer", lb.Id).Int("queue", ac.MaxQueueSize).Msg("Request rejected. Queue is full.")
+		return nil, ErrQueueFull
+	}
+	waiter := &admissionWaiter{ready: make(chan struct{}, 1)}
+	ac.queue = append(ac.queue, waiter)
+	ac.queued++
+	ac.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(ac.MaxQueueTime)
+	defer timer.Stop()
+	for {
+		select {
+		case <-waiter.ready:
+			ac.mu.Lock()
+			if target := ac.tryAcquire(lb, nil); target != nil {
+				ac.removeWaiter(waiter)
+				waited := time.Since(start)
+				ac.recordWait(waited)
+				ac.wakeHead()
+				ac.mu.Unlock()
+				requestLogger(ctx).Debug().Str("balancer", lb.Id).Dur("waited", waited).Msg("Request admitted from queue")
+				return target, nil
+			}
+			ac.mu.Unlock()
+		case <-timer.C:
+			ac.mu.Lock()
+			ac.removeWaiter(waiter)
+			ac.timedOut++
+			ac.recordWait(time.Since(start))
+			ac.wakeHead()
+			ac.mu.Unlock()
+			requestLogger(ctx).Info().Str("balancer", lb.Id).Str("mode", lb.Mode).Msg("Request is timing out due to no available targets.")
+			if !lb.HasLiveTargets() {
+				return nil, ErrNoTargetsAvailable
+			}
+			return nil, ErrQueueTimeout
+		}
+	}
+}
+
+// Wakes up the request at the head of the queue after targets were added or brought up
+func (ac *AdmissionController) Wake() {
+	ac.mu.Lock()
+	ac.wakeHead()
+	ac.mu.Unlock()
+}
+
+// Reserves a target other than `exclude` without waiting in queue. Returns nil if none is available.
+func (ac *AdmissionController) TryAcquire(lb *Balancer, exclude *Target) *Target {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if len(ac.queue) > 0 {
+		return nil
+	}
+	return ac.tryAcquire(lb, exclude)
+}
+
+// Reserves a slot on the route and on the given target without waiting in queue. Returns
+// false if target is not available or either has no free slot.
+func (ac *AdmissionController) TryAcquireTarget(target *Target) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if len(ac.queue) > 0 || (ac.MaxConnections > 0 && ac.inFlight >= ac.MaxConnections) {
+		return false
+	}
+	if !target.IsAvailable() || !target.reserve() {
+		return false
+	}
+	ac.inFlight++
+	ac.admitted++
+	return true
+}
+
+// Releases the slots reserved by `Acquire`
+func (ac *AdmissionController) Release(target *Target) {
+	atomic.AddInt64(&target.Connections, -1)
+	target.checkDrained()
+	ac.mu.Lock()
+	ac.inFlight--
+	ac.wakeHead()
+	ac.mu.Unlock()
+}
+
+// Returns the number of requests currently holding a slot on the route
+func (ac *AdmissionController) InFlight() int64 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.inFlight
+}
+
+// Returns the number of requests currently waiting in queue
+func (ac *AdmissionController) QueueDepth() int {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return len(ac.queue)
+}
+
+func (ac *AdmissionController) Stats() AdmissionStats {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return AdmissionStats{
+		InFlight:      ac.inFlight,
+		QueueDepth:    len(ac.queue),
+		Admitted:      ac.admitted,
+		Queued:        ac.queued,
+		Rejected:      ac.rejected,
+		TimedOut:      ac.timedOut,
+		TotalWaitTime: ac.totalWaitTime,
+		MaxWaitTime:   ac.maxWaitTime,
+	}
+}
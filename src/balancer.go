@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -53,16 +54,50 @@ type Balancer struct {
 	Mode              string
 	RoutePrefix       string
 	TargetWaitTimeout time.Duration
-	Targets           []*Target
-	State             LB_STATE
+	// Replaced, never modified in place, while holding `targetsMu` so that snapshots stay valid
+	Targets   []*Target
+	targetsMu sync.RWMutex
+	// LB_STATE of balancer, changed while requests are being served
+	state             atomic.Int32
 	CustomHeaderRules []CustomHeaderRule
+	// Maximum size of request body in bytes. 0 means unlimited.
+	MaxRequestBodyBytes int64
+	// Fraction of requests written to access log
+	AccessLogSampleRate float64
+	// Fraction of new traces sampled
+	TraceSampleRatio float64
+	// Route level upstream timeouts, targets may override them
+	Timeouts *TimeoutsYAMLConfig
 	// NextAvailableServer func(lb *Balancer) *Target
-	Logic BalancerLogic
+	Logic     BalancerLogic
+	Admission *AdmissionController
+	// Optional adaptive limit of in-flight requests
+	Limiter ConcurrencyLimiter
+	// Optional hedging of slow idempotent requests
+	Hedging *HedgePolicy
+	// Set if targets are shared with other balancers through named upstream
+	Upstream *Upstream
+	// Protocol of listener balancer serves, tls for passthrough routes. Decides which target
+	// addresses balancer takes.
+	Protocol string
+	// Set if balancer takes TLS connections, chosen by their server name, instead of requests
+	Passthrough bool
+	ServerNames []string
+	// Discovery of targets resolved at runtime
+	discovery targetDiscoveries
 	BalancerDebugger
 }
 
 var LoadBalancersPool map[string]*Balancer
 
+// Errors returned when targets of a running balancer are changed
+var (
+	ErrTargetNotFound       = errors.New("target not found")
+	ErrTargetExists         = errors.New("target already exists")
+	ErrInvalidTargetWeight  = errors.New("target weight must be positive")
+	ErrInvalidTargetAddress = errors.New("invalid target address")
+)
+
 func (lb *Balancer) SetBalancerLogic() {
 
 	switch lb.Mode {
@@ -86,10 +121,49 @@ func (lb *Balancer) SetBalancerLogic() {
 	}
 
 	lb.DeubgDataMutext = &sync.Mutex{}
+
+	if lb.Admission == nil {
+		lb.Admission = &AdmissionController{}
+	}
+	if lb.Admission.MaxQueueTime == 0 {
+		lb.Admission.MaxQueueTime = lb.TargetWaitTimeout
+	}
 }
 
 func (lb *Balancer) IsAvailable() bool {
-	return lb.State == LB_STATE_ACTIVE
+	return lb.loadState() == LB_STATE_ACTIVE
+}
+
+func (lb *Balancer) loadState() LB_STATE {
+	return LB_STATE(lb.state.Load())
+}
+
+func (lb *Balancer) setState(state LB_STATE) {
+	lb.state.Store(int32(state))
+}
+
+// Stops accepting requests and waits till the ones being served complete
+func (lb *Balancer) Close() {
+	log.Debug().Str("balancer", lb.Id).Msg("Closing Load Balancer")
+	lb.setState(LB_STATE_CLOSING)
+	if lb.Upstream != nil {
+		lb.Upstream.detach(lb)
+	}
+	lb.discovery.Stop()
+	lb.liveConnections.Wait()
+	lb.setState(LB_STATE_CLOSED)
+	log.Debug().Str("balancer", lb.Id).Msg("- Load Balancer Closed")
+}
+
+// Returns state in string format
+func (lb *Balancer) GetState() string {
+	states := map[LB_STATE]string{
+		LB_STATE_INIT:    "init",
+		LB_STATE_ACTIVE:  "active",
+		LB_STATE_CLOSING: "closing",
+		LB_STATE_CLOSED:  "closed",
+	}
+	return states[lb.loadState()]
 }
 
 func (lb *Balancer) _parseCustomHeaderValue(header *CustomHeader, req *http.Request) string {
@@ -104,6 +178,11 @@ func (lb *Balancer) _parseCustomHeaderValue(header *CustomHeader, req *http.Requ
 		return ""
 	} else if header.Value == "[[balancer.id]]" {
 		return lb.Id
+	} else if header.Value == "[[request.id]]" {
+		if record := requestRecordFrom(req); record != nil {
+			return record.RequestID
+		}
+		return ""
 	}
 	return header.Value
 }
@@ -123,35 +202,344 @@ func (lb *Balancer) AddCustomHeaders(req *http.Request) {
 }
 
 func (lb *Balancer) serveProxy(rw http.ResponseWriter, req *http.Request) error {
-	target := lb.Logic.Next(lb)
-	if target == nil {
-		log.Info().Msg("No targets found")
-		return errors.New("notfound")
+	if lb.MaxRequestBodyBytes > 0 {
+		if req.ContentLength > lb.MaxRequestBodyBytes {
+			requestLogger(req.Context()).Info().Str("balancer", lb.Id).Int64("length", req.ContentLength).Msg("Request rejected. Body is too large.")
+			return ErrRequestBodyTooLarge
+		}
+		// Body of unknown length is checked while being forwarded
+		req.Body = http.MaxBytesReader(rw, req.Body, lb.MaxRequestBodyBytes)
+	}
+	selectSpan := startChildSpan(req.Context(), "select target", SPAN_KIND_INTERNAL)
+	selectSpan.SetAttribute("lb.mode", lb.Mode)
+	target, err := lb.Admission.Acquire(req.Context(), lb)
+	if err != nil {
+		selectSpan.SetStatus(SPAN_STATUS_ERROR, err.Error())
+	} else {
+		selectSpan.SetAttribute("lb.target", target.Address)
+	}
+	selectSpan.Finish()
+	if err != nil {
+		if err == ErrNoTargetsAvailable {
+			requestLogger(req.Context()).Info().Str("balancer", lb.Id).Msg("No targets found")
+		}
+		return err
 	}
-	log.Debug().Str("uri", req.RequestURI).Str("balancer", lb.Id).Str("to", target.Address).Msg("- Forwarding request")
+	defer lb.Admission.Release(target)
+	// In-flight requests of route, including this one
+	inFlight := lb.Admission.InFlight()
+	requestLogger(req.Context()).Debug().Str("uri", req.RequestURI).Str("balancer", lb.Id).Str("to", target.Address).Msg("- Forwarding request")
 
 	lb.liveConnections.Add(1)
+	// Deferred, as proxy panics when client goes away while response body is copied
+	defer lb.liveConnections.Done()
 	// Add Custom headers if matches any
 	lb.AddCustomHeaders(req)
 
-	isSuccessful := target.Serve(rw, req)
+	start := time.Now()
+	var result serveResult
+	// Target whose response was used, which is the hedge target if hedge won
+	served := target
+	hedges := 0
+	if lb.Hedging != nil && lb.Hedging.isHedgeable(req) {
+		result, served, hedges = lb.serveHedged(rw, req, target)
+	} else {
+		result = target.serve(rw, req)
+	}
+	isSuccessful := result.isSuccessful
+	spanFrom(req.Context()).SetAttribute("lb.target", served.Address)
+	if record := requestRecordFrom(req); record != nil {
+		record.Target = served.Address
+		record.UpstreamDuration = time.Since(start)
+		record.UpstreamStatus = result.upstreamStatus
+		record.Hedges = hedges
+	}
+	if lb.Limiter != nil {
+		lb.Limiter.OnSample(time.Since(start), inFlight, !isSuccessful)
+	}
 
 	if !isSuccessful {
-		log.Info().Str("uri", req.RequestURI).Str("balancer", lb.Id).Str("to", target.Address).Msg("Target unreachable")
+		requestLogger(req.Context()).Info().Str("uri", req.RequestURI).Str("balancer", lb.Id).Str("to", served.Address).Msg("Target unreachable")
 	}
-	lb.liveConnections.Done()
 	return nil
 }
 
+// Returns snapshot of balancer's targets
+func (lb *Balancer) GetTargets() []*Target {
+	lb.targetsMu.RLock()
+	defer lb.targetsMu.RUnlock()
+	return lb.Targets
+}
+
+// Selects next target other than `exclude`, preventing target changes while the logic runs
+func (lb *Balancer) nextTarget(exclude *Target) *Target {
+	lb.targetsMu.RLock()
+	defer lb.targetsMu.RUnlock()
+	return lb.Logic.Next(lb, exclude)
+}
+
+// Returns the number of in-flight requests across all targets
+func (lb *Balancer) InFlight() int64 {
+	var inFlight int64
+	for _, target := range lb.GetTargets() {
+		inFlight += target.ActiveConnections()
+	}
+	return inFlight
+}
+
+// Returns true if at least one target is alive and not draining, regardless of its in-flight limit
+func (lb *Balancer) HasLiveTargets() bool {
+	for _, target := range lb.GetTargets() {
+		if target.IsAlive() && !target.IsDraining() {
+			return true
+		}
+	}
+	return false
+}
+
+// Activates balancer once it has targets. Balancer being closed is not activated again.
 func (lb *Balancer) UpdateState() {
-	if len(lb.Targets) > 0 {
-		lb.State = LB_STATE_ACTIVE
+	if len(lb.GetTargets()) > 0 {
+		lb.state.CompareAndSwap(int32(LB_STATE_INIT), int32(LB_STATE_ACTIVE))
+	}
+}
+
+func (lb *Balancer) AddNewServer(targetConfig *TargetYAMLConfig) *Target {
+	target, _ := lb.addServer(targetConfig, false)
+	return target
+}
+
+// Adds target to balancer. If `unique` is set, target is not added when one with the same
+// address exists already.
+func (lb *Balancer) addServer(targetConfig *TargetYAMLConfig, unique bool) (*Target, error) {
+	target := lb.newTarget(targetConfig)
+	if !lb.appendTarget(target, unique) {
+		return nil, ErrTargetExists
+	}
+
+	if targetConfig.Draining {
+		lb.DrainTarget(target.Address, time.Duration(targetConfig.DrainTimeoutMs)*time.Millisecond)
 	}
+	return target, nil
 }
 
-func (lb *Balancer) AddNewServer(targetConfig *TargetYAMLConfig) {
-	target := NewTarget(targetConfig)
+// Creates target which takes balancer's timeouts and limits
+func (lb *Balancer) newTarget(targetConfig *TargetYAMLConfig) *Target {
+	targetCnf := *targetConfig
+	targetCnf.Timeouts = targetConfig.Timeouts.Merge(lb.Timeouts)
+	target := NewTarget(&targetCnf)
+	lb.Admission.applyTargetLimit(target)
 	target.MarkAsReachable()
-	lb.Targets = append(lb.Targets, target)
+	target.setOnReachable(lb.Admission.Wake)
+	return target
+}
+
+// Removes `removed` targets and adds targets of `added` in a single change, so that requests
+// see either targets before it or after it. Targets of balancer using an upstream are changed
+// in the upstream.
+func (lb *Balancer) replaceTargets(removed []*Target, added []*TargetYAMLConfig) {
+	if lb.Upstream != nil {
+		lb.Upstream.replaceTargets(removed, added)
+		return
+	}
+	targets := make([]*Target, 0, len(added))
+	for _, targetConfig := range added {
+		targets = append(targets, lb.newTarget(targetConfig))
+	}
+	for _, target := range lb.swapTargets(removed, targets) {
+		target.closeIdleConnections()
+		log.Info().Str("balancer", lb.Id).Str("address", target.Address).Msg("Target removed")
+	}
+	drainAddedTargets(lb, added)
+}
+
+// Swaps `removed` targets for `added` ones, returning removed targets balancer had
+func (lb *Balancer) swapTargets(removed []*Target, added []*Target) []*Target {
+	lb.targetsMu.Lock()
+	targets := make([]*Target, 0, len(lb.Targets)+len(added))
+	dropped := []*Target{}
+	for _, target := range lb.Targets {
+		if containsTarget(removed, target) {
+			dropped = append(dropped, target)
+		} else {
+			targets = append(targets, target)
+		}
+	}
+	lb.Targets = append(targets, added...)
+	lb.targetsMu.Unlock()
+
+	lb.UpdateState()
+	// Requests waiting in queue may use the new targets
+	lb.Admission.Wake()
+	return dropped
+}
+
+func containsTarget(targets []*Target, target *Target) bool {
+	for _, candidate := range targets {
+		if candidate == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Drains targets just added whose configuration says so
+func drainAddedTargets(targets targetSet, added []*TargetYAMLConfig) {
+	for _, targetConfig := range added {
+		if targetConfig.Draining {
+			targets.DrainTarget(targetConfig.Address, time.Duration(targetConfig.DrainTimeoutMs)*time.Millisecond)
+		}
+	}
+}
+
+func (lb *Balancer) discoveries() *targetDiscoveries {
+	return &lb.discovery
+}
+
+// Appends target, unless `unique` is set and balancer has a target with the same address,
+// which is checked while holding the same lock as the append
+func (lb *Balancer) appendTarget(target *Target, unique bool) bool {
+	lb.targetsMu.Lock()
+	if unique && findTarget(lb.Targets, target.Address) != nil {
+		lb.targetsMu.Unlock()
+		return false
+	}
+	targets := make([]*Target, 0, len(lb.Targets)+1)
+	targets = append(targets, lb.Targets...)
+	lb.Targets = append(targets, target)
+	lb.targetsMu.Unlock()
+
 	lb.UpdateState()
+	// Requests waiting in queue may use the new target
+	lb.Admission.Wake()
+	return true
+}
+
+// Validates target added at runtime to balancer of listener with given protocol, or to
+// upstream of any listener if protocol is empty
+func validateTargetConfig(targetConfig *TargetYAMLConfig, protocol string) error {
+	if !isValidTargetAddress(targetConfig.Address, protocol) {
+		return fmt.Errorf("%w, it must be %v", ErrInvalidTargetAddress, targetAddressKind(protocol))
+	}
+	if targetConfig.Weight < 0 {
+		return ErrInvalidTargetWeight
+	}
+	return nil
+}
+
+// Adds target to running balancer, unless one with the same address exists already. Targets
+// of balancer using an upstream are added to the upstream.
+func (lb *Balancer) AddTarget(targetConfig *TargetYAMLConfig) (*Target, error) {
+	if lb.Upstream != nil {
+		return lb.Upstream.AddTarget(targetConfig)
+	}
+	if err := validateTargetConfig(targetConfig, lb.Protocol); err != nil {
+		return nil, err
+	}
+	target, err := lb.addServer(targetConfig, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("balancer", lb.Id).Str("address", target.Address).Msg("Target added")
+	return target, nil
+}
+
+// Returns target with given address, or nil if balancer has none
+func (lb *Balancer) FindTarget(address string) *Target {
+	return findTarget(lb.GetTargets(), address)
+}
+
+func findTarget(targets []*Target, address string) *Target {
+	for _, target := range targets {
+		if target.Address == address {
+			return target
+		}
+	}
+	return nil
+}
+
+// Removes target from balancer. Requests already sent to it are not interrupted, while its
+// idle connections are closed.
+func (lb *Balancer) RemoveTarget(address string) error {
+	target := lb.FindTarget(address)
+	if target == nil || !lb.removeTarget(target) {
+		return ErrTargetNotFound
+	}
+	return nil
+}
+
+// Removes given target, returns false if balancer no longer has it
+func (lb *Balancer) removeTarget(removed *Target) bool {
+	if lb.Upstream != nil {
+		return lb.Upstream.removeTarget(removed)
+	}
+	if lb.dropTarget(removed) {
+		removed.closeIdleConnections()
+		log.Info().Str("balancer", lb.Id).Str("address", removed.Address).Msg("Target removed")
+		return true
+	}
+	return false
+}
+
+func (lb *Balancer) dropTarget(removed *Target) bool {
+	lb.targetsMu.Lock()
+	defer lb.targetsMu.Unlock()
+	for index, target := range lb.Targets {
+		if target == removed {
+			targets := make([]*Target, 0, len(lb.Targets)-1)
+			targets = append(targets, lb.Targets[:index]...)
+			lb.Targets = append(targets, lb.Targets[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns weight of target, which is changed while holding `targetsMu`
+func (lb *Balancer) TargetWeight(address string) (int, error) {
+	if lb.Upstream != nil {
+		return lb.Upstream.TargetWeight(address)
+	}
+	lb.targetsMu.RLock()
+	defer lb.targetsMu.RUnlock()
+	if target := findTarget(lb.Targets, address); target != nil {
+		return target.Weight, nil
+	}
+	return 0, ErrTargetNotFound
+}
+
+func (lb *Balancer) SetTargetWeight(address string, weight int) error {
+	if lb.Upstream != nil {
+		return lb.Upstream.SetTargetWeight(address, weight)
+	}
+	if weight < 1 {
+		return ErrInvalidTargetWeight
+	}
+	lb.targetsMu.Lock()
+	defer lb.targetsMu.Unlock()
+	for _, target := range lb.Targets {
+		if target.Address == address {
+			target.Weight = weight
+			return nil
+		}
+	}
+	return ErrTargetNotFound
+}
+
+// Manually marks target as up or down
+func (lb *Balancer) SetTargetAlive(address string, alive bool) error {
+	if lb.Upstream != nil {
+		return lb.Upstream.SetTargetAlive(address, alive)
+	}
+	target := lb.FindTarget(address)
+	if target == nil {
+		return ErrTargetNotFound
+	}
+	// Requests waiting in queue are woken up by target once it is brought back up
+	if alive {
+		target.MarkAsReachable()
+	} else {
+		target.MarkAsUnreachable()
+	}
+	return nil
 }
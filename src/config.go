@@ -1,33 +1,78 @@
 package src
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 
-	"github.com/rs/zerolog/log"
-
 	"gopkg.in/yaml.v3"
 )
 
 type LoadBalancerYAMLConfiguration struct {
-	Listeners []struct {
-		Protocol          string `yaml:"protocol"`
-		Port              string `yaml:"port"`
-		SSLCertificate    string `yaml:"ssl_certificate"`
-		SSLCertificateKey string `yaml:"ssl_certificate_key"`
-		Routes            []struct {
-			Routeprefix       string             `yaml:"routeprefix"`
-			Id                string             `yaml:"id"`
-			Mode              string             `yaml:"mode"`
-			CustomHeaders     []CustomHeaderRule `yaml:"customHeaders"`
-			TargetWaitTimeout int                `yaml:"targetWaitTimeout"`
-			Targets           []TargetYAMLConfig `yaml:"targets"`
-		} `yaml:"routes"`
-	} `yaml:"listeners"`
+	// Named target sets which routes refer to
+	Upstreams map[string]UpstreamYAMLConfig `yaml:"upstreams"`
+	Listeners []ListenerYAMLConfig          `yaml:"listeners"`
+	Admin     *AdminYAMLConfig              `yaml:"admin"`
+	AccessLog *AccessLogYAMLConfig          `yaml:"accessLog"`
+	Tracing   *TracingYAMLConfig            `yaml:"tracing"`
+	// Paths of values which are redacted when configuration is printed
+	secretPaths map[string]bool
+}
+
+type ListenerYAMLConfig struct {
+	Protocol          string `yaml:"protocol"`
+	Port              string `yaml:"port"`
+	SSLCertificate    string `yaml:"ssl_certificate"`
+	SSLCertificateKey string `yaml:"ssl_certificate_key"`
+	// Client side timeouts in milliseconds
+	ReadHeaderTimeoutMs int `yaml:"readHeaderTimeoutMs"`
+	ReadTimeoutMs       int `yaml:"readTimeoutMs"`
+	WriteTimeoutMs      int `yaml:"writeTimeoutMs"`
+	IdleTimeoutMs       int `yaml:"idleTimeoutMs"`
+	MaxHeaderBytes      int `yaml:"maxHeaderBytes"`
+	MaxConnectionsPerIP int `yaml:"maxConnectionsPerIP"`
+	// Time connections of tcp and tls listeners and of passthrough routes are given to finish
+	// once listener stops
+	ShutdownTimeoutMs int `yaml:"shutdownTimeoutMs"`
+	// Limits client sessions udp listener keeps open at once
+	MaxSessions int `yaml:"maxSessions"`
+	// Sends every client IP of udp listener to the same target instead of choosing target by mode
+	HashClientIP bool `yaml:"hashClientIP"`
+	// Assigns identifier to requests which arrive without one
+	RequestID *RequestIDYAMLConfig `yaml:"requestId"`
+	Routes    []RouteYAMLConfig    `yaml:"routes"`
+}
+
+type RouteYAMLConfig struct {
+	Routeprefix          string                         `yaml:"routeprefix"`
+	Id                   string                         `yaml:"id"`
+	Mode                 string                         `yaml:"mode"`
+	CustomHeaders        []CustomHeaderRule             `yaml:"customHeaders"`
+	TargetWaitTimeout    int                            `yaml:"targetWaitTimeout"`
+	MaxConnections       int                            `yaml:"maxConnections"`
+	MaxTargetConnections int                            `yaml:"maxTargetConnections"`
+	MaxQueueSize         int                            `yaml:"maxQueueSize"`
+	MaxQueueTime         int                            `yaml:"maxQueueTime"`
+	AdaptiveConcurrency  *AdaptiveConcurrencyYAMLConfig `yaml:"adaptiveConcurrency"`
+	Hedging              *HedgingYAMLConfig             `yaml:"hedging"`
+	Timeouts             *TimeoutsYAMLConfig            `yaml:"timeouts"`
+	MaxRequestBodyBytes  int64                          `yaml:"maxRequestBodyBytes"`
+	AccessLogSampleRate  *float64                       `yaml:"accessLogSampleRate"`
+	TraceSampleRatio     *float64                       `yaml:"traceSampleRatio"`
+	// Passes TLS connections of https listener to targets without terminating them. Every route
+	// of tls listener is a passthrough route.
+	Passthrough bool `yaml:"passthrough"`
+	// Server names (SNI) of connections passthrough route takes. `*.` prefix matches any single
+	// label. Route of tls listener without server names takes connections no other route does.
+	ServerNames []string `yaml:"serverNames"`
+	// Name of upstream providing targets, used instead of `targets`
+	Upstream string             `yaml:"upstream"`
+	Targets  []TargetYAMLConfig `yaml:"targets"`
 }
 
 // Default Config and constants
@@ -35,6 +80,12 @@ const (
 	// Listener Protocol
 	LS_PROTOCOL_HTTP  = "http"
 	LS_PROTOCOL_HTTPS = "https"
+	// Connections are piped to targets as they are, without being read as HTTP
+	LS_PROTOCOL_TCP = "tcp"
+	// Datagrams are relayed to targets, each client address keeping its target until it idles
+	LS_PROTOCOL_UDP = "udp"
+	// TLS connections are routed by server name and piped to targets without being decrypted
+	LS_PROTOCOL_TLS = "tls"
 
 	// Balancer Modes
 	LB_MODE_RANDOM                       = "Random"
@@ -48,8 +99,15 @@ const (
 
 	DEFAULT_TARGET_WAIT_TIMEOUT time.Duration = 15 * time.Second
 
-	TARGET_CONNECTION_TIMEOUT   = 300 * time.Second
-	TARGET_CONNECTION_KEEPALIVE = 300 * time.Second
+	TARGET_CONNECTION_TIMEOUT    = 300 * time.Second
+	TARGET_CONNECTION_KEEPALIVE  = 300 * time.Second
+	TARGET_TLS_HANDSHAKE_TIMEOUT = 180 * time.Second
+	// Window over which target errors are reported by admin API
+	TARGET_ERROR_WINDOW_SECONDS = 60
+
+	// Protects listeners from clients which send headers slowly
+	DEFAULT_LISTENER_READ_HEADER_TIMEOUT = 10 * time.Second
+	DEFAULT_LISTENER_IDLE_TIMEOUT        = 120 * time.Second
 
 	DEFAULT_TARGET_WEIGHT = 1
 )
@@ -57,6 +115,9 @@ const (
 var supportedListenerProtocols []string = []string{
 	LS_PROTOCOL_HTTP,
 	LS_PROTOCOL_HTTPS,
+	LS_PROTOCOL_TCP,
+	LS_PROTOCOL_UDP,
+	LS_PROTOCOL_TLS,
 }
 
 var supportedBalancers []string = []string{
@@ -89,117 +150,258 @@ func IsValidBalancerMode(searchType string) bool {
 	return false
 }
 
-func LoadConfigFromFile(filepath string) (cnf *LoadBalancerYAMLConfiguration, err error) {
-	if _, err := os.Stat(filepath); errors.Is(err, os.ErrNotExist) {
-		panic(fmt.Sprintf("Configuration file not found at location: %v", filepath))
-	}
+// Loads configuration file, judging its format by extension
+func LoadConfigFromFile(configFile string) (*LoadBalancerYAMLConfiguration, error) {
+	return LoadConfigFromFileAs(configFile, ConfigFormatFromPath(configFile))
+}
 
-	f, err := os.ReadFile(filepath)
+// Loads configuration file written in given format
+func LoadConfigFromFileAs(configFile string, format string) (*LoadBalancerYAMLConfiguration, error) {
+	contents, err := os.ReadFile(configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("configuration file not found at location: %v", configFile)
+	}
 	if err != nil {
-		log.Error().Err(err)
+		return nil, err
 	}
+	return parseConfig(contents, format, configFile)
+}
 
-	// Unmarshal YAML config
-	cnf = UnmarshalYAML(&f)
+// Formats of dumped configuration
+const (
+	DUMP_FORMAT_YAML = "yaml"
+	DUMP_FORMAT_JSON = "json"
+)
 
-	return
+var supportedDumpFormats []string = []string{
+	DUMP_FORMAT_YAML, DUMP_FORMAT_JSON,
 }
 
-func loadConfigFromString(fileContents string) (cnf *LoadBalancerYAMLConfiguration, err error) {
-	contents := []byte(fileContents)
-	// Unmarshal YAML config
-	cnf = UnmarshalYAML(&contents)
-	return
+func IsValidDumpFormat(format string) bool {
+	for _, val := range supportedDumpFormats {
+		if val == format {
+			return true
+		}
+	}
+	return false
 }
 
-func _getRandomString() string {
-	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	b := make([]byte, AUTO_GENERATED_BALANCER_ID_LENGTH)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+// Serializes configuration in given format, using the same keys as configuration file.
+// Secrets are redacted.
+func DumpConfig(cnf *LoadBalancerYAMLConfiguration, format string) ([]byte, error) {
+	if !IsValidDumpFormat(format) {
+		return nil, fmt.Errorf("dump format '%v' is invalid, supported formats are: %v", format, strings.Join(supportedDumpFormats, ", "))
 	}
-	return string(b)
+	// Defaults are filled in on a copy, running configuration keeps settings as they were given
+	document := &yaml.Node{}
+	if err := document.Encode(cnf); err != nil {
+		return nil, err
+	}
+	normalized := &LoadBalancerYAMLConfiguration{}
+	if err := document.Decode(normalized); err != nil {
+		return nil, err
+	}
+	applyRuntimeDefaults(normalized)
+	document = &yaml.Node{}
+	if err := document.Encode(normalized); err != nil {
+		return nil, err
+	}
+	redactYAML(document, configPath{}, cnf.secretPaths)
+	if format == DUMP_FORMAT_YAML {
+		return yaml.Marshal(document)
+	}
+	// Structs carry yaml tags only, so JSON is produced from generic YAML document
+	var values any
+	if err := document.Decode(&values); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(values, "", "  ")
 }
 
-func generateBalancerId(balancerIdsPool map[string]bool) (newId string) {
-	maxTries := 5
-	for i := 0; i < maxTries; i++ {
-		newId = _getRandomString()
-		_, ok := balancerIdsPool[newId]
-		if ok {
-			continue
+// Returns copy of configuration with its secrets redacted
+func (cnf *LoadBalancerYAMLConfiguration) redacted() (*LoadBalancerYAMLConfiguration, error) {
+	document := &yaml.Node{}
+	if err := document.Encode(cnf); err != nil {
+		return nil, err
+	}
+	redactYAML(document, configPath{}, cnf.secretPaths)
+	redacted := &LoadBalancerYAMLConfiguration{}
+	if err := document.Decode(redacted); err != nil {
+		return nil, err
+	}
+	return redacted, nil
+}
+
+// Fills in settings left unset with values the service uses in their place, so that dumped
+// configuration shows the effective ones
+func applyRuntimeDefaults(cnf *LoadBalancerYAMLConfiguration) {
+	for index := range cnf.Listeners {
+		listener := &cnf.Listeners[index]
+		passthrough := false
+		for routeIndex := range listener.Routes {
+			route := &listener.Routes[routeIndex]
+			passthrough = passthrough || route.Passthrough
+			if route.TargetWaitTimeout <= 0 {
+				route.TargetWaitTimeout = int(DEFAULT_TARGET_WAIT_TIMEOUT / time.Second)
+			}
+			if route.Hedging != nil && route.Hedging.BudgetPercent <= 0 {
+				route.Hedging.BudgetPercent = DEFAULT_HEDGING_BUDGET_PERCENT
+			}
+			applyTargetDefaults(route.Targets)
+		}
+
+		idleTimeout, shutdownTimeout := time.Duration(0), time.Duration(0)
+		switch listener.Protocol {
+		case LS_PROTOCOL_HTTP, LS_PROTOCOL_HTTPS:
+			if listener.ReadHeaderTimeoutMs <= 0 {
+				listener.ReadHeaderTimeoutMs = int(DEFAULT_LISTENER_READ_HEADER_TIMEOUT / time.Millisecond)
+			}
+			// Connections of passthrough routes default to idle timeout of tcp listeners instead
+			if !passthrough {
+				idleTimeout = DEFAULT_LISTENER_IDLE_TIMEOUT
+			}
+			if listener.Protocol == LS_PROTOCOL_HTTPS {
+				shutdownTimeout = DEFAULT_TCP_SHUTDOWN_TIMEOUT
+			}
+		case LS_PROTOCOL_TCP, LS_PROTOCOL_TLS:
+			idleTimeout, shutdownTimeout = DEFAULT_TCP_IDLE_TIMEOUT, DEFAULT_TCP_SHUTDOWN_TIMEOUT
+		case LS_PROTOCOL_UDP:
+			idleTimeout = DEFAULT_UDP_SESSION_TIMEOUT
+			if listener.MaxSessions <= 0 {
+				listener.MaxSessions = DEFAULT_UDP_MAX_SESSIONS
+			}
+		}
+		if listener.IdleTimeoutMs <= 0 && idleTimeout > 0 {
+			listener.IdleTimeoutMs = int(idleTimeout / time.Millisecond)
+		}
+		if listener.ShutdownTimeoutMs <= 0 && shutdownTimeout > 0 {
+			listener.ShutdownTimeoutMs = int(shutdownTimeout / time.Millisecond)
+		}
+		if listener.RequestID != nil && listener.RequestID.Enabled {
+			if listener.RequestID.Header == "" {
+				listener.RequestID.Header = DEFAULT_REQUEST_ID_HEADER
+			}
+			if listener.RequestID.Format == "" {
+				listener.RequestID.Format = DEFAULT_REQUEST_ID_FORMAT
+			}
+		}
+	}
+
+	for name, upstream := range cnf.Upstreams {
+		if upstream.HealthCheck != nil {
+			if upstream.HealthCheck.Path == "" {
+				upstream.HealthCheck.Path = DEFAULT_HEALTH_CHECK_PATH
+			}
+			if upstream.HealthCheck.IntervalMs <= 0 {
+				upstream.HealthCheck.IntervalMs = int(DEFAULT_HEALTH_CHECK_INTERVAL / time.Millisecond)
+			}
+			if upstream.HealthCheck.TimeoutMs <= 0 {
+				upstream.HealthCheck.TimeoutMs = int(DEFAULT_HEALTH_CHECK_TIMEOUT / time.Millisecond)
+			}
+		}
+		applyTargetDefaults(upstream.Targets)
+		cnf.Upstreams[name] = upstream
+	}
+
+	if cnf.Admin != nil && cnf.Admin.MetricsPath == "" {
+		cnf.Admin.MetricsPath = DEFAULT_METRICS_PATH
+	}
+	if cnf.AccessLog != nil {
+		if cnf.AccessLog.Format == "" {
+			cnf.AccessLog.Format = DEFAULT_ACCESS_LOG_FORMAT
+		}
+		if cnf.AccessLog.Output == "" {
+			cnf.AccessLog.Output = DEFAULT_ACCESS_LOG_OUTPUT
+		}
+		if cnf.AccessLog.Output == ACCESS_LOG_OUTPUT_SYSLOG && cnf.AccessLog.SyslogTag == "" {
+			cnf.AccessLog.SyslogTag = DEFAULT_ACCESS_LOG_TAG
 		}
 	}
-	return
 }
 
-func UnmarshalYAML(contents *[]byte) (cnf *LoadBalancerYAMLConfiguration) {
-	cnf = &LoadBalancerYAMLConfiguration{}
-	if err := yaml.Unmarshal(*contents, cnf); err != nil {
-		log.Error().Err(err)
+func applyTargetDefaults(targets []TargetYAMLConfig) {
+	for index := range targets {
+		if targets[index].Weight <= 0 {
+			targets[index].Weight = DEFAULT_TARGET_WEIGHT
+		}
 	}
+}
 
-	portCheckPool := map[string]bool{}
-	balancerIdsCheckPool := map[string]bool{}
+func loadConfigFromString(fileContents string, format string) (*LoadBalancerYAMLConfiguration, error) {
+	if format == "" {
+		format = CONFIG_FORMAT_YAML
+	}
+	return ParseConfigAs([]byte(fileContents), format)
+}
 
-	if len(cnf.Listeners) > 0 {
-		for _, listener := range cnf.Listeners {
+func _getHashedString(key string) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	b := make([]byte, AUTO_GENERATED_BALANCER_ID_LENGTH)
+	for i := range b {
+		b[i] = letterBytes[sum%uint64(len(letterBytes))]
+		sum /= uint64(len(letterBytes))
+	}
+	return string(b)
+}
 
-			// check protocol field
-			if listener.Protocol == "" {
-				log.Info().Msgf("Protocol field not set, hence setting to default '%v'", DefaultListenerProtocol)
-				listener.Protocol = DefaultListenerProtocol
-			} else if !IsValidListenerProtocol(listener.Protocol) {
-				log.Error().Msgf("Listener Protocol is not valid. Valid values are : '%+v", strings.Join(supportedListenerProtocols, "', '"))
-			}
+// Derives id of route which has none from port of its listener and the requests it takes,
+// so that route keeps its id, and with it its balancer, across configuration reloads
+func generateBalancerId(port string, route *RouteYAMLConfig, balancerIdsPool map[string]configPath) (newId string) {
+	routePrefix := route.Routeprefix
+	if routePrefix == "" && !route.Passthrough {
+		routePrefix = DefaultRoutePrefix
+	}
+	key := port + "|" + routePrefix + "|" + strings.Join(route.ServerNames, ",")
+	for attempt := 0; ; attempt++ {
+		newId = _getHashedString(fmt.Sprintf("%v|%v", key, attempt))
+		if _, ok := balancerIdsPool[newId]; !ok {
+			return
+		}
+	}
+}
 
-			// Check Port field
-			if listener.Port == "" {
-				log.Info().Msgf("Port not specified, hence setting to default port '%v'", DefaultListenerPort)
-				listener.Port = DefaultListenerPort
-			}
-			portCheckPool[listener.Protocol+":"+listener.Port] = true
+// Parses and validates configuration, filling in defaults. Environment variables,
+// `file://` references and includes are resolved first. Returns `ConfigErrors` listing
+// every problem found, in which case no configuration is returned.
+func ParseConfig(contents []byte) (*LoadBalancerYAMLConfiguration, error) {
+	return parseConfig(contents, CONFIG_FORMAT_YAML, "")
+}
 
-			// Check secure listener settings
-			if listener.Protocol == LS_PROTOCOL_HTTPS {
-				if listener.SSLCertificate == "" || listener.SSLCertificateKey == "" {
-					log.Error().Msgf("SSL certificate fields are mandatory if protocol is set to '%v'", LS_PROTOCOL_HTTPS)
-				}
-			}
+// Parses configuration written in given format
+func ParseConfigAs(contents []byte, format string) (*LoadBalancerYAMLConfiguration, error) {
+	return parseConfig(contents, format, "")
+}
 
-			for index, route := range listener.Routes {
-				// Check Id field
-				if len(route.Id) < 1 {
-					route.Id = generateBalancerId(balancerIdsCheckPool)
-					listener.Routes[index].Id = route.Id
-					log.Info().Str("new-id", route.Id).Msg("Id field was not set hence auto-assigning a unique identifier")
-				}
-				balancerIdsCheckPool[route.Id] = true
-
-				// Check Route Prefix field
-				if len(route.Routeprefix) < 1 {
-					log.Info().Str("balancer", route.Id).Msg("`routeprefix` field not specified. Set to '/' by default.")
-					route.Routeprefix = DefaultRoutePrefix
-				}
-
-				// Check Mode field
-				if route.Mode == "" {
-					route.Mode = DefaultLoadBalancerType
-					log.Info().Str("balancer", route.Id).Msgf("Mode field defaults to '%v'", DefaultLoadBalancerType)
-				}
-				if !IsValidBalancerMode(route.Mode) {
-					log.Error().Str("balancer", route.Id).Msgf("Mode field is set to '%v', which is invalid. Supported types are : '%+v'", route.Mode, strings.Join(supportedBalancers, "', '"))
-				}
-
-				// Check targets field
-				if len(route.Targets) < 1 {
-					log.Error().Str("balancer", route.Id).Msg("No redirection targets mentioned")
-				}
-			}
+// Parses configuration read from `file`, which relative paths are resolved against
+func parseConfig(contents []byte, format string, file string) (*LoadBalancerYAMLConfiguration, error) {
+	validator := &configValidator{
+		files:       map[*yaml.Node]string{},
+		secretNodes: map[*yaml.Node]bool{},
+		secretPaths: map[string]bool{},
+	}
+	validator.root = validator.loadDocument(contents, format, file, nil)
+	if validator.root == nil || len(validator.errs) > validator.typeErrors {
+		return nil, validator.errs
+	}
+	validator.collectSecretPaths(validator.root, configPath{})
+
+	// Secrets are tracked per configuration, so that those of previously loaded ones do not linger
+	cnf := &LoadBalancerYAMLConfiguration{secretPaths: validator.secretPaths}
+	// Empty document leaves root node without kind
+	if validator.root.Kind != 0 {
+		// Type errors were reported for every file already
+		if err := validator.root.Decode(cnf); err != nil && validator.typeErrors == 0 {
+			validator.errs = append(validator.errs, newYAMLError("", err.Error()))
 		}
-	} else {
-		log.Info().Msg("No listeners were configured")
 	}
+	validator.checkKnownFields(validator.root, reflect.TypeOf(cnf), configPath{})
+	validator.validate(cnf)
 
-	return
+	if len(validator.errs) > 0 {
+		return nil, validator.errs
+	}
+	return cnf, nil
 }
@@ -0,0 +1,90 @@
+package src
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Listener which limits number of concurrent connections from a single client IP.
+// Connections over the limit are closed right after being accepted.
+type ipLimitListener struct {
+	net.Listener
+	maxPerIP int
+	mu       sync.Mutex
+	conns    map[string]int
+	rejected int64
+}
+
+func newIPLimitListener(listener net.Listener, maxPerIP int) *ipLimitListener {
+	return &ipLimitListener{
+		Listener: listener,
+		maxPerIP: maxPerIP,
+		conns:    map[string]int{},
+	}
+}
+
+func (ll *ipLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+
+		ll.mu.Lock()
+		if ll.conns[ip] >= ll.maxPerIP {
+			ll.mu.Unlock()
+			atomic.AddInt64(&ll.rejected, 1)
+			log.Info().Str("client", ip).Int("limit", ll.maxPerIP).Msg("Connection rejected. Too many connections from client.")
+			conn.Close()
+			continue
+		}
+		ll.conns[ip]++
+		ll.mu.Unlock()
+
+		return &ipLimitConn{Conn: conn, listener: ll, ip: ip}, nil
+	}
+}
+
+func (ll *ipLimitListener) release(ip string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.conns[ip]--
+	if ll.conns[ip] <= 0 {
+		delete(ll.conns, ip)
+	}
+}
+
+// Returns number of connections rejected due to per IP limit
+func (ll *ipLimitListener) Rejected() int64 {
+	return atomic.LoadInt64(&ll.rejected)
+}
+
+type ipLimitConn struct {
+	net.Conn
+	listener *ipLimitListener
+	ip       string
+	once     sync.Once
+}
+
+func (lc *ipLimitConn) Close() error {
+	err := lc.Conn.Close()
+	lc.once.Do(func() {
+		lc.listener.release(lc.ip)
+	})
+	return err
+}
+
+// Closes writing side of connection, so that tcp listeners can pass half close on
+func (lc *ipLimitConn) CloseWrite() error {
+	if closer, ok := lc.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return lc.Close()
+}
@@ -0,0 +1,174 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_CONSUL_WAIT           = 60 * time.Second
+	DEFAULT_CONSUL_RETRY_INTERVAL = time.Second
+	// Time catalog is given to respond on top of blocking wait
+	CONSUL_REQUEST_TIMEOUT = 10 * time.Second
+	// Service metadata key holding weight of instance, overriding weights registered with catalog
+	CONSUL_WEIGHT_META_KEY = "weight"
+	// Header carrying index of catalog state, sent back to block until it changes
+	CONSUL_INDEX_HEADER = "X-Consul-Index"
+	CONSUL_TOKEN_HEADER = "X-Consul-Token"
+)
+
+type ConsulDiscoveryYAMLConfig struct {
+	// Base URL of catalog HTTP API
+	Address string `yaml:"address"`
+	Service string `yaml:"service"`
+	// Only instances carrying every tag are targets
+	Tags       []string `yaml:"tags"`
+	Datacenter string   `yaml:"datacenter"`
+	// ACL token sent with queries
+	Token string `yaml:"token"`
+	// Scheme of target addresses, `http` or `https`
+	Scheme string `yaml:"scheme"`
+	// Longest time catalog holds a query while waiting for changes
+	WaitMs int `yaml:"waitMs"`
+	// Time to wait before querying again after catalog failed
+	RetryIntervalMs int `yaml:"retryIntervalMs"`
+}
+
+// Entry of health endpoint response, fields not used are left out
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// Resolves healthy instances of service registered with Consul-compatible catalog. Queries
+// block until catalog changes, so changes are applied as soon as they are registered.
+type consulResolver struct {
+	Address       string
+	Service       string
+	Tags          []string
+	Datacenter    string
+	Token         string
+	Scheme        string
+	Wait          time.Duration
+	retryInterval time.Duration
+	client        *http.Client
+	// Index of catalog state last read
+	index uint64
+}
+
+func newConsulResolver(cnf *ConsulDiscoveryYAMLConfig) *consulResolver {
+	resolver := &consulResolver{
+		Address:       strings.TrimSuffix(cnf.Address, "/"),
+		Service:       cnf.Service,
+		Tags:          cnf.Tags,
+		Datacenter:    cnf.Datacenter,
+		Token:         cnf.Token,
+		Scheme:        cnf.Scheme,
+		Wait:          time.Duration(cnf.WaitMs) * time.Millisecond,
+		retryInterval: time.Duration(cnf.RetryIntervalMs) * time.Millisecond,
+		client:        &http.Client{},
+	}
+	if resolver.Scheme == "" {
+		resolver.Scheme = DEFAULT_DISCOVERY_SCHEME
+	}
+	if resolver.Wait <= 0 {
+		resolver.Wait = DEFAULT_CONSUL_WAIT
+	}
+	if resolver.retryInterval <= 0 {
+		resolver.retryInterval = DEFAULT_CONSUL_RETRY_INTERVAL
+	}
+	return resolver
+}
+
+func (r *consulResolver) RetryInterval() time.Duration {
+	return r.retryInterval
+}
+
+func (r *consulResolver) Resolve(ctx context.Context) ([]discoveredTarget, time.Duration, error) {
+	query := url.Values{}
+	query.Set("passing", "true")
+	for _, tag := range r.Tags {
+		query.Add("tag", tag)
+	}
+	if r.Datacenter != "" {
+		query.Set("dc", r.Datacenter)
+	}
+	if r.index > 0 {
+		query.Set("index", strconv.FormatUint(r.index, 10))
+		query.Set("wait", fmt.Sprintf("%dms", r.Wait.Milliseconds()))
+	}
+
+	// Catalog may add jitter of up to 1/16 of wait time to blocking queries
+	ctx, cancel := context.WithTimeout(ctx, r.Wait+r.Wait/16+CONSUL_REQUEST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Address+"/v1/health/service/"+url.PathEscape(r.Service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Token != "" {
+		req.Header.Set(CONSUL_TOKEN_HEADER, r.Token)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("catalog responded with status %v", res.StatusCode)
+	}
+	entries := []consulServiceEntry{}
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("catalog sent malformed response: %w", err)
+	}
+
+	index, _ := strconv.ParseUint(res.Header.Get(CONSUL_INDEX_HEADER), 10, 64)
+	unchanged := index > 0 && index == r.index
+	// Index going backwards means catalog state was reset, so blocking starts over
+	if index < r.index {
+		index = 0
+	}
+	r.index = index
+
+	targets := make([]discoveredTarget, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		target := discoveredTarget{
+			Address: r.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Weight:  entry.Service.Weights.Passing,
+			Labels:  entry.Service.Meta,
+		}
+		if weight, err := strconv.Atoi(entry.Service.Meta[CONSUL_WEIGHT_META_KEY]); err == nil && weight > 0 {
+			target.Weight = weight
+		}
+		targets = append(targets, target)
+	}
+
+	// Catalog which does not block, or did not change before wait passed, is not queried in a loop
+	if unchanged || index == 0 {
+		return targets, r.retryInterval, nil
+	}
+	return targets, 0, nil
+}
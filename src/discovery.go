@@ -0,0 +1,387 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Time drained targets which disappeared from discovery are given to complete their requests
+	DEFAULT_DISCOVERY_DRAIN_TIMEOUT = 30 * time.Second
+	// Scheme of discovered target addresses, for sources which do not name one
+	DEFAULT_DISCOVERY_SCHEME = "http"
+)
+
+// Target found by discovery
+type discoveredTarget struct {
+	Address string
+	// Overrides weight of target entry, if set
+	Weight int
+	Labels map[string]string
+	// Target is going away and should receive no new requests, it is not added if missing
+	Draining bool
+}
+
+// Source of targets which change at runtime
+type targetResolver interface {
+	// Returns current targets and time after which they should be resolved again
+	Resolve(ctx context.Context) ([]discoveredTarget, time.Duration, error)
+	// Time to wait before resolving again after an error
+	RetryInterval() time.Duration
+}
+
+// Returns true if target entry lists targets resolved at runtime rather than a single address
+func (targetConfig *TargetYAMLConfig) IsDiscovered() bool {
+	return targetConfig.DNS != nil || targetConfig.File != nil || targetConfig.Consul != nil ||
+		targetConfig.Kubernetes != nil
+}
+
+// Identifies source of discovered targets, so that it can be matched across reloads
+func (targetConfig *TargetYAMLConfig) discoveryKey() string {
+	key, _ := json.Marshal(struct {
+		DNS        *DNSDiscoveryYAMLConfig
+		File       *FileDiscoveryYAMLConfig
+		Consul     *ConsulDiscoveryYAMLConfig
+		Kubernetes *KubernetesDiscoveryYAMLConfig
+	}{targetConfig.DNS, targetConfig.File, targetConfig.Consul, targetConfig.Kubernetes})
+	return string(key)
+}
+
+// Returns name of discovery source and its scheme setting, nil if source lists whole addresses
+func (targetConfig *TargetYAMLConfig) discoveryScheme() (string, *string) {
+	switch {
+	case targetConfig.DNS != nil:
+		return "dns", &targetConfig.DNS.Scheme
+	case targetConfig.Consul != nil:
+		return "consul", &targetConfig.Consul.Scheme
+	case targetConfig.Kubernetes != nil:
+		return "kubernetes", &targetConfig.Kubernetes.Scheme
+	}
+	return "file", nil
+}
+
+func newTargetResolver(targetConfig *TargetYAMLConfig) targetResolver {
+	if targetConfig.File != nil {
+		return newFileResolver(targetConfig.File)
+	}
+	if targetConfig.Consul != nil {
+		return newConsulResolver(targetConfig.Consul)
+	}
+	if targetConfig.Kubernetes != nil {
+		return newKubernetesResolver(targetConfig.Kubernetes)
+	}
+	return newDNSResolver(targetConfig.DNS)
+}
+
+// Keeps targets of balancer or upstream in sync with a discovery source. Targets are added
+// once they are found and drained once they disappear; targets found again keep their
+// connections and counters.
+type TargetDiscovery struct {
+	// Entry discovered targets are created from
+	config   TargetYAMLConfig
+	resolver targetResolver
+	logger   zerolog.Logger
+	// Addresses of targets added by discovery, and of those being drained as they disappeared
+	owned    map[string]bool
+	retiring map[string]bool
+	mu       sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTargetDiscovery(targetConfig *TargetYAMLConfig) *TargetDiscovery {
+	return &TargetDiscovery{
+		config:   *targetConfig,
+		resolver: newTargetResolver(targetConfig),
+		logger:   log.With().Str("discovery", targetConfig.discoveryKey()).Logger(),
+		owned:    map[string]bool{},
+		retiring: map[string]bool{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Starts resolving targets into `targets`, until stopped
+func (td *TargetDiscovery) Start(targets targetSet) {
+	go func() {
+		defer close(td.done)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-td.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		for {
+			interval := td.refresh(ctx, targets)
+			timer := time.NewTimer(interval)
+			select {
+			case <-td.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// Resolves targets once, returning time after which they should be resolved again
+func (td *TargetDiscovery) refresh(ctx context.Context, targets targetSet) time.Duration {
+	found, interval, err := td.resolver.Resolve(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			td.logger.Warn().Err(err).Msg("Target discovery failed, keeping current targets")
+		}
+		return td.resolver.RetryInterval()
+	}
+	td.reconcile(targets, found)
+	return interval
+}
+
+// Adds targets which were found and drains owned targets which were not, or which are
+// going away. Targets are added and replaced in a single change of `targets`.
+func (td *TargetDiscovery) reconcile(targets targetSet, found []discoveredTarget) {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+
+	removed := []*Target{}
+	added := []*TargetYAMLConfig{}
+	current := map[string]bool{}
+	for _, discovered := range found {
+		if current[discovered.Address] {
+			continue
+		}
+		current[discovered.Address] = true
+		weight := discovered.Weight
+		if weight <= 0 {
+			weight = td.config.Weight
+		}
+		if weight <= 0 {
+			weight = DEFAULT_TARGET_WEIGHT
+		}
+
+		targetCnf := td.config
+		targetCnf.DNS, targetCnf.File, targetCnf.Consul, targetCnf.Kubernetes = nil, nil, nil, nil
+		targetCnf.Address = discovered.Address
+		targetCnf.Weight = weight
+		if len(discovered.Labels) > 0 {
+			targetCnf.Labels = discovered.Labels
+		}
+
+		target := targets.FindTarget(discovered.Address)
+		switch {
+		case target == nil && discovered.Draining:
+		case target == nil:
+			added = append(added, &targetCnf)
+			td.owned[discovered.Address] = true
+			td.logger.Info().Str("address", discovered.Address).Msg("Discovered target added")
+		case td.owned[discovered.Address] && discovered.Draining:
+			// Drain lasts while target is listed, it is retired once it disappears
+			if !target.IsDraining() {
+				target.StartDrain()
+				td.logger.Info().Str("address", discovered.Address).Msg("Discovered target is going away, draining")
+			}
+		case td.owned[discovered.Address] && !labelsEqual(target.Labels, targetCnf.Labels):
+			// Labels are read without locks, so target is replaced rather than changed
+			removed = append(removed, target)
+			added = append(added, &targetCnf)
+			delete(td.retiring, discovered.Address)
+			td.logger.Info().Str("address", discovered.Address).Msg("Discovered target labels changed, target replaced")
+		case td.owned[discovered.Address]:
+			if target.IsDraining() {
+				delete(td.retiring, discovered.Address)
+				target.StopDrain()
+				td.logger.Info().Str("address", discovered.Address).Msg("Discovered target is back")
+			}
+			if currentWeight, _ := targets.TargetWeight(discovered.Address); currentWeight != weight {
+				targets.SetTargetWeight(discovered.Address, weight)
+			}
+		}
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		targets.replaceTargets(removed, added)
+	}
+
+	for address := range td.owned {
+		if current[address] {
+			continue
+		}
+		target := targets.FindTarget(address)
+		if target == nil {
+			delete(td.owned, address)
+			delete(td.retiring, address)
+			continue
+		}
+		if !td.retiring[address] {
+			td.logger.Info().Str("address", address).Msg("Target no longer discovered, draining")
+			td.retiring[address] = true
+			address := address
+			retireTarget(targets, target, td.drainTimeout(), func() {
+				td.mu.Lock()
+				delete(td.owned, address)
+				delete(td.retiring, address)
+				td.mu.Unlock()
+			})
+		}
+	}
+}
+
+func labelsEqual(a map[string]string, b map[string]string) bool {
+	return (len(a) == 0 && len(b) == 0) || reflect.DeepEqual(a, b)
+}
+
+func (td *TargetDiscovery) drainTimeout() time.Duration {
+	if td.config.DrainTimeoutMs > 0 {
+		return time.Duration(td.config.DrainTimeoutMs) * time.Millisecond
+	}
+	return DEFAULT_DISCOVERY_DRAIN_TIMEOUT
+}
+
+// Drains target, then removes it from `targets` once it has no requests in flight or
+// `deadline` passes. Nothing is removed if drain is stopped first.
+func retireTarget(targets targetSet, target *Target, deadline time.Duration, onRemoved func()) {
+	done, cancelled := target.StartDrain()
+	go func() {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		select {
+		case <-cancelled:
+			return
+		case <-done:
+		case <-timer.C:
+		}
+		if targets.removeTarget(target) {
+			onRemoved()
+		}
+	}()
+}
+
+// Stops discovery and waits till it completes, targets it added are kept
+func (td *TargetDiscovery) Stop() {
+	td.stopOnce.Do(func() {
+		close(td.stop)
+	})
+	<-td.done
+}
+
+// Removes targets added by discovery from `targets`. Requests in flight are not interrupted.
+func (td *TargetDiscovery) removeTargets(targets targetSet) {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	for address := range td.owned {
+		if target := targets.FindTarget(address); target != nil {
+			targets.removeTarget(target)
+		}
+		delete(td.owned, address)
+		delete(td.retiring, address)
+	}
+}
+
+// Takes over targets added by previous discovery of the same source. Targets which were
+// being drained are drained again by the new discovery, as they may belong to another set.
+func (td *TargetDiscovery) adopt(previous *TargetDiscovery) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	for address := range previous.owned {
+		td.owned[address] = true
+	}
+}
+
+// Discoveries running for a balancer or upstream, keyed by their source
+type targetDiscoveries struct {
+	running map[string]*TargetDiscovery
+	mu      sync.Mutex
+}
+
+// Adds targets listed in configuration to `targets`, starting discovery of entries which
+// are resolved at runtime
+func addConfiguredTargets(targets targetSet, targetCnfs []TargetYAMLConfig) {
+	for index := range targetCnfs {
+		if targetCnfs[index].IsDiscovered() {
+			targets.discoveries().start(targets, &targetCnfs[index], nil)
+			continue
+		}
+		targets.AddNewServer(&targetCnfs[index])
+	}
+}
+
+// Starts discovery of target entry, taking over targets of `previous` if given
+func (tds *targetDiscoveries) start(targets targetSet, targetConfig *TargetYAMLConfig, previous *TargetDiscovery) {
+	discovery := newTargetDiscovery(targetConfig)
+	if previous != nil {
+		previous.Stop()
+		discovery.adopt(previous)
+	}
+	tds.mu.Lock()
+	if tds.running == nil {
+		tds.running = map[string]*TargetDiscovery{}
+	}
+	tds.running[targetConfig.discoveryKey()] = discovery
+	tds.mu.Unlock()
+	discovery.Start(targets)
+}
+
+// Reconciles discoveries with target entries of new configuration. Discoveries of unchanged
+// entries keep running; when only weight or drain timeout of an entry changed, its targets
+// are taken over by the new discovery. `previous` holds discoveries of the balancer `targets` replace, or is
+// the same as `tds`.
+func (tds *targetDiscoveries) reload(targets targetSet, previous *targetDiscoveries, targetCnfs []TargetYAMLConfig) {
+	previous.mu.Lock()
+	running := previous.running
+	previous.running = nil
+	previous.mu.Unlock()
+
+	for index := range targetCnfs {
+		targetCnf := &targetCnfs[index]
+		if !targetCnf.IsDiscovered() {
+			continue
+		}
+		key := targetCnf.discoveryKey()
+		discovery, found := running[key]
+		delete(running, key)
+		switch {
+		case found && tds == previous && reflect.DeepEqual(discovery.config, *targetCnf):
+			tds.mu.Lock()
+			if tds.running == nil {
+				tds.running = map[string]*TargetDiscovery{}
+			}
+			tds.running[key] = discovery
+			tds.mu.Unlock()
+		case found && targetSettingsEqual(&discovery.config, targetCnf):
+			tds.start(targets, targetCnf, discovery)
+		case found:
+			discovery.Stop()
+			discovery.removeTargets(targets)
+			tds.start(targets, targetCnf, nil)
+		default:
+			tds.start(targets, targetCnf, nil)
+		}
+	}
+
+	for _, discovery := range running {
+		discovery.Stop()
+		discovery.removeTargets(targets)
+	}
+}
+
+// Stops every discovery, keeping targets they added
+func (tds *targetDiscoveries) Stop() {
+	tds.mu.Lock()
+	running := tds.running
+	tds.running = nil
+	tds.mu.Unlock()
+	for _, discovery := range running {
+		discovery.Stop()
+	}
+}
@@ -0,0 +1,314 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Types of DNS records targets are discovered from
+const (
+	DNS_RECORD_A   = "A"
+	DNS_RECORD_SRV = "SRV"
+
+	DEFAULT_DNS_RECORD_TYPE  = DNS_RECORD_A
+	DEFAULT_DNS_MIN_INTERVAL = time.Second
+	DEFAULT_DNS_MAX_INTERVAL = 60 * time.Second
+	DNS_QUERY_TIMEOUT        = 2 * time.Second
+
+	// Name servers are read from here if not configured
+	RESOLV_CONF_PATH    = "/etc/resolv.conf"
+	DEFAULT_DNS_SERVER  = "127.0.0.1:53"
+	DNS_MAX_PACKET_SIZE = 65535
+)
+
+var supportedDNSRecordTypes []string = []string{
+	DNS_RECORD_A, DNS_RECORD_SRV,
+}
+
+func IsValidDNSRecordType(recordType string) bool {
+	for _, val := range supportedDNSRecordTypes {
+		if val == recordType {
+			return true
+		}
+	}
+	return false
+}
+
+type DNSDiscoveryYAMLConfig struct {
+	// Hostname whose A and AAAA records are targets, or name of SRV record
+	Name string `yaml:"name"`
+	// Type of records, `A` (which includes AAAA) or `SRV`
+	Type string `yaml:"type"`
+	// Port of targets resolved from A and AAAA records, SRV records carry their own
+	Port int `yaml:"port"`
+	// Scheme of target addresses, `http` or `https`
+	Scheme string `yaml:"scheme"`
+	// Name server as `host:port`, first one listed in /etc/resolv.conf if not set
+	Server string `yaml:"server"`
+	// Records are resolved again once their TTL expires, within these bounds
+	MinIntervalMs int `yaml:"minIntervalMs"`
+	MaxIntervalMs int `yaml:"maxIntervalMs"`
+}
+
+// Resolves hostname or SRV record into targets, querying name server directly so that
+// record TTLs are known
+type dnsResolver struct {
+	Name        string
+	Type        string
+	Port        int
+	Scheme      string
+	Server      string
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+func newDNSResolver(cnf *DNSDiscoveryYAMLConfig) *dnsResolver {
+	resolver := &dnsResolver{
+		Name:        cnf.Name,
+		Type:        cnf.Type,
+		Port:        cnf.Port,
+		Scheme:      cnf.Scheme,
+		Server:      cnf.Server,
+		MinInterval: time.Duration(cnf.MinIntervalMs) * time.Millisecond,
+		MaxInterval: time.Duration(cnf.MaxIntervalMs) * time.Millisecond,
+	}
+	if !strings.HasSuffix(resolver.Name, ".") {
+		resolver.Name += "."
+	}
+	if resolver.Type == "" {
+		resolver.Type = DEFAULT_DNS_RECORD_TYPE
+	}
+	if resolver.Scheme == "" {
+		resolver.Scheme = DEFAULT_DISCOVERY_SCHEME
+	}
+	if resolver.MinInterval <= 0 {
+		resolver.MinInterval = DEFAULT_DNS_MIN_INTERVAL
+	}
+	if resolver.MaxInterval <= 0 {
+		resolver.MaxInterval = DEFAULT_DNS_MAX_INTERVAL
+	}
+	if resolver.MaxInterval < resolver.MinInterval {
+		resolver.MaxInterval = resolver.MinInterval
+	}
+	return resolver
+}
+
+func (r *dnsResolver) RetryInterval() time.Duration {
+	return r.MinInterval
+}
+
+// Returns targets named by records, and the lowest TTL among those records bounded by
+// configured intervals
+func (r *dnsResolver) Resolve(ctx context.Context) ([]discoveredTarget, time.Duration, error) {
+	server := r.Server
+	if server == "" {
+		server = systemNameServer()
+	}
+	ttl := r.MaxInterval
+	observe := func(header dnsmessage.ResourceHeader) {
+		if recordTTL := time.Duration(header.TTL) * time.Second; recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+
+	targets := []discoveredTarget{}
+	if r.Type == DNS_RECORD_SRV {
+		response, err := queryDNS(ctx, server, r.Name, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Only records of the lowest priority are used, others are backups
+		records := []dnsmessage.Resource{}
+		for _, answer := range response.Answers {
+			srv, ok := answer.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			if len(records) > 0 && srv.Priority > records[0].Body.(*dnsmessage.SRVResource).Priority {
+				continue
+			}
+			if len(records) > 0 && srv.Priority < records[0].Body.(*dnsmessage.SRVResource).Priority {
+				records = records[:0]
+			}
+			records = append(records, answer)
+		}
+		for _, record := range records {
+			srv := record.Body.(*dnsmessage.SRVResource)
+			observe(record.Header)
+			ips := addressRecords(response.Additionals, srv.Target.String(), observe)
+			if len(ips) == 0 {
+				ips, err = r.resolveHost(ctx, server, srv.Target.String(), observe)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			for _, ip := range ips {
+				targets = append(targets, discoveredTarget{
+					Address: r.address(ip, int(srv.Port)),
+					Weight:  int(srv.Weight),
+				})
+			}
+		}
+	} else {
+		ips, err := r.resolveHost(ctx, server, r.Name, observe)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ip := range ips {
+			targets = append(targets, discoveredTarget{Address: r.address(ip, r.Port)})
+		}
+	}
+
+	if len(targets) == 0 {
+		ttl = r.MinInterval
+	}
+	if ttl < r.MinInterval {
+		ttl = r.MinInterval
+	}
+	return targets, ttl, nil
+}
+
+func (r *dnsResolver) address(ip string, port int) string {
+	return r.Scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// Returns addresses from A and AAAA records of host
+func (r *dnsResolver) resolveHost(ctx context.Context, server string, host string, observe func(dnsmessage.ResourceHeader)) ([]string, error) {
+	ips := []string{}
+	for _, recordType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		response, err := queryDNS(ctx, server, host, recordType)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, addressRecords(response.Answers, "", observe)...)
+	}
+	return ips, nil
+}
+
+// Returns addresses held by A and AAAA records, of given host if it is set
+func addressRecords(records []dnsmessage.Resource, host string, observe func(dnsmessage.ResourceHeader)) []string {
+	ips := []string{}
+	for _, record := range records {
+		if host != "" && !strings.EqualFold(record.Header.Name.String(), host) {
+			continue
+		}
+		switch body := record.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		default:
+			continue
+		}
+		observe(record.Header)
+	}
+	return ips
+}
+
+// Sends query to name server over UDP, retrying over TCP if response was truncated.
+// Name which does not exist resolves to no records.
+func queryDNS(ctx context.Context, server string, name string, recordType dnsmessage.Type) (*dnsmessage.Message, error) {
+	questionName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: questionName, Type: recordType, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DNS_QUERY_TIMEOUT)
+	defer cancel()
+	response, err := exchangeDNS(ctx, "udp", server, packed)
+	if err == nil && response.Truncated {
+		response, err = exchangeDNS(ctx, "tcp", server, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.ID != query.ID || !response.Response {
+		return nil, fmt.Errorf("name server %v sent unexpected response to query for %v", server, name)
+	}
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+		return response, nil
+	case dnsmessage.RCodeNameError:
+		return &dnsmessage.Message{}, nil
+	}
+	return nil, fmt.Errorf("name server %v failed to resolve %v: %v", server, name, response.RCode)
+}
+
+func exchangeDNS(ctx context.Context, network string, server string, packed []byte) (*dnsmessage.Message, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buffer := make([]byte, DNS_MAX_PACKET_SIZE)
+	var length int
+	if network == "tcp" {
+		// Messages sent over TCP are prefixed with their length
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buffer[:2]); err != nil {
+			return nil, err
+		}
+		length = int(binary.BigEndian.Uint16(buffer[:2]))
+		if _, err := io.ReadFull(conn, buffer[:length]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if length, err = conn.Read(buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	response := &dnsmessage.Message{}
+	if err := response.Unpack(buffer[:length]); err != nil {
+		return nil, fmt.Errorf("name server %v sent malformed response: %w", server, err)
+	}
+	return response, nil
+}
+
+// Returns first name server listed in resolv.conf
+func systemNameServer() string {
+	file, err := os.Open(RESOLV_CONF_PATH)
+	if err != nil {
+		return DEFAULT_DNS_SERVER
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return DEFAULT_DNS_SERVER
+}
@@ -0,0 +1,122 @@
+package src
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Stops sending new requests to target. Returned `done` channel is closed once the last
+// in-flight request completes, `cancelled` once drain is stopped by `StopDrain`.
+func (s *Target) StartDrain() (done <-chan struct{}, cancelled <-chan struct{}) {
+	s.drainMu.Lock()
+	if atomic.LoadInt32(&s.draining) == 0 {
+		s.drainDone = make(chan struct{})
+		s.drainCancel = make(chan struct{})
+		atomic.StoreInt32(&s.draining, 1)
+		log.Info().Str("address", s.Address).Int64("inFlight", s.ActiveConnections()).Msg("Target draining")
+	}
+	done, cancelled = s.drainDone, s.drainCancel
+	s.drainMu.Unlock()
+
+	s.checkDrained()
+	return done, cancelled
+}
+
+// Returns target to service
+func (s *Target) StopDrain() {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if atomic.LoadInt32(&s.draining) == 0 {
+		return
+	}
+	atomic.StoreInt32(&s.draining, 0)
+	close(s.drainCancel)
+	log.Info().Str("address", s.Address).Msg("Target drain stopped")
+}
+
+func (s *Target) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Returns true if target is draining and has no in-flight requests left
+func (s *Target) IsDrained() bool {
+	return s.IsDraining() && s.ActiveConnections() == 0
+}
+
+// Counts a new in-flight request on target. Fails, leaving the count unchanged, if target
+// started draining after it was selected, so that drain can not complete while a request
+// which selected target before drain started is yet to be counted.
+func (s *Target) reserve() bool {
+	atomic.AddInt64(&s.Connections, 1)
+	if s.IsDraining() {
+		atomic.AddInt64(&s.Connections, -1)
+		s.checkDrained()
+		return false
+	}
+	return true
+}
+
+// Reports drain completion once in-flight requests of draining target reach zero
+func (s *Target) checkDrained() {
+	if !s.IsDrained() {
+		return
+	}
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	select {
+	case <-s.drainDone:
+	default:
+		if s.IsDrained() {
+			close(s.drainDone)
+			log.Info().Str("address", s.Address).Msg("Target drained")
+		}
+	}
+}
+
+// Drains target with given address. If `deadline` is set and requests are still in flight
+// when it passes, target is removed from balancer regardless. Those requests are not
+// interrupted.
+func (lb *Balancer) DrainTarget(address string, deadline time.Duration) error {
+	target := lb.FindTarget(address)
+	if target == nil {
+		return ErrTargetNotFound
+	}
+	drainTarget(target, deadline, log.With().Str("balancer", lb.Id).Logger(), lb.removeTarget)
+	return nil
+}
+
+// Starts draining target, calling `remove` if it is still draining once `deadline` passes
+func drainTarget(target *Target, deadline time.Duration, logger zerolog.Logger, remove func(*Target) bool) {
+	done, cancelled := target.StartDrain()
+	if deadline <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-cancelled:
+		case <-timer.C:
+			logger.Warn().Str("address", target.Address).Int64("inFlight", target.ActiveConnections()).
+				Msg("Drain deadline passed, removing target")
+			remove(target)
+		}
+	}()
+}
+
+func (lb *Balancer) UndrainTarget(address string) error {
+	if lb.Upstream != nil {
+		return lb.Upstream.UndrainTarget(address)
+	}
+	target := lb.FindTarget(address)
+	if target == nil {
+		return ErrTargetNotFound
+	}
+	target.StopDrain()
+	lb.Admission.Wake()
+	return nil
+}
@@ -0,0 +1,107 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_FILE_DISCOVERY_INTERVAL = time.Second
+
+type FileDiscoveryYAMLConfig struct {
+	// JSON or YAML file listing targets, relative to configuration file which names it
+	Path string `yaml:"path"`
+	// How often file is checked for changes
+	IntervalMs int `yaml:"intervalMs"`
+}
+
+// Entry of target list file
+type FileTargetYAMLConfig struct {
+	Address string            `yaml:"address"`
+	Weight  int               `yaml:"weight"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// Reads targets from file which is rewritten by other tools. Update is applied only once the
+// whole file is valid, until then the last valid list is kept. Tools should replace the file
+// by renaming, so that it is never read half written.
+type fileResolver struct {
+	Path     string
+	Interval time.Duration
+	// Modification time and size of file `targets` were read from
+	modTime time.Time
+	size    int64
+	targets []discoveredTarget
+}
+
+func newFileResolver(cnf *FileDiscoveryYAMLConfig) *fileResolver {
+	resolver := &fileResolver{
+		Path:     cnf.Path,
+		Interval: time.Duration(cnf.IntervalMs) * time.Millisecond,
+	}
+	if resolver.Interval <= 0 {
+		resolver.Interval = DEFAULT_FILE_DISCOVERY_INTERVAL
+	}
+	return resolver
+}
+
+func (r *fileResolver) RetryInterval() time.Duration {
+	return r.Interval
+}
+
+func (r *fileResolver) Resolve(ctx context.Context) ([]discoveredTarget, time.Duration, error) {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.targets != nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return r.targets, r.Interval, nil
+	}
+	contents, err := os.ReadFile(r.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	targets, err := parseTargetsFile(contents)
+	if err != nil {
+		return nil, 0, fmt.Errorf("target list '%v' is invalid: %w", r.Path, err)
+	}
+	r.modTime, r.size, r.targets = info.ModTime(), info.Size(), targets
+	return targets, r.Interval, nil
+}
+
+// Parses list of targets, JSON being read as YAML. File which holds no document is taken
+// as malformed, as it is more likely truncated than meant to remove every target, which
+// takes an empty list.
+func parseTargetsFile(contents []byte) ([]discoveredTarget, error) {
+	entries := []FileTargetYAMLConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&entries); errors.Is(err, io.EOF) {
+		return nil, errors.New("file holds no target list")
+	} else if err != nil {
+		return nil, err
+	}
+
+	targets := make([]discoveredTarget, 0, len(entries))
+	addresses := map[string]bool{}
+	for index, entry := range entries {
+		if !isValidTargetAddress(entry.Address, "") {
+			return nil, fmt.Errorf("[%v].address: target address '%v' must be %v", index, entry.Address, targetAddressKind(""))
+		}
+		if addresses[entry.Address] {
+			return nil, fmt.Errorf("[%v].address: target address '%v' is listed more than once", index, entry.Address)
+		}
+		addresses[entry.Address] = true
+		if entry.Weight < 0 {
+			return nil, fmt.Errorf("[%v].weight: weight must not be negative", index)
+		}
+		targets = append(targets, discoveredTarget{Address: entry.Address, Weight: entry.Weight, Labels: entry.Labels})
+	}
+	return targets, nil
+}
@@ -0,0 +1,79 @@
+package src
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats configuration can be written in. All of them describe the same
+// `LoadBalancerYAMLConfiguration` model, with the keys used by YAML.
+const (
+	CONFIG_FORMAT_YAML = "yaml"
+	CONFIG_FORMAT_JSON = "json"
+	CONFIG_FORMAT_TOML = "toml"
+)
+
+var supportedConfigFormats []string = []string{
+	CONFIG_FORMAT_YAML, CONFIG_FORMAT_JSON, CONFIG_FORMAT_TOML,
+}
+
+// Extensions of configuration files, per format
+var configFormatExtensions map[string]string = map[string]string{
+	".yaml": CONFIG_FORMAT_YAML,
+	".yml":  CONFIG_FORMAT_YAML,
+	".json": CONFIG_FORMAT_JSON,
+	".toml": CONFIG_FORMAT_TOML,
+}
+
+func IsValidConfigFormat(format string) bool {
+	for _, val := range supportedConfigFormats {
+		if val == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns format of configuration file judging by its extension. Files with unknown
+// extension are read as YAML.
+func ConfigFormatFromPath(file string) string {
+	if format, found := configFormatExtensions[strings.ToLower(filepath.Ext(file))]; found {
+		return format
+	}
+	return CONFIG_FORMAT_YAML
+}
+
+// Parses document in given format into YAML node tree, which the rest of loading works on
+func parseDocument(contents []byte, format string, file string) (*yaml.Node, *ConfigError) {
+	document := &yaml.Node{}
+	switch format {
+	case CONFIG_FORMAT_TOML:
+		// TOML parser does not report positions of values, so they are unknown in errors
+		values := map[string]any{}
+		if _, err := toml.Decode(string(contents), &values); err != nil {
+			configError := &ConfigError{File: file, Message: err.Error()}
+			if parseErr, ok := err.(toml.ParseError); ok {
+				configError.Message = parseErr.Message
+				configError.Line = parseErr.Position.Line
+				configError.Column = parseErr.Position.Start - strings.LastIndexByte(string(contents[:parseErr.Position.Start]), '\n')
+			}
+			return nil, configError
+		}
+		if len(values) > 0 {
+			mapping := &yaml.Node{}
+			if err := mapping.Encode(values); err != nil {
+				return nil, &ConfigError{File: file, Message: err.Error()}
+			}
+			document = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{mapping}}
+		}
+	default:
+		// JSON is a subset of YAML, parsing it as such keeps positions of values
+		if err := yaml.Unmarshal(contents, document); err != nil {
+			return nil, newYAMLError(file, err.Error())
+		}
+	}
+	return document, nil
+}
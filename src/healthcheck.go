@@ -0,0 +1,127 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_PATH     = "/"
+	DEFAULT_HEALTH_CHECK_INTERVAL = 10 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = 2 * time.Second
+)
+
+type HealthCheckYAMLConfig struct {
+	// Path requested from every target. Responses with status below 400 mark target alive.
+	// Targets of tcp listeners are alive while they accept connections, targets of udp
+	// listeners unless they refuse datagrams.
+	Path       string `yaml:"path"`
+	IntervalMs int    `yaml:"intervalMs"`
+	TimeoutMs  int    `yaml:"timeoutMs"`
+}
+
+// Periodically probes targets, marking them unreachable when probe fails and reachable again
+// once it succeeds
+type HealthChecker struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	client   *http.Client
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Returns nil if health checks are not configured
+func NewHealthChecker(cnf *HealthCheckYAMLConfig) *HealthChecker {
+	if cnf == nil {
+		return nil
+	}
+	hc := &HealthChecker{
+		Path:     cnf.Path,
+		Interval: time.Duration(cnf.IntervalMs) * time.Millisecond,
+		Timeout:  time.Duration(cnf.TimeoutMs) * time.Millisecond,
+		client:   &http.Client{},
+		stop:     make(chan struct{}),
+	}
+	if hc.Path == "" {
+		hc.Path = DEFAULT_HEALTH_CHECK_PATH
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	return hc
+}
+
+// Starts probing targets returned by `targets`. Targets which become reachable again wake up
+// requests waiting for them.
+func (hc *HealthChecker) Start(targets func() []*Target) {
+	if hc == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hc.stop:
+				return
+			case <-ticker.C:
+				for _, target := range targets() {
+					healthy := hc.probe(target)
+					if healthy && !target.IsAlive() {
+						log.Info().Str("address", target.Address).Msg("Health check passed, target marked as available")
+						target.MarkAsReachable()
+					} else if !healthy && target.IsAlive() {
+						log.Info().Str("address", target.Address).Msg("Health check failed")
+						target.MarkAsUnreachable()
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Requests path from http targets; tcp targets are healthy if they accept connections and
+// udp targets unless they report their port closed
+func (hc *HealthChecker) probe(target *Target) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	if strings.HasPrefix(target.Address, TCP_TARGET_SCHEME+"://") {
+		conn, err := target.dialTCP(ctx)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	if strings.HasPrefix(target.Address, UDP_TARGET_SCHEME+"://") {
+		return target.probeUDP(hc.Timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(target.Address, "/")+hc.Path, nil)
+	if err != nil {
+		return false
+	}
+	res, err := hc.client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode < http.StatusBadRequest
+}
+
+func (hc *HealthChecker) Stop() {
+	if hc == nil {
+		return
+	}
+	hc.stopOnce.Do(func() {
+		close(hc.stop)
+	})
+}
@@ -0,0 +1,300 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_HEDGING_BUDGET_PERCENT = 10
+	DEFAULT_HEDGING_PERCENTILE     = 95
+	// Delay used until enough latency samples are collected for the percentile
+	DEFAULT_HEDGING_DELAY = 100 * time.Millisecond
+
+	HEDGING_LATENCY_SAMPLES       = 1000
+	HEDGING_MIN_LATENCY_SAMPLES   = 20
+	HEDGING_PERCENTILE_REFRESH_AT = 100
+)
+
+// Hedging is restricted to methods which are idempotent and carry no body
+var hedgeableMethods []string = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+}
+
+type HedgingYAMLConfig struct {
+	// Delay before sending hedged request. If not set, observed p95 latency of the route is used.
+	DelayMs       int `yaml:"delayMs"`
+	BudgetPercent int `yaml:"budgetPercent"`
+}
+
+// Sends a second request to another target when the first one is slow to respond
+type HedgePolicy struct {
+	Delay         time.Duration
+	BudgetPercent int64
+	requests      int64
+	hedges        int64
+	hedgeWins     int64
+	latencies     *latencyTracker
+}
+
+func NewHedgePolicy(cnf *HedgingYAMLConfig) *HedgePolicy {
+	if cnf == nil {
+		return nil
+	}
+	policy := &HedgePolicy{
+		Delay:         time.Duration(cnf.DelayMs) * time.Millisecond,
+		BudgetPercent: DEFAULT_HEDGING_BUDGET_PERCENT,
+		latencies:     &latencyTracker{},
+	}
+	if cnf.BudgetPercent > 0 {
+		policy.BudgetPercent = int64(cnf.BudgetPercent)
+	}
+	return policy
+}
+
+func (hp *HedgePolicy) isHedgeable(req *http.Request) bool {
+	for _, method := range hedgeableMethods {
+		if req.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns configured delay or the observed percentile latency of the route
+func (hp *HedgePolicy) hedgeDelay() time.Duration {
+	if hp.Delay > 0 {
+		return hp.Delay
+	}
+	if delay := hp.latencies.percentile(); delay > 0 {
+		return delay
+	}
+	return DEFAULT_HEDGING_DELAY
+}
+
+// Reserves a hedge from budget, if available
+func (hp *HedgePolicy) takeBudget() bool {
+	requests := atomic.LoadInt64(&hp.requests)
+	hedges := atomic.AddInt64(&hp.hedges, 1)
+	if hedges*100 > requests*hp.BudgetPercent {
+		atomic.AddInt64(&hp.hedges, -1)
+		return false
+	}
+	return true
+}
+
+// Returns number of hedged requests sent and how many of them won
+func (hp *HedgePolicy) Stats() (hedges int64, wins int64) {
+	return atomic.LoadInt64(&hp.hedges), atomic.LoadInt64(&hp.hedgeWins)
+}
+
+// Keeps a window of recent latencies and the percentile computed from it
+type latencyTracker struct {
+	mu        sync.Mutex
+	samples   []time.Duration
+	next      int
+	sinceCalc int
+	value     time.Duration
+}
+
+func (lt *latencyTracker) record(latency time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if len(lt.samples) < HEDGING_LATENCY_SAMPLES {
+		lt.samples = append(lt.samples, latency)
+	} else {
+		lt.samples[lt.next] = latency
+		lt.next = (lt.next + 1) % HEDGING_LATENCY_SAMPLES
+	}
+	lt.sinceCalc++
+	if len(lt.samples) >= HEDGING_MIN_LATENCY_SAMPLES && (lt.value == 0 || lt.sinceCalc >= HEDGING_PERCENTILE_REFRESH_AT) {
+		sorted := make([]time.Duration, len(lt.samples))
+		copy(sorted, lt.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		lt.value = sorted[len(sorted)*DEFAULT_HEDGING_PERCENTILE/100]
+		lt.sinceCalc = 0
+	}
+}
+
+func (lt *latencyTracker) percentile() time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.value
+}
+
+// Shared between the attempts of a hedged request. The first attempt to write
+// response headers wins and is the only one forwarded to the client.
+type hedgeRace struct {
+	mu      sync.Mutex
+	rw      http.ResponseWriter
+	winner  *hedgeWriter
+	writers []*hedgeWriter
+}
+
+type hedgeWriter struct {
+	race        *hedgeRace
+	header      http.Header
+	cancel      context.CancelFunc
+	wroteHeader bool
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(code int) {
+	if hw.wroteHeader {
+		return
+	}
+	hw.wroteHeader = true
+	race := hw.race
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.winner != nil {
+		return
+	}
+	race.winner = hw
+	for _, writer := range race.writers {
+		if writer != hw {
+			writer.cancel()
+		}
+	}
+	for name, values := range hw.header {
+		race.rw.Header()[name] = values
+	}
+	race.rw.WriteHeader(code)
+}
+
+func (hw *hedgeWriter) isWinner() bool {
+	hw.race.mu.Lock()
+	defer hw.race.mu.Unlock()
+	return hw.race.winner == hw
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.isWinner() {
+		return len(b), nil
+	}
+	return hw.race.rw.Write(b)
+}
+
+func (hw *hedgeWriter) Flush() {
+	if flusher, ok := hw.race.rw.(http.Flusher); ok && hw.isWinner() {
+		flusher.Flush()
+	}
+}
+
+type hedgeResult struct {
+	writer *hedgeWriter
+	target *Target
+	serveResult
+	// Value attempt panicked with, such as `http.ErrAbortHandler` raised by proxy when copying
+	// response body fails
+	panicked any
+}
+
+func (hr *hedgeRace) hasWinner() bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	return hr.winner != nil
+}
+
+func (hr *hedgeRace) launch(target *Target, req *http.Request, results chan hedgeResult, onDone func()) *hedgeWriter {
+	ctx, cancel := context.WithCancel(req.Context())
+	writer := &hedgeWriter{
+		race:   hr,
+		header: http.Header{},
+		cancel: cancel,
+	}
+	hr.mu.Lock()
+	hr.writers = append(hr.writers, writer)
+	hr.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		result := hedgeResult{writer: writer, target: target}
+		// Panic is passed on to handler goroutine, as server recovers it only there
+		defer func() {
+			result.panicked = recover()
+			if onDone != nil {
+				onDone()
+			}
+			results <- result
+		}()
+		result.serveResult = target.serve(writer, req.Clone(ctx))
+	}()
+	return writer
+}
+
+// Serves request from primary target and hedges it to another target if the
+// primary has not responded within the hedge delay. Returns result of the winning
+// attempt, target which served it and number of hedged requests sent. Once every attempt
+// finished, panic of the winning attempt is raised again, and so is any other panic than
+// aborted response of a losing attempt.
+func (lb *Balancer) serveHedged(rw http.ResponseWriter, req *http.Request, primary *Target) (serveResult, *Target, int) {
+	hp := lb.Hedging
+	atomic.AddInt64(&hp.requests, 1)
+	start := time.Now()
+
+	race := &hedgeRace{rw: rw}
+	results := make(chan hedgeResult, 2)
+	primaryWriter := race.launch(primary, req, results, nil)
+	pending := 1
+
+	timer := time.NewTimer(hp.hedgeDelay())
+	defer timer.Stop()
+
+	// Wait for all attempts, losers are cancelled as soon as a winner responds
+	var result hedgeResult
+	var panicked any
+	isDecided := false
+	hedged := 0
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if race.hasWinner() || !hp.takeBudget() {
+				continue
+			}
+			secondary := lb.Admission.TryAcquire(lb, primary)
+			if secondary == nil {
+				atomic.AddInt64(&hp.hedges, -1)
+				continue
+			}
+			requestLogger(req.Context()).Debug().Str("balancer", lb.Id).Str("to", secondary.Address).Msg("- Hedging request")
+			race.launch(secondary, req, results, func() {
+				lb.Admission.Release(secondary)
+			})
+			pending++
+			hedged++
+		case res := <-results:
+			pending--
+			if res.panicked != nil && (res.panicked != http.ErrAbortHandler || res.writer.isWinner()) {
+				panicked = res.panicked
+			}
+			if isDecided {
+				continue
+			}
+			result = res
+			if res.writer.isWinner() {
+				isDecided = true
+				if res.writer != primaryWriter {
+					atomic.AddInt64(&hp.hedgeWins, 1)
+				}
+				hp.latencies.record(time.Since(start))
+			}
+		}
+	}
+	if panicked != nil {
+		panic(panicked)
+	}
+	return result.serveResult, result.target, hedged
+}
@@ -0,0 +1,232 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Top level key listing configuration files merged into the one which names them
+const INCLUDE_KEY = "include"
+
+// Parses configuration document read from `file` in given format, resolving its variables
+// and includes. `chain` lists absolute paths of files which include it, to detect cycles.
+// Returns nil if document can not be parsed.
+func (cv *configValidator) loadDocument(contents []byte, format string, file string, chain []string) *yaml.Node {
+	document, parseErr := parseDocument(contents, format, file)
+	if parseErr != nil {
+		cv.errs = append(cv.errs, parseErr)
+		return nil
+	}
+	cv.setFile(document, file)
+
+	baseDir := ""
+	if file != "" {
+		baseDir = filepath.Dir(file)
+		absolute, _ := filepath.Abs(file)
+		chain = append(chain[:len(chain):len(chain)], absolute)
+	}
+	cv.interpolate(document, configPath{}, baseDir)
+	cv.checkTypes(document, file)
+	cv.resolveIncludes(document, baseDir, chain)
+	return document
+}
+
+func (cv *configValidator) setFile(node *yaml.Node, file string) {
+	if file == "" {
+		return
+	}
+	cv.files[node] = file
+	for _, child := range node.Content {
+		cv.setFile(child, file)
+	}
+}
+
+// Reports values of document which can not be decoded into their fields. Done for every
+// file separately, as decoder reports line numbers only.
+func (cv *configValidator) checkTypes(document *yaml.Node, file string) {
+	if document.Kind == 0 {
+		return
+	}
+	if err := document.Decode(&LoadBalancerYAMLConfiguration{}); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, message := range typeErr.Errors {
+				cv.errs = append(cv.errs, newYAMLError(file, message))
+				cv.typeErrors++
+			}
+		} else {
+			cv.errs = append(cv.errs, newYAMLError(file, err.Error()))
+		}
+	}
+}
+
+// Returns top level mapping of document, or nil if document has none
+func documentMapping(document *yaml.Node) *yaml.Node {
+	if document.Kind == yaml.DocumentNode && len(document.Content) > 0 && document.Content[0].Kind == yaml.MappingNode {
+		return document.Content[0]
+	}
+	return nil
+}
+
+// Removes `include` key from document and merges files it lists into document. Entries
+// are paths relative to the including file, glob patterns, or directories from which every
+// configuration file is included. Format of included files is judged by their extension.
+func (cv *configValidator) resolveIncludes(document *yaml.Node, baseDir string, chain []string) {
+	root := documentMapping(document)
+	if root == nil {
+		return
+	}
+	var includes *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == INCLUDE_KEY {
+			includes = root.Content[i+1]
+			root.Content = append(root.Content[:i:i], root.Content[i+2:]...)
+			break
+		}
+	}
+	if includes == nil {
+		return
+	}
+
+	path := configPath{INCLUDE_KEY}
+	entries := []*yaml.Node{includes}
+	if includes.Kind == yaml.SequenceNode {
+		entries = includes.Content
+	}
+	for index, entry := range entries {
+		if includes.Kind == yaml.SequenceNode {
+			path = configPath{INCLUDE_KEY, index}
+		}
+		if entry.Kind != yaml.ScalarNode || entry.Value == "" {
+			cv.addNodef(entry, path, "include must be a path or a list of paths")
+			continue
+		}
+		files, err := expandInclude(entry.Value, baseDir)
+		if err != nil {
+			cv.addNodef(entry, path, "%v", err)
+			continue
+		}
+		for _, file := range files {
+			absolute, _ := filepath.Abs(file)
+			if cycle := includeCycle(chain, absolute); cycle != "" {
+				cv.addNodef(entry, path, "include cycle: %v", cycle)
+				continue
+			}
+			contents, err := os.ReadFile(file)
+			if err != nil {
+				cv.addNodef(entry, path, "included file '%v' can not be read", file)
+				continue
+			}
+			if included := cv.loadDocument(contents, ConfigFormatFromPath(file), file, chain); included != nil {
+				cv.mergeDocument(document, included)
+			}
+		}
+	}
+}
+
+// Returns files matched by include entry, in lexical order
+func expandInclude(pattern string, baseDir string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(baseDir, pattern)
+	}
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		files := []string{}
+		for extension := range configFormatExtensions {
+			matches, _ := filepath.Glob(filepath.Join(pattern, "*"+extension))
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		if _, err := os.Stat(pattern); err != nil {
+			return nil, fmt.Errorf("included file '%v' can not be read", pattern)
+		}
+		return []string{pattern}, nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("include pattern '%v' is invalid", pattern)
+	}
+	return files, nil
+}
+
+// Returns chain of includes leading back to `file`, or empty string if it does not form a cycle
+func includeCycle(chain []string, file string) string {
+	for index, included := range chain {
+		if included == file {
+			return strings.Join(append(chain[index:len(chain):len(chain)], file), " -> ")
+		}
+	}
+	return ""
+}
+
+// Merges top level sections of included document into document. Listeners are appended
+// and upstreams added, while other sections may be defined in one file only.
+func (cv *configValidator) mergeDocument(document *yaml.Node, included *yaml.Node) {
+	if included.Kind == 0 {
+		return
+	}
+	source := documentMapping(included)
+	if source == nil {
+		cv.addNodef(included, configPath{}, "included configuration must be a mapping")
+		return
+	}
+	if document.Kind == 0 {
+		*document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := documentMapping(document)
+	if root == nil {
+		return
+	}
+
+	for i := 0; i+1 < len(source.Content); i += 2 {
+		key, value := source.Content[i], source.Content[i+1]
+		var existing *yaml.Node
+		for j := 0; j+1 < len(root.Content); j += 2 {
+			if root.Content[j].Value == key.Value {
+				existing = root.Content[j+1]
+				break
+			}
+		}
+		switch {
+		case existing == nil:
+			root.Content = append(root.Content, key, value)
+		case key.Value == "listeners" && existing.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			existing.Content = append(existing.Content, value.Content...)
+		case key.Value == "upstreams" && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			names := map[string]*yaml.Node{}
+			for j := 0; j+1 < len(existing.Content); j += 2 {
+				names[existing.Content[j].Value] = existing.Content[j]
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j]
+				if previous, found := names[name.Value]; found {
+					cv.addNodef(name, configPath{"upstreams"}, "upstream '%v' is already defined%v", name.Value, cv.location(previous))
+					continue
+				}
+				existing.Content = append(existing.Content, name, value.Content[j+1])
+			}
+		default:
+			cv.addNodef(key, configPath{}, "section '%v' is already defined%v", key.Value, cv.location(existing))
+		}
+	}
+}
+
+// Describes where node was defined, for messages about conflicting definitions
+func (cv *configValidator) location(node *yaml.Node) string {
+	file := cv.files[node]
+	switch {
+	case file != "" && node.Line > 0:
+		return fmt.Sprintf(" in %v, line %v", file, node.Line)
+	case file != "":
+		return fmt.Sprintf(" in %v", file)
+	case node.Line > 0:
+		return fmt.Sprintf(" at line %v", node.Line)
+	}
+	return ""
+}
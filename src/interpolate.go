@@ -0,0 +1,158 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of values which are replaced by contents of the referenced file
+const SECRET_FILE_PREFIX = "file://"
+
+// Replaces secret values when configuration is printed
+const REDACTED_VALUE = "[REDACTED]"
+
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Marks value at path as one which must never be printed, such as a token
+func (cv *configValidator) addSecret(path configPath, value string) {
+	if value != "" {
+		cv.secretPaths[path.String()] = true
+	}
+}
+
+// Records paths of values loaded through `file://` references, which are known only once
+// included files are merged into configuration
+func (cv *configValidator) collectSecretPaths(node *yaml.Node, path configPath) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			cv.collectSecretPaths(child, path)
+		}
+	case yaml.SequenceNode:
+		for index, child := range node.Content {
+			cv.collectSecretPaths(child, path.Child(index))
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			cv.collectSecretPaths(node.Content[i+1], path.Child(node.Content[i].Value))
+		}
+	case yaml.ScalarNode:
+		if cv.secretNodes[node] {
+			cv.secretPaths[path.String()] = true
+		}
+	}
+}
+
+// Replaces scalar values of YAML document found at `secretPaths`
+func redactYAML(node *yaml.Node, path configPath, secretPaths map[string]bool) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			redactYAML(child, path, secretPaths)
+		}
+	case yaml.SequenceNode:
+		for index, child := range node.Content {
+			redactYAML(child, path.Child(index), secretPaths)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			redactYAML(node.Content[i+1], path.Child(node.Content[i].Value), secretPaths)
+		}
+	case yaml.ScalarNode:
+		if secretPaths[path.String()] {
+			node.Value, node.Style, node.Tag = REDACTED_VALUE, 0, "!!str"
+		}
+	}
+}
+
+// Resolves `${VAR}` and `${VAR:-default}` references to environment variables in scalar
+// values, then replaces values of the form `file://path` with contents of that file. Relative
+// paths are resolved against `baseDir`. Mapping keys are left as they are.
+func (cv *configValidator) interpolate(node *yaml.Node, path configPath, baseDir string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			cv.interpolate(child, path, baseDir)
+		}
+	case yaml.SequenceNode:
+		for index, child := range node.Content {
+			cv.interpolate(child, path.Child(index), baseDir)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			cv.interpolate(node.Content[i+1], path.Child(node.Content[i].Value), baseDir)
+		}
+	case yaml.ScalarNode:
+		value, err := expandVariables(node.Value)
+		if err != nil {
+			cv.addNodef(node, path, "%v", err)
+			return
+		}
+		if value != node.Value {
+			node.Value = value
+			// Plain values are typed by their contents, so substituted ones must be resolved again
+			if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				node.Tag = ""
+			}
+		}
+		if strings.HasPrefix(value, SECRET_FILE_PREFIX) {
+			secretPath := strings.TrimPrefix(value, SECRET_FILE_PREFIX)
+			if !filepath.IsAbs(secretPath) {
+				secretPath = filepath.Join(baseDir, secretPath)
+			}
+			contents, err := os.ReadFile(secretPath)
+			if err != nil {
+				cv.addNodef(node, path, "secret file '%v' can not be read", secretPath)
+				return
+			}
+			node.Value = strings.TrimRight(string(contents), "\r\n")
+			node.Tag = "!!str"
+			cv.secretNodes[node] = true
+		}
+	}
+}
+
+// Expands environment variable references in value. `$$` stands for a literal `$`.
+func expandVariables(value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			sb.WriteByte(value[i])
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("variable reference '%v' is not closed", value[i:])
+			}
+			reference := value[i+2 : i+end]
+			name, defaultValue, hasDefault := strings.Cut(reference, ":-")
+			if !variableNamePattern.MatchString(name) {
+				return "", fmt.Errorf("variable reference '${%v}' is invalid", reference)
+			}
+			resolved, set := os.LookupEnv(name)
+			if resolved == "" && hasDefault {
+				resolved = defaultValue
+			} else if !set {
+				return "", fmt.Errorf("environment variable '%v' is not set", name)
+			}
+			sb.WriteString(resolved)
+			i += end
+		default:
+			sb.WriteByte('$')
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,463 @@
+package src
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DEFAULT_KUBERNETES_NAMESPACE      = "default"
+	DEFAULT_KUBERNETES_RETRY_INTERVAL = time.Second
+	// Longest time API server keeps a watch open, it is opened again afterwards
+	KUBERNETES_WATCH_TIMEOUT   = 5 * time.Minute
+	KUBERNETES_REQUEST_TIMEOUT = 10 * time.Second
+
+	// Credentials of pod's service account, used when running inside the cluster
+	KUBERNETES_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// Label linking EndpointSlices to the service they belong to
+	KUBERNETES_SERVICE_NAME_LABEL = "kubernetes.io/service-name"
+)
+
+type KubernetesDiscoveryYAMLConfig struct {
+	Service string `yaml:"service"`
+	// Namespace of service, taken from kubeconfig context or pod's namespace if not set
+	Namespace string `yaml:"namespace"`
+	// Name of EndpointSlice port targets are reached on, first port if not set
+	Port string `yaml:"port"`
+	// Scheme of target addresses, `http` or `https`
+	Scheme string `yaml:"scheme"`
+	// Path to kubeconfig file. Service account of pod is used if not set.
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Context of kubeconfig, its current context if not set
+	Context string `yaml:"context"`
+	// Time to wait before listing again after API server failed
+	RetryIntervalMs int `yaml:"retryIntervalMs"`
+}
+
+// EndpointSlice fields used by discovery
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSliceEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Status sent by API server in place of an object when watch fails
+type kubernetesStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Connection settings of API server
+type kubernetesAPI struct {
+	Server    string
+	Namespace string
+	Token     string
+	// Read before every request, as service account tokens are rotated
+	TokenFile string
+	Client    *http.Client
+}
+
+// Watches EndpointSlices of service. Ready endpoints are targets, terminating ones are
+// kept draining until they are removed.
+type kubernetesResolver struct {
+	cnf           KubernetesDiscoveryYAMLConfig
+	retryInterval time.Duration
+	api           *kubernetesAPI
+	slices        map[string]*endpointSlice
+	// Version of listed slices watch continues from, empty if they must be listed again
+	resourceVersion string
+	watch           io.ReadCloser
+	events          *json.Decoder
+	// Whether open watch delivered any event
+	watched bool
+}
+
+func newKubernetesResolver(cnf *KubernetesDiscoveryYAMLConfig) *kubernetesResolver {
+	resolver := &kubernetesResolver{
+		cnf:           *cnf,
+		retryInterval: time.Duration(cnf.RetryIntervalMs) * time.Millisecond,
+		slices:        map[string]*endpointSlice{},
+	}
+	if resolver.cnf.Scheme == "" {
+		resolver.cnf.Scheme = DEFAULT_DISCOVERY_SCHEME
+	}
+	if resolver.retryInterval <= 0 {
+		resolver.retryInterval = DEFAULT_KUBERNETES_RETRY_INTERVAL
+	}
+	return resolver
+}
+
+func (r *kubernetesResolver) RetryInterval() time.Duration {
+	return r.retryInterval
+}
+
+// Lists slices, then returns again each time watch reports a change
+func (r *kubernetesResolver) Resolve(ctx context.Context) ([]discoveredTarget, time.Duration, error) {
+	if r.api == nil {
+		api, err := newKubernetesAPI(&r.cnf)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.api = api
+	}
+	if r.resourceVersion == "" {
+		if err := r.list(ctx); err != nil {
+			return nil, 0, err
+		}
+		return r.targets(), 0, nil
+	}
+
+	if r.watch == nil {
+		if err := r.openWatch(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+	for {
+		event := endpointSliceEvent{}
+		if err := r.events.Decode(&event); err != nil {
+			watched := r.watched
+			r.closeWatch()
+			if errors.Is(err, io.EOF) {
+				// Watch timed out, it is opened again from the last version seen. Watch closed
+				// straight away is not opened again in a loop.
+				if !watched {
+					return r.targets(), r.retryInterval, nil
+				}
+				return r.targets(), 0, nil
+			}
+			return nil, 0, err
+		}
+		r.watched = true
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			slice := &endpointSlice{}
+			if err := json.Unmarshal(event.Object, slice); err != nil {
+				r.closeWatch()
+				return nil, 0, fmt.Errorf("API server sent malformed EndpointSlice: %w", err)
+			}
+			r.resourceVersion = slice.Metadata.ResourceVersion
+			if event.Type == "DELETED" {
+				delete(r.slices, slice.Metadata.Name)
+			} else {
+				r.slices[slice.Metadata.Name] = slice
+			}
+			return r.targets(), 0, nil
+		case "BOOKMARK":
+			slice := &endpointSlice{}
+			if json.Unmarshal(event.Object, slice) == nil {
+				r.resourceVersion = slice.Metadata.ResourceVersion
+			}
+		case "ERROR":
+			status := kubernetesStatus{}
+			json.Unmarshal(event.Object, &status)
+			r.closeWatch()
+			if status.Code == http.StatusGone {
+				// Version is too old to continue from, slices are listed again
+				r.resourceVersion = ""
+				return r.targets(), 0, nil
+			}
+			return nil, 0, fmt.Errorf("watch of EndpointSlices failed: %v", status.Message)
+		}
+	}
+}
+
+func (r *kubernetesResolver) slicesURL(query url.Values) string {
+	query.Set("labelSelector", KUBERNETES_SERVICE_NAME_LABEL+"="+r.cnf.Service)
+	return r.api.Server + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(r.api.Namespace) + "/endpointslices?" + query.Encode()
+}
+
+func (r *kubernetesResolver) list(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, KUBERNETES_REQUEST_TIMEOUT)
+	defer cancel()
+	res, err := r.api.get(ctx, r.slicesURL(url.Values{}))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	list := endpointSliceList{}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return fmt.Errorf("API server sent malformed EndpointSlice list: %w", err)
+	}
+	r.slices = map[string]*endpointSlice{}
+	for index := range list.Items {
+		r.slices[list.Items[index].Metadata.Name] = &list.Items[index]
+	}
+	r.resourceVersion = list.Metadata.ResourceVersion
+	return nil
+}
+
+func (r *kubernetesResolver) openWatch(ctx context.Context) error {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", r.resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(int(KUBERNETES_WATCH_TIMEOUT.Seconds())))
+	res, err := r.api.get(ctx, r.slicesURL(query))
+	if err != nil {
+		return err
+	}
+	r.watch, r.events = res.Body, json.NewDecoder(res.Body)
+	return nil
+}
+
+func (r *kubernetesResolver) closeWatch() {
+	if r.watch != nil {
+		r.watch.Close()
+	}
+	r.watch, r.events, r.watched = nil, nil, false
+}
+
+// Returns ready and terminating endpoints of every slice
+func (r *kubernetesResolver) targets() []discoveredTarget {
+	names := make([]string, 0, len(r.slices))
+	for name := range r.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	targets := []discoveredTarget{}
+	for _, name := range names {
+		slice := r.slices[name]
+		port := 0
+		for _, slicePort := range slice.Ports {
+			if r.cnf.Port == "" || slicePort.Name == r.cnf.Port {
+				port = slicePort.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// Unset ready condition means ready, terminating endpoints are never ready
+			ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+			terminating := endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating
+			if len(endpoint.Addresses) == 0 || (!ready && !terminating) {
+				continue
+			}
+			labels := map[string]string{}
+			if endpoint.Zone != "" {
+				labels["zone"] = endpoint.Zone
+			}
+			if endpoint.NodeName != "" {
+				labels["node"] = endpoint.NodeName
+			}
+			targets = append(targets, discoveredTarget{
+				// Addresses of an endpoint are fungible, the first one is used
+				Address:  r.cnf.Scheme + "://" + net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(port)),
+				Labels:   labels,
+				Draining: !ready,
+			})
+		}
+	}
+	return targets
+}
+
+func (api *kubernetesAPI) get(ctx context.Context, requestURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := api.Token
+	if api.TokenFile != "" {
+		contents, err := os.ReadFile(api.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := api.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("API server responded with status %v", res.StatusCode)
+	}
+	return res, nil
+}
+
+// Subset of kubeconfig file needed to connect with token or client certificate
+type kubeconfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// Returns API server connection from kubeconfig, or from pod's service account if none is set
+func newKubernetesAPI(cnf *KubernetesDiscoveryYAMLConfig) (*kubernetesAPI, error) {
+	api := &kubernetesAPI{Namespace: cnf.Namespace}
+	tlsConfig := &tls.Config{}
+	readData := func(file string, data string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		return os.ReadFile(file)
+	}
+	var caCert []byte
+
+	if cnf.Kubeconfig == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running inside Kubernetes cluster and no kubeconfig is set")
+		}
+		api.Server = "https://" + net.JoinHostPort(host, port)
+		api.TokenFile = KUBERNETES_SERVICE_ACCOUNT_DIR + "/token"
+		var err error
+		if caCert, err = os.ReadFile(KUBERNETES_SERVICE_ACCOUNT_DIR + "/ca.crt"); err != nil {
+			return nil, err
+		}
+		if api.Namespace == "" {
+			namespace, _ := os.ReadFile(KUBERNETES_SERVICE_ACCOUNT_DIR + "/namespace")
+			api.Namespace = strings.TrimSpace(string(namespace))
+		}
+	} else {
+		contents, err := os.ReadFile(cnf.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		kubeconfig := kubeconfigFile{}
+		if err := yaml.Unmarshal(contents, &kubeconfig); err != nil {
+			return nil, fmt.Errorf("kubeconfig '%v' is invalid: %w", cnf.Kubeconfig, err)
+		}
+		contextName := cnf.Context
+		if contextName == "" {
+			contextName = kubeconfig.CurrentContext
+		}
+		found := false
+		for _, kubeContext := range kubeconfig.Contexts {
+			if kubeContext.Name != contextName {
+				continue
+			}
+			found = true
+			if api.Namespace == "" {
+				api.Namespace = kubeContext.Context.Namespace
+			}
+			for _, cluster := range kubeconfig.Clusters {
+				if cluster.Name != kubeContext.Context.Cluster {
+					continue
+				}
+				api.Server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+				tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+				if cluster.Cluster.CertificateAuthority != "" || cluster.Cluster.CertificateAuthorityData != "" {
+					if caCert, err = readData(cluster.Cluster.CertificateAuthority, cluster.Cluster.CertificateAuthorityData); err != nil {
+						return nil, err
+					}
+				}
+			}
+			for _, user := range kubeconfig.Users {
+				if user.Name != kubeContext.Context.User {
+					continue
+				}
+				api.Token, api.TokenFile = user.User.Token, user.User.TokenFile
+				if user.User.ClientCertificate != "" || user.User.ClientCertificateData != "" {
+					certificate, err := readData(user.User.ClientCertificate, user.User.ClientCertificateData)
+					if err != nil {
+						return nil, err
+					}
+					key, err := readData(user.User.ClientKey, user.User.ClientKeyData)
+					if err != nil {
+						return nil, err
+					}
+					keyPair, err := tls.X509KeyPair(certificate, key)
+					if err != nil {
+						return nil, err
+					}
+					tlsConfig.Certificates = []tls.Certificate{keyPair}
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("context '%v' is not defined in kubeconfig '%v'", contextName, cnf.Kubeconfig)
+		}
+		if api.Server == "" {
+			return nil, fmt.Errorf("cluster of context '%v' is not defined in kubeconfig '%v'", contextName, cnf.Kubeconfig)
+		}
+	}
+
+	if caCert != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("certificate authority of API server is invalid")
+		}
+	}
+	if api.Namespace == "" {
+		api.Namespace = DEFAULT_KUBERNETES_NAMESPACE
+	}
+	api.Client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}
+	return api, nil
+}
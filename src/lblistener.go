@@ -2,10 +2,13 @@ package src
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -26,9 +29,27 @@ type Listener struct {
 	Protocol          string
 	SSLCertificate    string
 	SSLCertificateKey string
-	Balancers         []*Balancer
-	State             LISTENER_STATE
-	ListenerWG        *sync.WaitGroup
+	// Replaced, never modified in place, while holding `balancersMu`
+	Balancers   []*Balancer
+	balancersMu sync.RWMutex
+	// LISTENER_STATE of listener, changed while requests are being served
+	state      atomic.Int32
+	ListenerWG *sync.WaitGroup
+	// Maximum concurrent connections from a single client IP. 0 means unlimited.
+	MaxConnectionsPerIP int
+	connLimiter         *ipLimitListener
+	Metrics             *MetricsRegistry
+	AccessLog           *AccessLogger
+	Tracer              *Tracer
+	RequestID           *RequestIDGenerator
+	// Serves connections of tcp and tls listeners, nil for other listeners
+	tcp *tcpProxy
+	// Serves connections passthrough routes of https listener take, nil for other listeners
+	passthrough *tcpProxy
+	// Relays datagrams of udp listener, nil for other listeners
+	udp *udpProxy
+	// Bound when listener starts, unless listener took over socket of the one it replaces
+	socket *listenerSocket
 	// IsRunning         bool
 }
 
@@ -36,10 +57,16 @@ type Listener struct {
 
 // Starts Listener and initiates state checker
 func (lbs *Listener) Start(startersSync *sync.WaitGroup) (err error) {
-	if lbs.State != LISTENER_STATE_INIT {
+	if lbs.loadState() != LISTENER_STATE_INIT {
 		err = errors.New("LoadBalancer server is already running")
 		return
 	}
+	if err = lbs.bind(); err != nil {
+		lbs.setState(LISTENER_STATE_CLOSED)
+		log.Info().Str("port", lbs.Port).Err(err).Str("protocol", lbs.Protocol).Msg("Load Balancer server failed to start.")
+		startersSync.Done()
+		return
+	}
 
 	go func(lbs *Listener) {
 		log.Info().
@@ -48,14 +75,20 @@ func (lbs *Listener) Start(startersSync *sync.WaitGroup) (err error) {
 
 		lbs.ListenerWG.Add(1)
 
-		lbs.checkStateByPoll(startersSync)
-
-		err := lbs.Srv.ListenAndServe()
+		var err error
+		if lbs.tcp != nil {
+			err = lbs.tcp.listenAndServe(startersSync)
+		} else if lbs.udp != nil {
+			err = lbs.udp.listenAndServe(startersSync)
+		} else {
+			lbs.checkStateByPoll(startersSync)
+			err = lbs.listenAndServe()
+		}
 		if err == http.ErrServerClosed {
-			lbs.State = LISTENER_STATE_CLOSED
+			lbs.setState(LISTENER_STATE_CLOSED)
 			log.Info().Str("port", lbs.Port).Str("protocol", lbs.Protocol).Msg("Load Balancer server stopped")
 		} else if err != nil {
-			lbs.State = LISTENER_STATE_CLOSED
+			lbs.setState(LISTENER_STATE_CLOSED)
 			log.Info().Str("port", lbs.Port).Err(err).Str("protocol", lbs.Protocol).Msg("Load Balancer server failed to start.")
 		}
 		lbs.ListenerWG.Done()
@@ -64,13 +97,64 @@ func (lbs *Listener) Start(startersSync *sync.WaitGroup) (err error) {
 	return nil
 }
 
+func (lbs *Listener) listenAndServe() error {
+	ln := lbs.listen()
+	if lbs.Protocol == LS_PROTOCOL_HTTPS {
+		// Connections of passthrough routes are taken before TLS is terminated
+		ln = lbs.passthrough.passthroughListener(ln)
+		// Server does not close listener if certificate can not be loaded
+		defer ln.Close()
+		return lbs.Srv.ServeTLS(ln, lbs.SSLCertificate, lbs.SSLCertificateKey)
+	}
+	return lbs.Srv.Serve(ln)
+}
+
+// Binds listening socket unless listener took one over from listener it replaces
+func (lbs *Listener) bind() error {
+	if lbs.socket != nil {
+		return nil
+	}
+	socket, err := listenSocket(lbs.Protocol, lbs.Srv.Addr)
+	if err != nil {
+		return err
+	}
+	lbs.socket = socket
+	return nil
+}
+
+// Takes connections of listening socket, applying per IP connection limit if configured
+func (lbs *Listener) listen() net.Listener {
+	ln := lbs.socket.listener()
+	if lbs.MaxConnectionsPerIP > 0 {
+		lbs.connLimiter = newIPLimitListener(ln, lbs.MaxConnectionsPerIP)
+		ln = lbs.connLimiter
+	}
+	return ln
+}
+
+// Returns number of connections rejected due to per IP limit
+func (lbs *Listener) RejectedConnections() int64 {
+	if lbs.connLimiter == nil {
+		return 0
+	}
+	return lbs.connLimiter.Rejected()
+}
+
 // Repeatatively checks whether listener is ready to serve requests
 func (lbs *Listener) checkStateByPoll(startersSync *sync.WaitGroup) {
 	time.Sleep(10 * time.Millisecond)
 	loopBreaker := 1000
+	// Keep-alive connections would count against per IP connection limit
+	pollClient := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			// Certificate of https listener need not be valid for localhost
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
 	go func(lbs *Listener, startersSync *sync.WaitGroup) {
 		for {
-			if lbs.State != LISTENER_STATE_INIT {
+			if lbs.loadState() != LISTENER_STATE_INIT {
 				log.Error().
 					Str("port", lbs.Port).
 					Str("protocol", lbs.Protocol).
@@ -78,14 +162,16 @@ func (lbs *Listener) checkStateByPoll(startersSync *sync.WaitGroup) {
 				break
 			}
 			requestURL := lbs.Protocol + "://localhost:" + lbs.Port + "/"
-			res, err := http.Get(requestURL)
+			res, err := pollClient.Get(requestURL)
 			if err != nil {
 				log.Error().
 					Str("port", lbs.Port).
 					Str("protocol", lbs.Protocol).
 					Msgf("Error making request to listener at '%v'", requestURL)
+			} else {
+				res.Body.Close()
 			}
-			if res.StatusCode == 200 {
+			if err == nil && res.StatusCode == 200 {
 				log.Info().
 					Str("port", lbs.Port).
 					Str("protocol", lbs.Protocol).
@@ -108,29 +194,76 @@ func (lbs *Listener) Shutdown(serversSync *sync.WaitGroup) {
 		Str("protocol", lbs.Protocol).
 		Msg("Stopping listener at :" + lbs.Port)
 
+	// Connections of tcp listener are drained before balancers, as balancers wait for them
+	if lbs.tcp != nil {
+		lbs.setState(LISTENER_STATE_CLOSING)
+		lbs.tcp.shutdown()
+	}
+	// Sessions of udp listener hold target slots until they are closed
+	if lbs.udp != nil {
+		lbs.setState(LISTENER_STATE_CLOSING)
+		lbs.udp.shutdown()
+	}
+	// Https listener keeps accepting connections it terminates until its server is shut down
+	if lbs.passthrough != nil {
+		lbs.passthrough.shutdown()
+	}
+
 	// Count Balancers
+	balancers := lbs.GetBalancers()
 	balancersSync := &sync.WaitGroup{}
-	balancersSync.Add(len(lbs.Balancers))
+	balancersSync.Add(len(balancers))
 
-	for _, balancer := range lbs.Balancers {
+	for _, balancer := range balancers {
 		go func(balancersSync *sync.WaitGroup, balancer *Balancer) {
-			log.Debug().Str("balancer", balancer.Id).Msg("Closing Load Balancer")
-			balancer.State = LB_STATE_CLOSING
-			balancer.liveConnections.Wait()
-			balancer.State = LB_STATE_CLOSED
+			balancer.Close()
 			balancersSync.Done()
-			log.Debug().Str("balancer", balancer.Id).Msg("- Load Balancer Closed")
 		}(balancersSync, balancer)
 	}
 	balancersSync.Wait()
 
-	lbs.State = LISTENER_STATE_CLOSED
-	_ = lbs.Srv.Shutdown(context.Background())
+	lbs.setState(LISTENER_STATE_CLOSED)
+	if lbs.tcp == nil && lbs.udp == nil {
+		_ = lbs.Srv.Shutdown(context.Background())
+	}
 	lbs.ListenerWG.Wait()
 
 	serversSync.Done()
 }
 
+// Returns snapshot of listener's balancers
+func (lbs *Listener) GetBalancers() []*Balancer {
+	lbs.balancersMu.RLock()
+	defer lbs.balancersMu.RUnlock()
+	return lbs.Balancers
+}
+
+func (lbs *Listener) AddBalancer(balancer *Balancer) {
+	lbs.balancersMu.Lock()
+	defer lbs.balancersMu.Unlock()
+	balancers := make([]*Balancer, 0, len(lbs.Balancers)+1)
+	balancers = append(balancers, lbs.Balancers...)
+	lbs.Balancers = append(balancers, balancer)
+}
+
+// Stops routing new requests to balancer. Requests it is serving are not interrupted.
+func (lbs *Listener) RemoveBalancer(removed *Balancer) {
+	lbs.balancersMu.Lock()
+	defer lbs.balancersMu.Unlock()
+	balancers := make([]*Balancer, 0, len(lbs.Balancers))
+	for _, balancer := range lbs.Balancers {
+		if balancer != removed {
+			balancers = append(balancers, balancer)
+		}
+	}
+	lbs.Balancers = balancers
+}
+
+// Returns identifier of listener in `protocol:port` format
+func (lbs *Listener) Name() string {
+	return lbs.Protocol + ":" + lbs.Port
+}
+
 // Returns state in string format
 func (lbs *Listener) GetState() string {
 	states := map[LISTENER_STATE]string{
@@ -139,14 +272,21 @@ func (lbs *Listener) GetState() string {
 		2: "closing",
 		3: "inactive",
 	}
-	return states[lbs.State]
+	return states[lbs.loadState()]
+}
+
+func (lbs *Listener) loadState() LISTENER_STATE {
+	return LISTENER_STATE(lbs.state.Load())
+}
+
+func (lbs *Listener) setState(state LISTENER_STATE) {
+	lbs.state.Store(int32(state))
 }
 
 // Handles are incoming requests for listener
 func (lbs *Listener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if lbs.State != LISTENER_STATE_ACTIVE {
-		if lbs.State == LISTENER_STATE_INIT {
-			lbs.State = LISTENER_STATE_ACTIVE
+	if lbs.loadState() != LISTENER_STATE_ACTIVE {
+		if lbs.state.CompareAndSwap(int32(LISTENER_STATE_INIT), int32(LISTENER_STATE_ACTIVE)) {
 			rw.WriteHeader(http.StatusOK)
 			rw.Write([]byte("Activated"))
 			return
@@ -157,14 +297,28 @@ func (lbs *Listener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	requestURL := req.URL.RequestURI()
 
+	// Attach logger carrying request id, so that every log line of the request can be correlated
+	requestID := ""
+	logContext := log.With()
+	if lbs.RequestID != nil {
+		requestID = req.Header.Get(lbs.RequestID.Header)
+		if requestID == "" {
+			requestID = lbs.RequestID.Generate()
+			req.Header.Set(lbs.RequestID.Header, requestID)
+		}
+		logContext = logContext.Str("request_id", requestID)
+	}
+	logger := logContext.Logger()
+	req = req.WithContext(logger.WithContext(req.Context()))
+
 	candidateBalancer := struct {
 		balancer *Balancer
 		weight   int
 	}{}
 
 	found := false
-	for _, balancer := range lbs.Balancers {
-		if strings.Index(requestURL, balancer.RoutePrefix) == 0 && balancer.IsAvailable() {
+	for _, balancer := range lbs.GetBalancers() {
+		if !balancer.Passthrough && strings.Index(requestURL, balancer.RoutePrefix) == 0 && balancer.IsAvailable() {
 			found = true
 			balancerMatchWeight := len(balancer.RoutePrefix)
 			if candidateBalancer.weight < balancerMatchWeight {
@@ -174,23 +328,76 @@ func (lbs *Listener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 	if found {
-		log.Debug().
-			Str("lister", lbs.Protocol+":"+lbs.Port).
+		logger.Debug().
+			Str("lister", lbs.Name()).
 			Str("uri", req.RequestURI).
 			Str("method", req.Method).
 			Msg("Request received")
 
+		record := &RequestRecord{
+			Listener:  lbs.Name(),
+			Balancer:  candidateBalancer.balancer.Id,
+			RequestID: requestID,
+			Start:     time.Now(),
+		}
+		recorder := &responseRecorder{ResponseWriter: rw}
+		if requestID != "" {
+			recorder.overrides = http.Header{}
+			recorder.overrides.Set(lbs.RequestID.Header, requestID)
+		}
+		rw = recorder
+		if req.ContentLength != 0 {
+			req.Body = &countingReader{ReadCloser: req.Body, count: &record.BytesIn}
+		}
+		req = withRequestRecord(req, record)
+
+		span := lbs.Tracer.StartServerSpan(req, req.Method+" "+candidateBalancer.balancer.RoutePrefix, candidateBalancer.balancer.TraceSampleRatio)
+		if span != nil {
+			span.SetAttribute("http.method", req.Method)
+			span.SetAttribute("http.target", req.RequestURI)
+			span.SetAttribute("lb.listener", lbs.Name())
+			span.SetAttribute("lb.balancer", candidateBalancer.balancer.Id)
+			if requestID != "" {
+				span.SetAttribute("http.request_id", requestID)
+			}
+			req = req.WithContext(withSpan(req.Context(), span))
+		}
+		defer func() {
+			span.SetAttribute("http.status_code", recorder.StatusCode())
+			if recorder.StatusCode() >= http.StatusInternalServerError {
+				span.SetStatus(SPAN_STATUS_ERROR, http.StatusText(recorder.StatusCode()))
+			}
+			span.Finish()
+		}()
+
+		defer func() {
+			record.Status = recorder.StatusCode()
+			record.BytesOut = recorder.BytesWritten
+			record.Duration = time.Since(record.Start)
+			lbs.Metrics.ObserveRequest(record)
+			lbs.AccessLog.Log(NewAccessLogEntry(record, req), candidateBalancer.balancer.AccessLogSampleRate)
+		}()
+
 		// Pass request to the chosen balancer
 		err := candidateBalancer.balancer.serveProxy(rw, req)
 		if err != nil {
-			if err.Error() == "notfound" {
+			switch err {
+			case ErrNoTargetsAvailable:
 				rw.WriteHeader(http.StatusServiceUnavailable)
+			case ErrRequestBodyTooLarge:
+				http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			case ErrQueueFull, ErrQueueTimeout, ErrConcurrencyLimited:
+				http.Error(rw, "Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
 			}
 		}
 	} else {
-		log.Info().
+		if requestID != "" {
+			rw.Header().Set(lbs.RequestID.Header, requestID)
+		}
+		logger.Info().
 			Str("route", requestURL).
 			Msg("Request rejected. No matching balancer found.")
+		lbs.Metrics.IncNoMatchingBalancer(lbs.Name())
 	}
 }
 
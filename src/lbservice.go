@@ -2,8 +2,10 @@ package src
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,41 +14,122 @@ import (
 )
 
 type LoadBalancerService struct {
-	Params               *LoadBalancerServiceParams
-	Config               *LoadBalancerYAMLConfiguration
+	Params *LoadBalancerServiceParams
+	Config *LoadBalancerYAMLConfiguration
+	// Listeners and balancers change on configuration reload while holding `mu`
 	Listeners            []*Listener
 	BalancersIdReference map[string]*Balancer
+	Upstreams            map[string]*Upstream
+	mu                   sync.RWMutex
+	reloadMu             sync.Mutex
+	stopWatch            chan struct{}
 	State                string
+	Metrics              *MetricsRegistry
+	Admin                *AdminServer
+	AccessLog            *AccessLogger
+	Tracer               *Tracer
 }
 
 type LoadBalancerServiceParams struct {
 	DebugMode          bool
 	YAMLConfigFilePath string
 	YAMLConfigString   string
+	// Format of configuration, judged by file extension if not set
+	ConfigFormat string
+	// Interval of checking configuration file for changes. 0 disables watching.
+	WatchConfigInterval time.Duration
+	// Subcommand selected on command line
+	Command string
+	// Output format of `dump` command
+	DumpFormat string
 }
 
+// Subcommands of the load balancer binary
+const (
+	CMD_RUN      = "run"
+	CMD_VALIDATE = "validate"
+	CMD_DUMP     = "dump"
+	CMD_SCHEMA   = "schema"
+)
+
+var supportedCommands []string = []string{
+	CMD_RUN, CMD_VALIDATE, CMD_DUMP, CMD_SCHEMA,
+}
+
+func IsValidCommand(command string) bool {
+	for _, val := range supportedCommands {
+		if val == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses command line. First argument selects the subcommand; without one `run` is assumed,
+// so `-config` and other flags keep working as before. `validate` and `dump` take
+// configuration file as their argument, `schema` takes none.
 func LoadFlags() *LoadBalancerServiceParams {
-	params := &LoadBalancerServiceParams{}
+	params := &LoadBalancerServiceParams{Command: CMD_RUN}
 
-	debug := flag.Bool("debug", false, "Sets log level to debug")
-	configFile := flag.String("config", "", "Path to YAML config file.")
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		params.Command = args[0]
+		args = args[1:]
+	}
+	if !IsValidCommand(params.Command) {
+		fmt.Fprintf(os.Stderr, "unknown command '%v', supported commands are: %v\n", params.Command, strings.Join(supportedCommands, ", "))
+		os.Exit(2)
+	}
 
-	flag.Parse()
+	flags := flag.NewFlagSet(params.Command, flag.ExitOnError)
+	debug := flags.Bool("debug", false, "Sets log level to debug")
+	configFile := flags.String("config", "", "Path to config file.")
+	configFormat := flags.String("config-format", "", "Format of config file, one of: "+strings.Join(supportedConfigFormats, ", ")+". Judged by file extension if not set.")
+	var watchInterval *time.Duration
+	var dumpFormat *string
+	switch params.Command {
+	case CMD_RUN:
+		watchInterval = flags.Duration("watch", 0, "Reload config file when it changes, checking at given interval, e.g. 5s.")
+	case CMD_DUMP:
+		dumpFormat = flags.String("format", DUMP_FORMAT_YAML, "Output format, one of: "+strings.Join(supportedDumpFormats, ", "))
+	}
+	flags.Parse(args)
 
 	// Load Debug flag
 	params.DebugMode = *debug
 
 	// Load config file path
 	params.YAMLConfigFilePath = *configFile
+	params.ConfigFormat = *configFormat
+	if params.ConfigFormat != "" && !IsValidConfigFormat(params.ConfigFormat) {
+		fmt.Fprintf(os.Stderr, "config format '%v' is invalid, supported formats are: %v\n", params.ConfigFormat, strings.Join(supportedConfigFormats, ", "))
+		os.Exit(2)
+	}
+	if params.Command != CMD_RUN && flags.NArg() > 0 {
+		params.YAMLConfigFilePath = flags.Arg(0)
+	}
+	if watchInterval != nil {
+		params.WatchConfigInterval = *watchInterval
+	}
+	if dumpFormat != nil {
+		params.DumpFormat = *dumpFormat
+	}
 
 	return params
 }
 
-func (lbs *LoadBalancerService) SetParams(config *LoadBalancerServiceParams) {
-	lbs.Params = config
+// Loads configuration file in format set by parameters, or judged by its extension
+func (params *LoadBalancerServiceParams) LoadConfigFile() (*LoadBalancerYAMLConfiguration, error) {
+	if params.ConfigFormat != "" {
+		return LoadConfigFromFileAs(params.YAMLConfigFilePath, params.ConfigFormat)
+	}
+	return LoadConfigFromFile(params.YAMLConfigFilePath)
+}
 
+// Sets up global logger, which reports errors only unless debug mode is enabled
+func ConfigureLogging(debugMode bool) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if lbs.Params.DebugMode {
+	if debugMode {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
 		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
@@ -56,78 +139,244 @@ func (lbs *LoadBalancerService) SetParams(config *LoadBalancerServiceParams) {
 		Out:        os.Stderr,
 		TimeFormat: time.RFC3339,
 	})
+}
 
+// Sets parameters and loads configuration. Returns error if configuration could not be
+// loaded or is invalid, in which case the service refuses to start.
+func (lbs *LoadBalancerService) SetParams(config *LoadBalancerServiceParams) error {
+	lbs.Params = config
+
+	ConfigureLogging(lbs.Params.DebugMode)
+
+	var err error
 	if len(lbs.Params.YAMLConfigFilePath) > 0 {
-		var err error
-		lbs.Config, err = LoadConfigFromFile(lbs.Params.YAMLConfigFilePath)
-		if err != nil {
-			log.Error().Err(err)
-		}
+		lbs.Config, err = lbs.Params.LoadConfigFile()
 	}
-
-	if len(lbs.Params.YAMLConfigString) > 0 {
-		var err error
-		lbs.Config, err = loadConfigFromString(lbs.Params.YAMLConfigString)
-		if err != nil {
-			log.Error().Err(err)
-		}
+	if err == nil && len(lbs.Params.YAMLConfigString) > 0 {
+		lbs.Config, err = loadConfigFromString(lbs.Params.YAMLConfigString, lbs.Params.ConfigFormat)
+	}
+	if configErrors, ok := err.(ConfigErrors); ok {
+		configErrors.Log()
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to load configuration")
 	}
+	return err
 }
 
 func (lbs *LoadBalancerService) Apply() {
+	if lbs.Config == nil {
+		log.Error().Msg("No valid configuration loaded, refusing to start")
+		return
+	}
 	lbs.BalancersIdReference = make(map[string]*Balancer)
-	for _, listenerCnf := range lbs.Config.Listeners {
-		lbListener := Listener{
-			Port:     listenerCnf.Port,
-			Protocol: listenerCnf.Protocol,
-			Srv: http.Server{
-				Addr: ":" + listenerCnf.Port,
-			},
-			ListenerWG: &sync.WaitGroup{},
+	lbs.Metrics = NewMetricsRegistry()
+	if lbs.Config.Tracing != nil {
+		lbs.Tracer = NewTracer(lbs.Config.Tracing)
+	}
+	if lbs.Config.AccessLog != nil {
+		var err error
+		lbs.AccessLog, err = NewAccessLogger(lbs.Config.AccessLog)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open access log")
 		}
-
-		for _, route := range listenerCnf.Routes {
-			lbalancer := &Balancer{
-				Id:                route.Id,
-				Mode:              route.Mode,
-				RoutePrefix:       route.Routeprefix,
-				CustomHeaderRules: route.CustomHeaders,
-			}
-			if route.TargetWaitTimeout > 0 {
-				lbalancer.TargetWaitTimeout = time.Duration(route.TargetWaitTimeout) * time.Second
-			} else {
-				lbalancer.TargetWaitTimeout = DEFAULT_TARGET_WAIT_TIMEOUT
-			}
-			lbalancer.SetBalancerLogic()
-			for _, target := range route.Targets {
-				lbalancer.AddNewServer(&target)
-			}
-
-			lbListener.Balancers = append(lbListener.Balancers, lbalancer)
-			lbs.BalancersIdReference[route.Id] = lbalancer
+	}
+	lbs.Upstreams = make(map[string]*Upstream)
+	for name, upstreamCnf := range lbs.Config.Upstreams {
+		lbs.Upstreams[name] = NewUpstream(name, &upstreamCnf)
+	}
+	for index := range lbs.Config.Listeners {
+		lbListener := lbs.newListener(&lbs.Config.Listeners[index], lbs.Upstreams)
+		for _, balancer := range lbListener.Balancers {
+			lbs.BalancersIdReference[balancer.Id] = balancer
 		}
-		lbs.Listeners = append(lbs.Listeners, &lbListener)
-		lbListener.Srv.Handler = lbListener.GetListenerHandler()
+		lbs.Listeners = append(lbs.Listeners, lbListener)
+	}
+
+	if lbs.Config.Admin != nil {
+		lbs.startAdminServer(lbs.Config.Admin)
 	}
 
 	// start all listeners
+	startListeners(lbs.Listeners)
+
+	if lbs.Params.WatchConfigInterval > 0 && lbs.Params.YAMLConfigFilePath != "" {
+		lbs.WatchConfig(lbs.Params.WatchConfigInterval)
+	}
+}
+
+// Returns snapshot of service's listeners
+func (lbs *LoadBalancerService) GetListeners() []*Listener {
+	lbs.mu.RLock()
+	defer lbs.mu.RUnlock()
+	return lbs.Listeners
+}
+
+// Returns upstream with given name, or nil if there is none
+func (lbs *LoadBalancerService) GetUpstream(name string) *Upstream {
+	lbs.mu.RLock()
+	defer lbs.mu.RUnlock()
+	return lbs.Upstreams[name]
+}
+
+// Returns balancer with given id, or nil if there is none
+func (lbs *LoadBalancerService) GetBalancer(id string) *Balancer {
+	lbs.mu.RLock()
+	defer lbs.mu.RUnlock()
+	return lbs.BalancersIdReference[id]
+}
+
+// Starts listeners and waits till they are ready to serve requests. Returns error of
+// first listener which failed to start.
+func startListeners(listeners []*Listener) (err error) {
 	startersSync := &sync.WaitGroup{}
-	startersSync.Add(len(lbs.Listeners))
-	for _, lblistener := range lbs.Listeners {
-		lblistener.Start(startersSync)
+	startersSync.Add(len(listeners))
+	for _, lblistener := range listeners {
+		if startErr := lblistener.Start(startersSync); startErr != nil && err == nil {
+			err = startErr
+		}
 	}
 	startersSync.Wait()
+	return
+}
+
+// Creates listener along with its balancers, taking targets of routes which use an upstream from `upstreams`
+func (lbs *LoadBalancerService) newListener(listenerCnf *ListenerYAMLConfig, upstreams map[string]*Upstream) *Listener {
+	lbListener := &Listener{
+		Port:              listenerCnf.Port,
+		Protocol:          listenerCnf.Protocol,
+		SSLCertificate:    listenerCnf.SSLCertificate,
+		SSLCertificateKey: listenerCnf.SSLCertificateKey,
+		Srv: http.Server{
+			Addr:              ":" + listenerCnf.Port,
+			ReadHeaderTimeout: DEFAULT_LISTENER_READ_HEADER_TIMEOUT,
+			ReadTimeout:       time.Duration(listenerCnf.ReadTimeoutMs) * time.Millisecond,
+			WriteTimeout:      time.Duration(listenerCnf.WriteTimeoutMs) * time.Millisecond,
+			IdleTimeout:       DEFAULT_LISTENER_IDLE_TIMEOUT,
+			MaxHeaderBytes:    listenerCnf.MaxHeaderBytes,
+		},
+		ListenerWG:          &sync.WaitGroup{},
+		MaxConnectionsPerIP: listenerCnf.MaxConnectionsPerIP,
+		Metrics:             lbs.Metrics,
+		AccessLog:           lbs.AccessLog,
+		Tracer:              lbs.Tracer,
+		RequestID:           NewRequestIDGenerator(listenerCnf.RequestID),
+	}
+	if listenerCnf.ReadHeaderTimeoutMs > 0 {
+		lbListener.Srv.ReadHeaderTimeout = time.Duration(listenerCnf.ReadHeaderTimeoutMs) * time.Millisecond
+	}
+	if listenerCnf.IdleTimeoutMs > 0 {
+		lbListener.Srv.IdleTimeout = time.Duration(listenerCnf.IdleTimeoutMs) * time.Millisecond
+	}
+
+	for index := range listenerCnf.Routes {
+		route := &listenerCnf.Routes[index]
+		lbalancer := lbs.newBalancer(route, listenerCnf.Protocol)
+		addRouteTargets(lbalancer, route, upstreams)
+		lbListener.Balancers = append(lbListener.Balancers, lbalancer)
+	}
+	switch listenerCnf.Protocol {
+	case LS_PROTOCOL_TCP, LS_PROTOCOL_TLS:
+		lbListener.tcp = newTCPProxy(lbListener, listenerCnf)
+	case LS_PROTOCOL_UDP:
+		lbListener.udp = newUDPProxy(lbListener, listenerCnf)
+	case LS_PROTOCOL_HTTPS:
+		lbListener.passthrough = newTCPProxy(lbListener, listenerCnf)
+	}
+	lbListener.Srv.Handler = lbListener.GetListenerHandler()
+	return lbListener
+}
+
+// Creates balancer for route of listener with given protocol, without targets
+func (lbs *LoadBalancerService) newBalancer(route *RouteYAMLConfig, protocol string) *Balancer {
+	if route.Passthrough {
+		protocol = LS_PROTOCOL_TLS
+	}
+	lbalancer := &Balancer{
+		Protocol:            protocol,
+		Id:                  route.Id,
+		Mode:                route.Mode,
+		RoutePrefix:         route.Routeprefix,
+		CustomHeaderRules:   route.CustomHeaders,
+		Timeouts:            route.Timeouts,
+		MaxRequestBodyBytes: route.MaxRequestBodyBytes,
+		Passthrough:         route.Passthrough,
+		ServerNames:         route.ServerNames,
+	}
+	if route.TargetWaitTimeout > 0 {
+		lbalancer.TargetWaitTimeout = time.Duration(route.TargetWaitTimeout) * time.Second
+	} else {
+		lbalancer.TargetWaitTimeout = DEFAULT_TARGET_WAIT_TIMEOUT
+	}
+	lbalancer.Admission = &AdmissionController{
+		MaxConnections:       int64(route.MaxConnections),
+		MaxTargetConnections: int64(route.MaxTargetConnections),
+		MaxQueueSize:         route.MaxQueueSize,
+		MaxQueueTime:         time.Duration(route.MaxQueueTime) * time.Second,
+	}
+	if route.AccessLogSampleRate != nil {
+		lbalancer.AccessLogSampleRate = *route.AccessLogSampleRate
+	} else if lbs.AccessLog != nil {
+		lbalancer.AccessLogSampleRate = lbs.AccessLog.SampleRate
+	}
+	if route.TraceSampleRatio != nil {
+		lbalancer.TraceSampleRatio = *route.TraceSampleRatio
+	} else if lbs.Tracer != nil {
+		lbalancer.TraceSampleRatio = lbs.Tracer.SampleRatio
+	}
+	lbalancer.Limiter = NewConcurrencyLimiter(route.AdaptiveConcurrency)
+	lbalancer.Hedging = NewHedgePolicy(route.Hedging)
+	lbalancer.SetBalancerLogic()
+	return lbalancer
+}
+
+// Adds targets of route to its new balancer, or attaches balancer to route's upstream
+func addRouteTargets(balancer *Balancer, route *RouteYAMLConfig, upstreams map[string]*Upstream) {
+	if route.Upstream != "" {
+		upstreams[route.Upstream].attach(balancer)
+		return
+	}
+	addConfiguredTargets(balancer, route.Targets)
 }
 
 func (lbs *LoadBalancerService) Stop() {
 	log.Info().Msg("Triggered shutdown procedure for Load Balancer Service...")
+	if lbs.stopWatch != nil {
+		close(lbs.stopWatch)
+		lbs.stopWatch = nil
+	}
 	serversSync := &sync.WaitGroup{}
-	serversSync.Add(len(lbs.Listeners))
-	for _, listener := range lbs.Listeners {
+	listeners := lbs.GetListeners()
+	serversSync.Add(len(listeners))
+	for _, listener := range listeners {
 		go func(serversSync *sync.WaitGroup, listener *Listener) {
 			listener.Shutdown(serversSync)
 		}(serversSync, listener)
 	}
 	serversSync.Wait()
+	lbs.mu.RLock()
+	for _, upstream := range lbs.Upstreams {
+		upstream.Close()
+	}
+	lbs.mu.RUnlock()
+	if lbs.Admin != nil {
+		lbs.Admin.Shutdown()
+	}
+	if lbs.AccessLog != nil {
+		lbs.AccessLog.Close()
+	}
+	lbs.Tracer.Shutdown()
 	log.Info().Msg("Load Balancer service shutdown completed")
 }
+
+func (lbs *LoadBalancerService) startAdminServer(cnf *AdminYAMLConfig) {
+	lbs.Admin = NewAdminServer(cnf)
+	metricsPath := cnf.MetricsPath
+	if metricsPath == "" {
+		metricsPath = DEFAULT_METRICS_PATH
+	}
+	lbs.Admin.HandleFunc(metricsPath, lbs.serveMetrics)
+	lbs.Admin.HandleFunc("/api/listeners", lbs.serveListenersAPI)
+	lbs.Admin.HandleFunc("/api/balancers", lbs.serveBalancersAPI)
+	lbs.Admin.HandleFunc("/api/balancers/", lbs.serveBalancerAPI)
+	lbs.Admin.Start()
+}
@@ -0,0 +1,187 @@
+package src
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Adaptive concurrency algorithms
+const (
+	LIMITER_ALGORITHM_AIMD     = "AIMD"
+	LIMITER_ALGORITHM_GRADIENT = "Gradient"
+
+	DEFAULT_LIMITER_INITIAL_LIMIT        = 20
+	DEFAULT_LIMITER_MIN_LIMIT            = 1
+	DEFAULT_LIMITER_MAX_LIMIT            = 1000
+	DEFAULT_LIMITER_BACKOFF_RATIO        = 0.9
+	DEFAULT_LIMITER_LATENCY_THRESHOLD    = 5 * time.Second
+	DEFAULT_LIMITER_SMOOTHING            = 0.2
+	DEFAULT_LIMITER_LONG_WINDOW_SAMPLES  = 600
+	DEFAULT_LIMITER_SHORT_WINDOW_SAMPLES = 10
+)
+
+var supportedLimiterAlgorithms []string = []string{
+	LIMITER_ALGORITHM_AIMD,
+	LIMITER_ALGORITHM_GRADIENT,
+}
+
+func IsValidLimiterAlgorithm(algorithm string) bool {
+	for _, val := range supportedLimiterAlgorithms {
+		if val == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+type AdaptiveConcurrencyYAMLConfig struct {
+	Algorithm          string  `yaml:"algorithm"`
+	InitialLimit       int     `yaml:"initialLimit"`
+	MinLimit           int     `yaml:"minLimit"`
+	MaxLimit           int     `yaml:"maxLimit"`
+	BackoffRatio       float64 `yaml:"backoffRatio"`
+	LatencyThresholdMs int     `yaml:"latencyThresholdMs"`
+	Smoothing          float64 `yaml:"smoothing"`
+}
+
+// Adjusts the allowed number of in-flight requests of a balancer from measured latency
+type ConcurrencyLimiter interface {
+	// Returns current limit of in-flight requests
+	Limit() int
+	// Records the outcome of a completed request. `inFlight` is the number of
+	// in-flight requests when the request was admitted.
+	OnSample(rtt time.Duration, inFlight int64, didDrop bool)
+}
+
+// Returns limiter for given config, or nil if adaptive concurrency is not configured
+func NewConcurrencyLimiter(cnf *AdaptiveConcurrencyYAMLConfig) ConcurrencyLimiter {
+	if cnf == nil || cnf.Algorithm == "" {
+		return nil
+	}
+	switch cnf.Algorithm {
+	case LIMITER_ALGORITHM_AIMD:
+		limiter := &AIMDLimiter{
+			BackoffRatio:     DEFAULT_LIMITER_BACKOFF_RATIO,
+			LatencyThreshold: DEFAULT_LIMITER_LATENCY_THRESHOLD,
+		}
+		limiter.setBounds(cnf)
+		if cnf.BackoffRatio > 0 && cnf.BackoffRatio < 1 {
+			limiter.BackoffRatio = cnf.BackoffRatio
+		}
+		if cnf.LatencyThresholdMs > 0 {
+			limiter.LatencyThreshold = time.Duration(cnf.LatencyThresholdMs) * time.Millisecond
+		}
+		return limiter
+	case LIMITER_ALGORITHM_GRADIENT:
+		limiter := &GradientLimiter{
+			Smoothing: DEFAULT_LIMITER_SMOOTHING,
+		}
+		limiter.setBounds(cnf)
+		if cnf.Smoothing > 0 && cnf.Smoothing <= 1 {
+			limiter.Smoothing = cnf.Smoothing
+		}
+		return limiter
+	default:
+		log.Error().Msgf("Adaptive concurrency algorithm '%v' is not supported.", cnf.Algorithm)
+	}
+	return nil
+}
+
+type limiterBounds struct {
+	mu       sync.Mutex
+	limit    float64
+	minLimit float64
+	maxLimit float64
+}
+
+func (lim *limiterBounds) setBounds(cnf *AdaptiveConcurrencyYAMLConfig) {
+	lim.limit = float64(DEFAULT_LIMITER_INITIAL_LIMIT)
+	lim.minLimit = float64(DEFAULT_LIMITER_MIN_LIMIT)
+	lim.maxLimit = float64(DEFAULT_LIMITER_MAX_LIMIT)
+	if cnf.InitialLimit > 0 {
+		lim.limit = float64(cnf.InitialLimit)
+	}
+	if cnf.MinLimit > 0 {
+		lim.minLimit = float64(cnf.MinLimit)
+	}
+	if cnf.MaxLimit > 0 {
+		lim.maxLimit = float64(cnf.MaxLimit)
+	}
+	lim.limit = lim.clamp(lim.limit)
+}
+
+func (lim *limiterBounds) clamp(limit float64) float64 {
+	return math.Max(lim.minLimit, math.Min(lim.maxLimit, limit))
+}
+
+func (lim *limiterBounds) Limit() int {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return int(lim.limit)
+}
+
+/****** AIMD ******/
+
+// Additive increase, multiplicative decrease. Limit grows by one on every successful
+// request and backs off when a request fails or exceeds `LatencyThreshold`.
+type AIMDLimiter struct {
+	limiterBounds
+	BackoffRatio     float64
+	LatencyThreshold time.Duration
+}
+
+func (al *AIMDLimiter) OnSample(rtt time.Duration, inFlight int64, didDrop bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if didDrop || rtt > al.LatencyThreshold {
+		al.limit = al.clamp(math.Floor(al.limit * al.BackoffRatio))
+	} else if float64(inFlight)*2 >= al.limit {
+		// Only grow when limit is actually being used
+		al.limit = al.clamp(al.limit + 1)
+	}
+}
+
+/****** Gradient ******/
+
+// Compares short term latency against a long term baseline and shrinks the limit
+// as latency rises above the baseline, allowing a small queue of sqrt(limit).
+type GradientLimiter struct {
+	limiterBounds
+	Smoothing float64
+	shortRtt  float64
+	longRtt   float64
+}
+
+func (gl *GradientLimiter) OnSample(rtt time.Duration, inFlight int64, didDrop bool) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	sample := float64(rtt)
+	if gl.longRtt == 0 {
+		gl.shortRtt = sample
+		gl.longRtt = sample
+	}
+	gl.shortRtt += (sample - gl.shortRtt) / DEFAULT_LIMITER_SHORT_WINDOW_SAMPLES
+	gl.longRtt += (sample - gl.longRtt) / DEFAULT_LIMITER_LONG_WINDOW_SAMPLES
+
+	// Don't grow while the limit is not being used
+	if float64(inFlight) < gl.limit/2 && !didDrop {
+		return
+	}
+
+	// Let the baseline recover quickly after a period of high latency
+	if gl.longRtt/gl.shortRtt > 2 {
+		gl.longRtt *= 0.95
+	}
+
+	gradient := math.Max(0.5, math.Min(1.0, gl.longRtt/gl.shortRtt))
+	if didDrop {
+		gradient = 0.5
+	}
+	newLimit := gl.limit*gradient + math.Sqrt(gl.limit)
+	newLimit = gl.limit*(1-gl.Smoothing) + newLimit*gl.Smoothing
+	gl.limit = gl.clamp(newLimit)
+}
@@ -3,13 +3,15 @@ package src
 import (
 	"math/rand"
 	"sync"
-	"time"
-
-	"github.com/rs/zerolog/log"
 )
 
+// Selects the next target for a request other than `exclude`, which may be nil. `Next` must
+// not block; it returns nil when no target is available and leaves waiting to the
+// balancer's admission controller.
+// Balancer holds read lock on its targets while `Next` runs, so `lb.Targets` does not change
+// during a call but may differ between calls.
 type BalancerLogic interface {
-	Next(lb *Balancer) *Target
+	Next(lb *Balancer, exclude *Target) *Target
 	Init()
 }
 
@@ -20,35 +22,20 @@ func (rl *RandomLogic) Init() {
 
 }
 
-func (rl *RandomLogic) Next(lb *Balancer) *Target {
-	var successTarget = make(chan *Target, 1)
-	go func() {
-		liveTargets := []int{}
-		for index, target := range lb.Targets {
-			if target.IsAlive() {
-				liveTargets = append(liveTargets, index)
-			}
+func (rl *RandomLogic) Next(lb *Balancer, exclude *Target) *Target {
+	liveTargets := []int{}
+	for index, target := range lb.Targets {
+		if target != exclude && target.IsAvailable() {
+			liveTargets = append(liveTargets, index)
 		}
-		liveTargetsLength := len(liveTargets)
-		if liveTargetsLength == 0 {
-			successTarget <- nil
-			return
-		}
-
-		randomIndex := rand.Intn(liveTargetsLength)
-		successTarget <- lb.Targets[liveTargets[randomIndex]]
-	}()
-
-	select {
-	case <-time.After(lb.TargetWaitTimeout):
-		log.Info().
-			Str("balancer", lb.Id).
-			Str("mode", lb.Mode).
-			Msg("Request is timing out due to no available targets.")
+	}
+	liveTargetsLength := len(liveTargets)
+	if liveTargetsLength == 0 {
 		return nil
-	case target := <-successTarget:
-		return target
 	}
+
+	randomIndex := rand.Intn(liveTargetsLength)
+	return lb.Targets[liveTargets[randomIndex]]
 }
 
 /****** Round Robin *******/
@@ -62,44 +49,25 @@ func (rbl *RoundRobinLogic) Init() {
 	rbl.CounterMutex = &sync.Mutex{}
 }
 
-func (rbl *RoundRobinLogic) Next(lb *Balancer) *Target {
+func (rbl *RoundRobinLogic) Next(lb *Balancer, exclude *Target) *Target {
 	targetCount := len(lb.Targets)
 
-	var successTarget = make(chan *Target, 1)
-	breakerFlag := false
-	go func(breakerFlag *bool) {
-		rbl.CounterMutex.Lock()
-		defer rbl.CounterMutex.Unlock()
-		var targetIndex int
-		for i := 0; i < targetCount; i++ {
-			targetIndex = rbl.Counter % targetCount
-			target := lb.Targets[targetIndex]
-			rbl.Counter++
-			if target.IsAlive() {
-				if lb.DebugMode {
-					lb.recordIndex(targetIndex)
-				}
-				rbl.Counter = rbl.Counter % targetCount
-				successTarget <- target
-				break
-			}
-			if *breakerFlag {
-				break
+	rbl.CounterMutex.Lock()
+	defer rbl.CounterMutex.Unlock()
+	var targetIndex int
+	for i := 0; i < targetCount; i++ {
+		targetIndex = rbl.Counter % targetCount
+		target := lb.Targets[targetIndex]
+		rbl.Counter++
+		if target != exclude && target.IsAvailable() {
+			if lb.DebugMode {
+				lb.recordIndex(targetIndex)
 			}
+			rbl.Counter = rbl.Counter % targetCount
+			return target
 		}
-	}(&breakerFlag)
-
-	select {
-	case <-time.After(lb.TargetWaitTimeout):
-		log.Info().
-			Str("balancer", lb.Id).
-			Str("mode", lb.Mode).
-			Msg("Request is timing out due to no available targets.")
-		breakerFlag = true
-		return nil
-	case target := <-successTarget:
-		return target
 	}
+	return nil
 }
 
 /****** Weighted Round Robin *******/
@@ -115,49 +83,31 @@ func (wrbl *WeightedRoundRobinLogic) Init() {
 	wrbl.CounterMutex = &sync.Mutex{}
 }
 
-func (wrbl *WeightedRoundRobinLogic) Next(lb *Balancer) *Target {
+func (wrbl *WeightedRoundRobinLogic) Next(lb *Balancer, exclude *Target) *Target {
 	targetCount := len(lb.Targets)
 
-	successTarget := make(chan *Target, 1)
-	breakerFlag := false
-	go func(breakerFlag *bool) {
-		wrbl.CounterMutex.Lock()
-		defer wrbl.CounterMutex.Unlock()
-		var targetIndex, weightIndex int
-		for i := 0; i < targetCount; i++ {
-			targetIndex = wrbl.Counter % targetCount
-			weightIndex = wrbl.WeightCounter
-			target := lb.Targets[targetIndex]
-			wrbl.WeightCounter++
-			if wrbl.WeightCounter >= target.Weight || !target.IsAlive() {
-				wrbl.Counter++
-				wrbl.WeightCounter = 0
-			}
-			if target.IsAlive() {
-				if lb.DebugMode {
-					lb.recordWeightedIndex(targetIndex, weightIndex)
-				}
-				wrbl.Counter %= targetCount
-				successTarget <- target
-				return
-			}
-			if *breakerFlag {
-				return
+	wrbl.CounterMutex.Lock()
+	defer wrbl.CounterMutex.Unlock()
+	var targetIndex, weightIndex int
+	for i := 0; i < targetCount; i++ {
+		targetIndex = wrbl.Counter % targetCount
+		weightIndex = wrbl.WeightCounter
+		target := lb.Targets[targetIndex]
+		isAvailable := target != exclude && target.IsAvailable()
+		wrbl.WeightCounter++
+		if wrbl.WeightCounter >= target.Weight || !isAvailable {
+			wrbl.Counter++
+			wrbl.WeightCounter = 0
+		}
+		if isAvailable {
+			if lb.DebugMode {
+				lb.recordWeightedIndex(targetIndex, weightIndex)
 			}
+			wrbl.Counter %= targetCount
+			return target
 		}
-	}(&breakerFlag)
-
-	select {
-	case <-time.After(lb.TargetWaitTimeout):
-		log.Info().
-			Str("balancer", lb.Id).
-			Str("mode", lb.Mode).
-			Msg("Request is timing out due to no available targets.")
-		breakerFlag = true
-		return nil
-	case target := <-successTarget:
-		return target
 	}
+	return nil
 }
 
 /******* Least Connections Logic ********/
@@ -169,41 +119,28 @@ func (lc *LeastConnectionsRandomLogic) Init() {
 
 }
 
-func (lc *LeastConnectionsRandomLogic) Next(lb *Balancer) *Target {
-	var successTarget = make(chan *Target, 1)
-	go func() {
-		pool := []*Target{}
-
-		minTarget := lb.Targets[0]
-		pool = append(pool, minTarget)
+func (lc *LeastConnectionsRandomLogic) Next(lb *Balancer, exclude *Target) *Target {
+	pool := []*Target{}
+	var minTarget *Target
 
-		for _, nextTarget := range lb.Targets[1:] {
-			if nextTarget.IsAlive() {
-				if nextTarget.Connections < minTarget.Connections {
-					minTarget = nextTarget
-					pool = []*Target{
-						minTarget,
-					}
-				} else if nextTarget.Connections == minTarget.Connections {
-					pool = append(pool, nextTarget)
+	for _, nextTarget := range lb.Targets {
+		if nextTarget != exclude && nextTarget.IsAvailable() {
+			if minTarget == nil || nextTarget.ActiveConnections() < minTarget.ActiveConnections() {
+				minTarget = nextTarget
+				pool = []*Target{
+					minTarget,
 				}
+			} else if nextTarget.ActiveConnections() == minTarget.ActiveConnections() {
+				pool = append(pool, nextTarget)
 			}
 		}
-		poolSize := len(pool)
-		if poolSize > 1 {
-			randIndex := rand.Intn(poolSize)
-			minTarget = pool[randIndex]
-		}
-		successTarget <- minTarget
-	}()
-
-	select {
-	case <-time.After(lb.TargetWaitTimeout):
-		log.Info().Str("balancer", lb.Id).Str("mode", lb.Mode).Msg("Request is timing out due to no available targets.")
-		return nil
-	case target := <-successTarget:
-		return target
 	}
+	poolSize := len(pool)
+	if poolSize > 1 {
+		randIndex := rand.Intn(poolSize)
+		minTarget = pool[randIndex]
+	}
+	return minTarget
 }
 
 /******* Least Connections RoundRobin Logic ********/
@@ -217,47 +154,36 @@ func (lc *LeastConnectionsRoundRobinLogic) Init() {
 	lc.LastIndex = -1
 }
 
-func (lc *LeastConnectionsRoundRobinLogic) Next(lb *Balancer) *Target {
-	var successTarget = make(chan *Target, 1)
-	go func() {
-		var indexPool []int
-		var minTarget *Target
+func (lc *LeastConnectionsRoundRobinLogic) Next(lb *Balancer, exclude *Target) *Target {
+	var indexPool []int
+	var minTarget *Target
 
-		lc.mu.Lock()
-		defer lc.mu.Unlock()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
 
-		for index, nextTarget := range lb.Targets {
-			if nextTarget.IsAlive() {
-				if minTarget == nil || nextTarget.Connections < minTarget.Connections {
-					minTarget = nextTarget
-					indexPool = []int{index}
-				} else if nextTarget.Connections == minTarget.Connections {
-					indexPool = append(indexPool, index)
-				}
+	for index, nextTarget := range lb.Targets {
+		if nextTarget != exclude && nextTarget.IsAvailable() {
+			if minTarget == nil || nextTarget.ActiveConnections() < minTarget.ActiveConnections() {
+				minTarget = nextTarget
+				indexPool = []int{index}
+			} else if nextTarget.ActiveConnections() == minTarget.ActiveConnections() {
+				indexPool = append(indexPool, index)
 			}
 		}
-		candidateTargetIndex := -1
-		if len(indexPool) > 0 {
-			for _, index := range indexPool {
-				if candidateTargetIndex == -1 {
-					candidateTargetIndex = index
-				}
-				if index > lc.LastIndex {
-					candidateTargetIndex = index
-					break
-				}
+	}
+	candidateTargetIndex := -1
+	if len(indexPool) > 0 {
+		for _, index := range indexPool {
+			if candidateTargetIndex == -1 {
+				candidateTargetIndex = index
+			}
+			if index > lc.LastIndex {
+				candidateTargetIndex = index
+				break
 			}
-			lc.LastIndex = candidateTargetIndex
-			successTarget <- lb.Targets[candidateTargetIndex]
-			return
 		}
-	}()
-
-	select {
-	case <-time.After(lb.TargetWaitTimeout):
-		log.Info().Str("balancer", lb.Id).Str("mode", lb.Mode).Msg("Request is timing out due to no available targets.")
-		return nil
-	case target := <-successTarget:
-		return target
+		lc.LastIndex = candidateTargetIndex
+		return lb.Targets[candidateTargetIndex]
 	}
+	return nil
 }
@@ -0,0 +1,245 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_METRICS_PATH = "/metrics"
+
+	METRICS_NAMESPACE = "loadbalancer"
+)
+
+// Upper bounds of request duration histogram, in seconds
+var requestDurationBuckets []float64 = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	for index, bound := range requestDurationBuckets {
+		if value <= bound {
+			h.counts[index]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Collects request metrics of a service and exposes them in Prometheus text format
+type MetricsRegistry struct {
+	mu                 sync.Mutex
+	requests           map[string]uint64
+	durations          map[string]*histogram
+	noMatchingBalancer map[string]uint64
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		requests:           map[string]uint64{},
+		durations:          map[string]*histogram{},
+		noMatchingBalancer: map[string]uint64{},
+	}
+}
+
+// Formats label pairs as `name="value",...`
+func formatLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf(`%v="%v"`, pairs[i], value))
+	}
+	return strings.Join(labels, ",")
+}
+
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// Records a completed request. Safe to call on nil registry.
+func (mr *MetricsRegistry) ObserveRequest(record *RequestRecord) {
+	if mr == nil {
+		return
+	}
+	labels := formatLabels(
+		"listener", record.Listener,
+		"balancer", record.Balancer,
+		"target", record.Target,
+		"status_class", statusClass(record.Status),
+	)
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.requests[labels]++
+	hist, ok := mr.durations[labels]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(requestDurationBuckets))}
+		mr.durations[labels] = hist
+	}
+	hist.observe(record.Duration.Seconds())
+}
+
+// Records a request rejected because no balancer matched its route. Safe to call on nil registry.
+func (mr *MetricsRegistry) IncNoMatchingBalancer(listener string) {
+	if mr == nil {
+		return
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.noMatchingBalancer[formatLabels("listener", listener)]++
+}
+
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %v_%v %v\n", METRICS_NAMESPACE, name, help)
+	fmt.Fprintf(w, "# TYPE %v_%v %v\n", METRICS_NAMESPACE, name, metricType)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Metrics are rendered while holding the lock and written out after releasing it, so that
+// slow scrape does not block requests recording their metrics
+func (mr *MetricsRegistry) writeTo(w io.Writer) {
+	buf := &bytes.Buffer{}
+	mr.render(buf)
+	w.Write(buf.Bytes())
+}
+
+func (mr *MetricsRegistry) render(w io.Writer) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	writeMetricHeader(w, "requests_total", "counter", "Total number of proxied requests.")
+	for _, labels := range sortedKeys(mr.requests) {
+		fmt.Fprintf(w, "%v_requests_total{%v} %v\n", METRICS_NAMESPACE, labels, mr.requests[labels])
+	}
+
+	writeMetricHeader(w, "request_duration_seconds", "histogram", "Time spent serving proxied requests.")
+	for _, labels := range sortedKeys(mr.durations) {
+		hist := mr.durations[labels]
+		for index, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "%v_request_duration_seconds_bucket{%v,le=\"%v\"} %v\n", METRICS_NAMESPACE, labels, bound, hist.counts[index])
+		}
+		fmt.Fprintf(w, "%v_request_duration_seconds_bucket{%v,le=\"+Inf\"} %v\n", METRICS_NAMESPACE, labels, hist.count)
+		fmt.Fprintf(w, "%v_request_duration_seconds_sum{%v} %v\n", METRICS_NAMESPACE, labels, hist.sum)
+		fmt.Fprintf(w, "%v_request_duration_seconds_count{%v} %v\n", METRICS_NAMESPACE, labels, hist.count)
+	}
+
+	writeMetricHeader(w, "no_matching_balancer_total", "counter", "Requests rejected because no balancer matched the route.")
+	for _, labels := range sortedKeys(mr.noMatchingBalancer) {
+		fmt.Fprintf(w, "%v_no_matching_balancer_total{%v} %v\n", METRICS_NAMESPACE, labels, mr.noMatchingBalancer[labels])
+	}
+}
+
+// Writes gauges and counters read from the running listeners, balancers and targets
+func writeServiceMetrics(w io.Writer, listeners []*Listener) {
+	boolToInt := func(value bool) int {
+		if value {
+			return 1
+		}
+		return 0
+	}
+
+	writeMetricHeader(w, "target_connections", "gauge", "In-flight requests per target.")
+	for _, listener := range listeners {
+		for _, balancer := range listener.GetBalancers() {
+			for _, target := range balancer.GetTargets() {
+				labels := formatLabels("listener", listener.Name(), "balancer", balancer.Id, "target", target.Address)
+				fmt.Fprintf(w, "%v_target_connections{%v} %v\n", METRICS_NAMESPACE, labels, target.ActiveConnections())
+			}
+		}
+	}
+
+	writeMetricHeader(w, "target_up", "gauge", "Whether target is considered alive.")
+	for _, listener := range listeners {
+		for _, balancer := range listener.GetBalancers() {
+			for _, target := range balancer.GetTargets() {
+				labels := formatLabels("listener", listener.Name(), "balancer", balancer.Id, "target", target.Address)
+				fmt.Fprintf(w, "%v_target_up{%v} %v\n", METRICS_NAMESPACE, labels, boolToInt(target.IsAlive()))
+			}
+		}
+	}
+
+	writeMetricHeader(w, "target_draining", "gauge", "Whether target is draining and takes no new requests.")
+	for _, listener := range listeners {
+		for _, balancer := range listener.GetBalancers() {
+			for _, target := range balancer.GetTargets() {
+				labels := formatLabels("listener", listener.Name(), "balancer", balancer.Id, "target", target.Address)
+				fmt.Fprintf(w, "%v_target_draining{%v} %v\n", METRICS_NAMESPACE, labels, boolToInt(target.IsDraining()))
+			}
+		}
+	}
+
+	writeMetricHeader(w, "queue_depth", "gauge", "Requests waiting for a target.")
+	for _, listener := range listeners {
+		for _, balancer := range listener.GetBalancers() {
+			labels := formatLabels("listener", listener.Name(), "balancer", balancer.Id)
+			fmt.Fprintf(w, "%v_queue_depth{%v} %v\n", METRICS_NAMESPACE, labels, balancer.Admission.QueueDepth())
+		}
+	}
+
+	writeMetricHeader(w, "target_wait_timeouts_total", "counter", "Requests which timed out waiting for an available target.")
+	for _, listener := range listeners {
+		for _, balancer := range listener.GetBalancers() {
+			labels := formatLabels("listener", listener.Name(), "balancer", balancer.Id)
+			fmt.Fprintf(w, "%v_target_wait_timeouts_total{%v} %v\n", METRICS_NAMESPACE, labels, balancer.Admission.Stats().TimedOut)
+		}
+	}
+
+	writeMetricHeader(w, "queue_rejections_total", "counter", "Requests rejected because no target was alive or the queue was full.")
+	for _, listener := range listeners {
+		for _, balancer := range listener.GetBalancers() {
+			labels := formatLabels("listener", listener.Name(), "balancer", balancer.Id)
+			fmt.Fprintf(w, "%v_queue_rejections_total{%v} %v\n", METRICS_NAMESPACE, labels, balancer.Admission.Stats().Rejected)
+		}
+	}
+
+	writeMetricHeader(w, "rejected_connections_total", "counter", "Connections closed due to per client IP limit.")
+	for _, listener := range listeners {
+		labels := formatLabels("listener", listener.Name())
+		fmt.Fprintf(w, "%v_rejected_connections_total{%v} %v\n", METRICS_NAMESPACE, labels, listener.RejectedConnections())
+	}
+
+	udpListeners := []*Listener{}
+	for _, listener := range listeners {
+		if listener.Protocol == LS_PROTOCOL_UDP {
+			udpListeners = append(udpListeners, listener)
+		}
+	}
+	if len(udpListeners) == 0 {
+		return
+	}
+	writeMetricHeader(w, "udp_sessions", "gauge", "Client sessions open on udp listener.")
+	for _, listener := range udpListeners {
+		labels := formatLabels("listener", listener.Name())
+		fmt.Fprintf(w, "%v_udp_sessions{%v} %v\n", METRICS_NAMESPACE, labels, len(listener.UDPSessions()))
+	}
+	writeMetricHeader(w, "udp_rejected_datagrams_total", "counter", "Datagrams dropped as no session could be opened for them.")
+	for _, listener := range udpListeners {
+		labels := formatLabels("listener", listener.Name())
+		fmt.Fprintf(w, "%v_udp_rejected_datagrams_total{%v} %v\n", METRICS_NAMESPACE, labels, listener.RejectedDatagrams())
+	}
+}
+
+// Serves metrics of the service in Prometheus text format
+func (lbs *LoadBalancerService) serveMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	lbs.Metrics.writeTo(rw)
+	writeServiceMetrics(rw, lbs.GetListeners())
+}
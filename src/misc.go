@@ -4,7 +4,15 @@ import (
 	"encoding/json"
 )
 
+// Formats data as indented JSON. Secrets of configuration are redacted.
 func PrettyPrint(anyData interface{}) string {
+	if cnf, ok := anyData.(*LoadBalancerYAMLConfiguration); ok {
+		redacted, err := cnf.redacted()
+		if err != nil {
+			return err.Error()
+		}
+		anyData = redacted
+	}
 	b, err := json.MarshalIndent(anyData, "", "  ")
 	if err != nil {
 		return err.Error()
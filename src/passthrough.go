@@ -0,0 +1,193 @@
+package src
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Time client is given to send its TLS client hello
+const CLIENT_HELLO_TIMEOUT = 10 * time.Second
+
+var (
+	errClientHelloRead = errors.New("client hello read")
+	errPeekedConnWrite = errors.New("connection is only read while client hello is peeked")
+	errNoCloseWrite    = errors.New("connection can not be closed for writing")
+)
+
+// Reads TLS client hello of connection without answering it and returns server name client
+// asked for, in lower case, along with connection which replays the bytes read
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	peeked := &bytes.Buffer{}
+	serverName := ""
+	conn.SetReadDeadline(time.Now().Add(CLIENT_HELLO_TIMEOUT))
+	err := tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	replayed := &peekedConn{Conn: conn, reader: io.MultiReader(peeked, conn)}
+	if !errors.Is(err, errClientHelloRead) {
+		return "", replayed, err
+	}
+	return strings.ToLower(serverName), replayed, nil
+}
+
+// Connection handshake reads client hello from. Answers are discarded.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return 0, errPeekedConnWrite
+}
+
+// Connection which returns bytes read while peeking before the rest of the stream
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Closes writing side of connection, so that passthrough routes can pass half close on
+func (c *peekedConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+// Returns available passthrough balancer taking connections for server name. Exact names are
+// preferred over wildcards, and balancer without server names takes what no other one does.
+func (lbs *Listener) serverNameBalancer(serverName string) *Balancer {
+	var wildcard, fallback *Balancer
+	for _, balancer := range lbs.GetBalancers() {
+		if !balancer.Passthrough || !balancer.IsAvailable() {
+			continue
+		}
+		if len(balancer.ServerNames) == 0 && fallback == nil {
+			fallback = balancer
+		}
+		for _, name := range balancer.ServerNames {
+			if name == serverName {
+				return balancer
+			}
+			if wildcard == nil && matchesWildcard(name, serverName) {
+				wildcard = balancer
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return fallback
+}
+
+// Returns true if `name` is `*.domain` and server name is a single label followed by domain
+func matchesWildcard(name string, serverName string) bool {
+	if !strings.HasPrefix(name, "*.") {
+		return false
+	}
+	label := strings.TrimSuffix(serverName, name[1:])
+	return label != serverName && label != "" && !strings.Contains(label, ".")
+}
+
+// Listener of https listener. Connections whose server name a passthrough route takes are
+// piped to its targets, the rest are returned to be terminated by http server.
+type sniListener struct {
+	net.Listener
+	proxy     *tcpProxy
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *tcpProxy) passthroughListener(ln net.Listener) net.Listener {
+	sl := &sniListener{
+		Listener: ln,
+		proxy:    p,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go sl.acceptConns()
+	return sl
+}
+
+func (sl *sniListener) acceptConns() {
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			select {
+			case <-sl.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warn().Err(err).Str("listener", sl.proxy.listener.Name()).Msg("Failed to accept connection")
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		go sl.route(conn)
+	}
+}
+
+// Passes connection to passthrough route taking its server name, or on to http server
+func (sl *sniListener) route(conn net.Conn) {
+	serverName, peeked, err := peekServerName(conn)
+	if err == nil {
+		if balancer := sl.proxy.listener.serverNameBalancer(serverName); balancer != nil {
+			if !sl.proxy.track(conn) {
+				conn.Close()
+				return
+			}
+			defer sl.proxy.untrack(conn)
+			defer conn.Close()
+			sl.proxy.forward(peeked, balancer)
+			return
+		}
+	}
+	// Connections which are not TLS are left to http server to reject
+	select {
+	case sl.conns <- peeked:
+	case <-sl.done:
+		conn.Close()
+	}
+}
+
+func (sl *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sl.conns:
+		return conn, nil
+	case <-sl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (sl *sniListener) Close() error {
+	err := net.ErrClosed
+	sl.closeOnce.Do(func() {
+		close(sl.done)
+		err = sl.Listener.Close()
+	})
+	return err
+}
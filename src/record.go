@@ -0,0 +1,108 @@
+package src
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type requestRecordKey struct{}
+
+// Details of a single proxied request, filled in as it passes through listener,
+// balancer and target
+type RequestRecord struct {
+	Listener  string
+	Balancer  string
+	RequestID string
+	Target    string
+	// Status sent to client
+	Status int
+	// Status returned by target, 0 if target did not respond
+	UpstreamStatus int
+	// Hedged requests sent to other targets in addition to the first one
+	Hedges int
+	// Bytes read from request body, maintained atomically as hedged attempts read the body
+	// on their own goroutines
+	BytesIn  int64
+	BytesOut int64
+	Start    time.Time
+	// Total time spent serving the request
+	Duration time.Duration
+	// Time spent waiting for the target
+	UpstreamDuration time.Duration
+}
+
+func withRequestRecord(req *http.Request, record *RequestRecord) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestRecordKey{}, record))
+}
+
+// Returns record attached to request, or nil if there is none
+func requestRecordFrom(req *http.Request) *RequestRecord {
+	record, _ := req.Context().Value(requestRecordKey{}).(*RequestRecord)
+	return record
+}
+
+// Response writer which keeps track of response status and size
+type responseRecorder struct {
+	http.ResponseWriter
+	Status       int
+	BytesWritten int64
+	// Headers set on response before it is sent, replacing values set by target
+	overrides http.Header
+}
+
+func (rr *responseRecorder) applyOverrides() {
+	for name, values := range rr.overrides {
+		rr.ResponseWriter.Header()[name] = values
+	}
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.Status == 0 {
+		rr.Status = code
+		rr.applyOverrides()
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.Status == 0 {
+		rr.Status = http.StatusOK
+		rr.applyOverrides()
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.BytesWritten += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Returns status sent to client, 200 if handler did not write anything
+func (rr *responseRecorder) StatusCode() int {
+	if rr.Status == 0 {
+		return http.StatusOK
+	}
+	return rr.Status
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Counts bytes read from request body
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	atomic.AddInt64(cr.count, int64(n))
+	return n, err
+}
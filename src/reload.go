@@ -0,0 +1,390 @@
+package src
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoConfigFile = errors.New("service was not started from configuration file")
+
+// Re-reads configuration file and applies it to the running service. Invalid
+// configuration is rejected as a whole and the running one is kept.
+func (lbs *LoadBalancerService) Reload() error {
+	if lbs.Params == nil || lbs.Params.YAMLConfigFilePath == "" {
+		return ErrNoConfigFile
+	}
+	cnf, err := lbs.Params.LoadConfigFile()
+	if configErrors, ok := err.(ConfigErrors); ok {
+		configErrors.Log()
+		log.Error().Msg("Configuration reload rejected, keeping running configuration")
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Configuration reload failed")
+		return err
+	}
+	return lbs.ApplyConfig(cnf)
+}
+
+// Applies differences between running and given configuration in place. Listeners
+// whose own settings changed are restarted on the socket they listen on, every other
+// listener keeps serving. Routes and targets are added, changed and removed without
+// interrupting requests in flight, and unchanged targets keep their connection pools
+// and counters. If a listener can not be started nothing is changed and its error is
+// returned.
+func (lbs *LoadBalancerService) ApplyConfig(cnf *LoadBalancerYAMLConfiguration) error {
+	lbs.reloadMu.Lock()
+	defer lbs.reloadMu.Unlock()
+
+	current := lbs.Config
+	if !reflect.DeepEqual(current.Admin, cnf.Admin) || !reflect.DeepEqual(current.AccessLog, cnf.AccessLog) || !reflect.DeepEqual(current.Tracing, cnf.Tracing) {
+		log.Warn().Msg("Changes to `admin`, `accessLog` and `tracing` sections require restart and were not applied")
+		cnf.Admin, cnf.AccessLog, cnf.Tracing = current.Admin, current.AccessLog, current.Tracing
+	}
+
+	upstreams, replacedUpstreams := lbs.reloadUpstreams(current, cnf)
+
+	runningListeners := map[string]*Listener{}
+	for _, listener := range lbs.GetListeners() {
+		runningListeners[listener.Port] = listener
+	}
+	currentListenerCnfs := map[string]*ListenerYAMLConfig{}
+	for index := range current.Listeners {
+		currentListenerCnfs[current.Listeners[index].Port] = &current.Listeners[index]
+	}
+
+	// Sockets are bound before anything changes, so that configuration is rejected as a whole
+	// if one of them can not be
+	sockets, err := bindListenerSockets(cnf, runningListeners, currentListenerCnfs)
+	if err != nil {
+		log.Error().Err(err).Msg("Configuration reload failed, keeping running configuration")
+		return err
+	}
+
+	listeners := []*Listener{}
+	balancers := map[string]*Balancer{}
+	started := []*Listener{}
+	replaced := []*Listener{}
+	for index := range cnf.Listeners {
+		listenerCnf := &cnf.Listeners[index]
+		running, found := runningListeners[listenerCnf.Port]
+		currentCnf := currentListenerCnfs[listenerCnf.Port]
+
+		var lbListener *Listener
+		switch {
+		case !found || currentCnf == nil:
+			log.Info().Str("port", listenerCnf.Port).Msg("Adding listener")
+			lbListener = lbs.newListener(listenerCnf, upstreams)
+			lbListener.socket = sockets[listenerCnf.Port]
+			started = append(started, lbListener)
+		case !listenerSettingsEqual(currentCnf, listenerCnf):
+			log.Info().Str("port", listenerCnf.Port).Msg("Listener settings changed, restarting listener")
+			lbListener = lbs.newListener(listenerCnf, upstreams)
+			lbListener.socket = sockets[listenerCnf.Port]
+			started = append(started, lbListener)
+			replaced = append(replaced, running)
+		default:
+			lbListener = running
+			lbs.reloadRoutes(lbListener, currentCnf, listenerCnf, upstreams, replacedUpstreams)
+		}
+		delete(runningListeners, listenerCnf.Port)
+
+		listeners = append(listeners, lbListener)
+		for _, balancer := range lbListener.GetBalancers() {
+			balancers[balancer.Id] = balancer
+		}
+	}
+
+	// Replacing listeners take over sockets of replaced ones, which get no more connections once
+	// they do and are then shut down along with removed listeners
+	if err := startListeners(started); err != nil {
+		log.Error().Err(err).Msg("Listener failed to start")
+	}
+
+	lbs.mu.Lock()
+	previousUpstreams := lbs.Upstreams
+	lbs.Listeners = listeners
+	lbs.BalancersIdReference = balancers
+	lbs.Upstreams = upstreams
+	lbs.Config = cnf
+	lbs.mu.Unlock()
+
+	for name, upstream := range previousUpstreams {
+		if upstreams[name] != upstream {
+			upstream.Close()
+		}
+	}
+
+	removed := replaced
+	for _, listener := range runningListeners {
+		log.Info().Str("port", listener.Port).Msg("Removing listener")
+		removed = append(removed, listener)
+	}
+	go shutdownListeners(removed)
+
+	log.Info().Msg("Configuration reloaded")
+	return nil
+}
+
+// Binds sockets of listeners which are added or whose settings changed. Restarted listener
+// takes over socket of the running one, unless it switches between udp and tcp. Sockets bound
+// so far are closed if one can not be bound.
+func bindListenerSockets(cnf *LoadBalancerYAMLConfiguration, running map[string]*Listener, currentCnfs map[string]*ListenerYAMLConfig) (map[string]*listenerSocket, error) {
+	sockets := map[string]*listenerSocket{}
+	bound := []*listenerSocket{}
+	fail := func(port string, err error) (map[string]*listenerSocket, error) {
+		for _, socket := range bound {
+			socket.Close()
+		}
+		return nil, fmt.Errorf("listener on port %v can not be started: %w", port, err)
+	}
+	for index := range cnf.Listeners {
+		listenerCnf := &cnf.Listeners[index]
+		runningListener, found := running[listenerCnf.Port]
+		currentCnf := currentCnfs[listenerCnf.Port]
+		if found && currentCnf != nil && listenerSettingsEqual(currentCnf, listenerCnf) {
+			continue
+		}
+		if found && runningListener.socket != nil && !runningListener.socket.isClosed() && runningListener.socket.serves(listenerCnf.Protocol) {
+			sockets[listenerCnf.Port] = runningListener.socket
+			continue
+		}
+		// Server loads certificate only once it starts serving
+		if listenerCnf.Protocol == LS_PROTOCOL_HTTPS {
+			if _, err := tls.LoadX509KeyPair(listenerCnf.SSLCertificate, listenerCnf.SSLCertificateKey); err != nil {
+				return fail(listenerCnf.Port, err)
+			}
+		}
+		socket, err := listenSocket(listenerCnf.Protocol, ":"+listenerCnf.Port)
+		if err != nil {
+			return fail(listenerCnf.Port, err)
+		}
+		sockets[listenerCnf.Port] = socket
+		bound = append(bound, socket)
+	}
+	return sockets, nil
+}
+
+func shutdownListeners(listeners []*Listener) {
+	serversSync := &sync.WaitGroup{}
+	serversSync.Add(len(listeners))
+	for _, listener := range listeners {
+		go listener.Shutdown(serversSync)
+	}
+	serversSync.Wait()
+}
+
+// Reconciles running upstreams with new configuration. Upstreams whose timeouts or health
+// check changed are replaced, and so are balancers using them; returned set names those.
+func (lbs *LoadBalancerService) reloadUpstreams(current *LoadBalancerYAMLConfiguration, cnf *LoadBalancerYAMLConfiguration) (map[string]*Upstream, map[string]bool) {
+	lbs.mu.RLock()
+	running := lbs.Upstreams
+	lbs.mu.RUnlock()
+
+	upstreams := map[string]*Upstream{}
+	replaced := map[string]bool{}
+	for name := range cnf.Upstreams {
+		upstreamCnf := cnf.Upstreams[name]
+		upstream, found := running[name]
+		currentCnf, configured := current.Upstreams[name]
+		switch {
+		case !found || !configured:
+			log.Info().Str("upstream", name).Msg("Adding upstream")
+			upstream = NewUpstream(name, &upstreamCnf)
+		case !upstreamSettingsEqual(&currentCnf, &upstreamCnf):
+			log.Info().Str("upstream", name).Msg("Upstream settings changed, replacing upstream")
+			upstream = NewUpstream(name, &upstreamCnf)
+			replaced[name] = true
+		default:
+			reloadTargets(upstream, upstream.discoveries(), currentCnf.Targets, upstreamCnf.Targets)
+		}
+		upstreams[name] = upstream
+	}
+	return upstreams, replaced
+}
+
+// Reconciles balancers of running listener with routes of new configuration
+func (lbs *LoadBalancerService) reloadRoutes(listener *Listener, currentCnf *ListenerYAMLConfig, listenerCnf *ListenerYAMLConfig, upstreams map[string]*Upstream, replacedUpstreams map[string]bool) {
+	running := map[string]*Balancer{}
+	for _, balancer := range listener.GetBalancers() {
+		running[balancer.Id] = balancer
+	}
+	currentRoutes := map[string]*RouteYAMLConfig{}
+	for index := range currentCnf.Routes {
+		currentRoutes[currentCnf.Routes[index].Id] = &currentCnf.Routes[index]
+	}
+
+	for index := range listenerCnf.Routes {
+		route := &listenerCnf.Routes[index]
+		balancer, found := running[route.Id]
+		currentRoute := currentRoutes[route.Id]
+		delete(running, route.Id)
+
+		switch {
+		case !found || currentRoute == nil:
+			log.Info().Str("balancer", route.Id).Msg("Adding balancer")
+			balancer = lbs.newBalancer(route, listenerCnf.Protocol)
+			addRouteTargets(balancer, route, upstreams)
+			listener.AddBalancer(balancer)
+		case !routeSettingsEqual(currentRoute, route) || replacedUpstreams[route.Upstream]:
+			log.Info().Str("balancer", route.Id).Msg("Route settings changed, replacing balancer")
+			replacement := lbs.newBalancer(route, listenerCnf.Protocol)
+			// Targets are created with route's timeouts and limits, so they can be kept only if those did not change
+			if route.Upstream != "" || currentRoute.Upstream != "" {
+				addRouteTargets(replacement, route, upstreams)
+			} else if reflect.DeepEqual(currentRoute.Timeouts, route.Timeouts) && currentRoute.MaxTargetConnections == route.MaxTargetConnections {
+				replacement.Targets = balancer.GetTargets()
+				for _, target := range replacement.Targets {
+					target.setOnReachable(replacement.Admission.Wake)
+				}
+				replacement.UpdateState()
+				reloadTargets(replacement, balancer.discoveries(), currentRoute.Targets, route.Targets)
+			} else {
+				addConfiguredTargets(replacement, route.Targets)
+			}
+			listener.AddBalancer(replacement)
+			listener.RemoveBalancer(balancer)
+			go balancer.Close()
+		default:
+			reloadTargets(balancer, balancer.discoveries(), currentRoute.Targets, route.Targets)
+		}
+	}
+
+	for _, balancer := range running {
+		log.Info().Str("balancer", balancer.Id).Msg("Removing balancer")
+		listener.RemoveBalancer(balancer)
+		go balancer.Close()
+	}
+}
+
+// Targets of a balancer, or of an upstream shared by balancers
+type targetSet interface {
+	FindTarget(address string) *Target
+	AddNewServer(targetConfig *TargetYAMLConfig) *Target
+	RemoveTarget(address string) error
+	removeTarget(target *Target) bool
+	replaceTargets(removed []*Target, added []*TargetYAMLConfig)
+	TargetWeight(address string) (int, error)
+	SetTargetWeight(address string, weight int) error
+	DrainTarget(address string, deadline time.Duration) error
+	UndrainTarget(address string) error
+	discoveries() *targetDiscoveries
+}
+
+// Reconciles targets of balancer or upstream with new configuration. Weight and drain state
+// are changed in place; targets whose other settings changed are replaced. Targets added
+// through admin API, and so absent from both configurations, are kept. Discovery continues
+// from `previous`, which holds discoveries of the balancer being replaced if there is one.
+func reloadTargets(balancer targetSet, previous *targetDiscoveries, current []TargetYAMLConfig, targets []TargetYAMLConfig) {
+	balancer.discoveries().reload(balancer, previous, targets)
+
+	currentTargets := map[string]TargetYAMLConfig{}
+	for _, targetCnf := range current {
+		if !targetCnf.IsDiscovered() {
+			currentTargets[targetCnf.Address] = targetCnf
+		}
+	}
+
+	for index := range targets {
+		targetCnf := &targets[index]
+		if targetCnf.IsDiscovered() {
+			continue
+		}
+		currentCnf, configured := currentTargets[targetCnf.Address]
+		delete(currentTargets, targetCnf.Address)
+
+		target := balancer.FindTarget(targetCnf.Address)
+		if target == nil {
+			balancer.AddNewServer(targetCnf)
+			continue
+		}
+		if configured && !targetSettingsEqual(&currentCnf, targetCnf) {
+			balancer.removeTarget(target)
+			balancer.AddNewServer(targetCnf)
+			continue
+		}
+		if !configured || currentCnf.Weight != targetCnf.Weight {
+			weight := targetCnf.Weight
+			if weight <= 0 {
+				weight = DEFAULT_TARGET_WEIGHT
+			}
+			balancer.SetTargetWeight(targetCnf.Address, weight)
+		}
+		if !configured || currentCnf.Draining != targetCnf.Draining {
+			if targetCnf.Draining {
+				balancer.DrainTarget(targetCnf.Address, time.Duration(targetCnf.DrainTimeoutMs)*time.Millisecond)
+			} else {
+				balancer.UndrainTarget(targetCnf.Address)
+			}
+		}
+	}
+
+	for address := range currentTargets {
+		balancer.RemoveTarget(address)
+	}
+}
+
+func listenerSettingsEqual(a *ListenerYAMLConfig, b *ListenerYAMLConfig) bool {
+	left, right := *a, *b
+	left.Routes, right.Routes = nil, nil
+	return reflect.DeepEqual(left, right)
+}
+
+func upstreamSettingsEqual(a *UpstreamYAMLConfig, b *UpstreamYAMLConfig) bool {
+	return reflect.DeepEqual(a.Timeouts, b.Timeouts) && reflect.DeepEqual(a.HealthCheck, b.HealthCheck)
+}
+
+func routeSettingsEqual(a *RouteYAMLConfig, b *RouteYAMLConfig) bool {
+	left, right := *a, *b
+	left.Targets, right.Targets = nil, nil
+	return reflect.DeepEqual(left, right)
+}
+
+// Compares target settings other than weight and drain state
+func targetSettingsEqual(a *TargetYAMLConfig, b *TargetYAMLConfig) bool {
+	left, right := *a, *b
+	left.Weight, right.Weight = 0, 0
+	left.Draining, right.Draining = false, false
+	left.DrainTimeoutMs, right.DrainTimeoutMs = 0, 0
+	return reflect.DeepEqual(left, right)
+}
+
+// Reloads configuration whenever its file changes, checking every `interval`
+func (lbs *LoadBalancerService) WatchConfig(interval time.Duration) {
+	path := lbs.Params.YAMLConfigFilePath
+	lastModified := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0
+		}
+		return info.ModTime(), info.Size()
+	}
+	modTime, size := lastModified()
+
+	lbs.stopWatch = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				newModTime, newSize := lastModified()
+				if newModTime.Equal(modTime) && newSize == size {
+					continue
+				}
+				modTime, size = newModTime, newSize
+				log.Info().Str("file", path).Msg("Configuration file changed, reloading")
+				lbs.Reload()
+			}
+		}
+	}(lbs.stopWatch)
+}
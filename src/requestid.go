@@ -0,0 +1,121 @@
+package src
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Request ID formats
+const (
+	REQUEST_ID_FORMAT_UUID = "uuid"
+	REQUEST_ID_FORMAT_ULID = "ulid"
+
+	DEFAULT_REQUEST_ID_HEADER = "X-Request-ID"
+	DEFAULT_REQUEST_ID_FORMAT = REQUEST_ID_FORMAT_UUID
+
+	crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+var supportedRequestIDFormats []string = []string{
+	REQUEST_ID_FORMAT_UUID,
+	REQUEST_ID_FORMAT_ULID,
+}
+
+func IsValidRequestIDFormat(format string) bool {
+	for _, val := range supportedRequestIDFormats {
+		if val == format {
+			return true
+		}
+	}
+	return false
+}
+
+type RequestIDYAMLConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+	Format  string `yaml:"format"`
+}
+
+// Assigns an identifier to every request which does not carry one already
+type RequestIDGenerator struct {
+	Header string
+	Format string
+}
+
+func NewRequestIDGenerator(cnf *RequestIDYAMLConfig) *RequestIDGenerator {
+	if cnf == nil || !cnf.Enabled {
+		return nil
+	}
+	generator := &RequestIDGenerator{
+		Header: cnf.Header,
+		Format: cnf.Format,
+	}
+	if generator.Header == "" {
+		generator.Header = DEFAULT_REQUEST_ID_HEADER
+	}
+	if generator.Format == "" {
+		generator.Format = DEFAULT_REQUEST_ID_FORMAT
+	}
+	return generator
+}
+
+func (rg *RequestIDGenerator) Generate() string {
+	if rg.Format == REQUEST_ID_FORMAT_ULID {
+		return newULID(time.Now())
+	}
+	return newUUID()
+}
+
+// Returns random (version 4) UUID
+func newUUID() string {
+	var id [16]byte
+	randomBytes(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], id[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], id[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], id[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], id[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], id[10:])
+	return string(buf)
+}
+
+// Returns ULID, 48 bit millisecond timestamp followed by 80 random bits in Crockford's base32
+func newULID(now time.Time) string {
+	var id [16]byte
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(now.UnixMilli()))
+	copy(id[:6], timestamp[2:])
+	randomBytes(id[6:])
+
+	// 128 bits are encoded as 26 characters of 5 bits, first character carries 3 bits
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	buf := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockfordBase32[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+	return string(buf)
+}
+
+// Returns logger attached to request context, or the global logger
+func requestLogger(ctx context.Context) *zerolog.Logger {
+	logger := zerolog.Ctx(ctx)
+	if logger.GetLevel() == zerolog.Disabled {
+		return &log.Logger
+	}
+	return logger
+}
@@ -0,0 +1,121 @@
+package src
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const rotatedFileTimeFormat = "20060102T150405.000000000"
+
+// File writer which rotates file once it grows over `MaxSize` bytes or gets older than
+// `Interval`. Rotated files are renamed with a timestamp suffix and only the newest
+// `MaxBackups` of them are kept.
+type RotatingFile struct {
+	mu         sync.Mutex
+	Path       string
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+}
+
+func NewRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		Interval:   interval,
+		MaxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(writeSize int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.MaxSize > 0 && rf.size+writeSize > rf.MaxSize {
+		return true
+	}
+	return rf.Interval > 0 && time.Since(rf.openedAt) >= rf.Interval
+}
+
+// File is renamed while still open, and is kept for writes if no new file can be opened. If
+// rename fails, original path is reopened, as file may have been moved or removed meanwhile.
+func (rf *RotatingFile) rotate() error {
+	previous := rf.file
+	backupPath := rf.Path + "." + time.Now().Format(rotatedFileTimeFormat)
+	renameErr := os.Rename(rf.Path, backupPath)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	previous.Close()
+	if renameErr != nil {
+		return renameErr
+	}
+	rf.removeOldBackups()
+	return nil
+}
+
+func (rf *RotatingFile) removeOldBackups() {
+	if rf.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(rf.Path + ".*")
+	if err != nil || len(backups) <= rf.MaxBackups {
+		return
+	}
+	// Timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-rf.MaxBackups] {
+		os.Remove(backup)
+	}
+}
+
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	// Data is written even if rotation fails, which is reported instead
+	var rotateErr error
+	if rf.shouldRotate(int64(len(b))) {
+		rotateErr = rf.rotate()
+	}
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
@@ -0,0 +1,105 @@
+package src
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Dialect of published configuration schema
+const CONFIG_SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+// Values allowed for string fields, keyed by `<struct type>.<field key>`
+var configSchemaEnums map[string][]string = map[string][]string{
+	"ListenerYAMLConfig.protocol":             supportedListenerProtocols,
+	"RouteYAMLConfig.mode":                    supportedBalancers,
+	"UpstreamYAMLConfig.mode":                 supportedBalancers,
+	"AccessLogYAMLConfig.format":              supportedAccessLogFormats,
+	"AccessLogYAMLConfig.output":              supportedAccessLogOutputs,
+	"RequestIDYAMLConfig.format":              supportedRequestIDFormats,
+	"AdaptiveConcurrencyYAMLConfig.algorithm": supportedLimiterAlgorithms,
+	"DNSDiscoveryYAMLConfig.type":             supportedDNSRecordTypes,
+}
+
+// Ports are strings in the model, but are usually written as numbers
+var configSchemaPorts map[string]bool = map[string]bool{
+	"ListenerYAMLConfig.port": true,
+	"AdminYAMLConfig.port":    true,
+}
+
+type schemaGenerator struct {
+	defs map[string]any
+}
+
+// Returns JSON Schema describing configuration files, so editors can validate and complete them.
+// It is generated from `LoadBalancerYAMLConfiguration`, hence always matches what is accepted.
+func ConfigSchema() []byte {
+	sg := &schemaGenerator{defs: map[string]any{}}
+	root := sg.structSchema(reflect.TypeOf(LoadBalancerYAMLConfiguration{}))
+	root["$schema"] = CONFIG_SCHEMA_DIALECT
+	root["title"] = "Load balancer configuration"
+	root["properties"].(map[string]any)[INCLUDE_KEY] = map[string]any{
+		"description": "Configuration files, glob patterns or directories merged into this file",
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}
+	root["$defs"] = sg.defs
+	// Maps are marshalled with sorted keys, so output is stable
+	schema, _ := json.MarshalIndent(root, "", "  ")
+	return append(schema, '\n')
+}
+
+func (sg *schemaGenerator) typeSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		name := strings.TrimSuffix(t.Name(), "YAMLConfig")
+		if _, found := sg.defs[name]; !found {
+			// Placeholder guards against recursive types
+			sg.defs[name] = nil
+			sg.defs[name] = sg.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + name}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": sg.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sg.typeSchema(t.Elem())}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{"type": "string"}
+}
+
+func (sg *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := yamlFieldName(field)
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		key := t.Name() + "." + name
+		switch {
+		case configSchemaEnums[key] != nil:
+			properties[name] = map[string]any{"type": "string", "enum": configSchemaEnums[key]}
+		case configSchemaPorts[key]:
+			properties[name] = map[string]any{"type": []string{"string", "integer"}}
+		default:
+			properties[name] = sg.typeSchema(field.Type)
+		}
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
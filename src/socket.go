@@ -0,0 +1,212 @@
+package src
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Listening socket of listener. Listener restarted by configuration reload takes over socket
+// of the listener it replaces, so that port stays open while one is swapped for the other.
+// Socket is closed once the listener owning it last is closed.
+type listenerSocket struct {
+	addr string
+	// Set for listeners accepting connections, which are passed on to `conns` of owner
+	ln    net.Listener
+	conns chan net.Conn
+	// Set for udp listeners, whose datagrams are passed on to `handler` of owner
+	conn    net.PacketConn
+	handler func(data []byte, addr net.Addr)
+	// Listener or udp proxy which takes connections or datagrams and whose closing closes socket
+	owner any
+	// Closed when socket gets another owner
+	ownerChanged chan struct{}
+	mu           sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// Binds socket for listener of given protocol
+func listenSocket(protocol string, addr string) (*listenerSocket, error) {
+	socket := &listenerSocket{
+		addr:         addr,
+		ownerChanged: make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	if protocol == LS_PROTOCOL_UDP {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		socket.conn = conn
+		return socket, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	socket.ln = ln
+	go socket.acceptConns()
+	return socket, nil
+}
+
+// Returns true if listener of `protocol` can take over socket
+func (s *listenerSocket) serves(protocol string) bool {
+	return (s.conn != nil) == (protocol == LS_PROTOCOL_UDP)
+}
+
+func (s *listenerSocket) acceptConns() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.isClosed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warn().Err(err).Str("address", s.addr).Msg("Failed to accept connection")
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		if !s.deliver(conn) {
+			return
+		}
+	}
+}
+
+// Passes connection to owner, or to the one which took socket over while it was waiting.
+// Returns false if socket was closed instead.
+func (s *listenerSocket) deliver(conn net.Conn) bool {
+	for {
+		s.mu.Lock()
+		conns, ownerChanged := s.conns, s.ownerChanged
+		s.mu.Unlock()
+		select {
+		case conns <- conn:
+			return true
+		case <-ownerChanged:
+		case <-s.closed:
+			conn.Close()
+			return false
+		}
+	}
+}
+
+// Makes `owner` the one which takes connections or datagrams of socket
+func (s *listenerSocket) setOwner(owner any) {
+	s.owner = owner
+	close(s.ownerChanged)
+	s.ownerChanged = make(chan struct{})
+}
+
+// Returns listener taking connections of socket, which becomes its owner
+func (s *listenerSocket) listener() net.Listener {
+	sl := &socketListener{
+		socket: s,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.setOwner(sl)
+	s.conns = sl.conns
+	s.mu.Unlock()
+	return sl
+}
+
+// Passes datagrams of udp socket to `handler` of `owner`, which replaces handler of its
+// previous owner
+func (s *listenerSocket) serveDatagrams(owner any, handler func(data []byte, addr net.Addr)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := s.handler != nil
+	s.setOwner(owner)
+	s.handler = handler
+	if !started {
+		go s.readDatagrams()
+	}
+}
+
+func (s *listenerSocket) readDatagrams() {
+	buffer := make([]byte, UDP_MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			if s.isClosed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warn().Err(err).Str("address", s.addr).Msg("Failed to read datagram")
+			continue
+		}
+		s.mu.Lock()
+		handler := s.handler
+		s.mu.Unlock()
+		handler(buffer[:n], addr)
+	}
+}
+
+// Closes socket if `owner` still owns it, otherwise it was taken over by another listener
+func (s *listenerSocket) release(owner any) {
+	s.mu.Lock()
+	owned := s.owner == owner
+	s.mu.Unlock()
+	if owned {
+		s.Close()
+	}
+}
+
+func (s *listenerSocket) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *listenerSocket) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.conn != nil {
+			err = s.conn.Close()
+		} else {
+			err = s.ln.Close()
+		}
+	})
+	return err
+}
+
+// Takes connections of socket for one listener until another listener takes socket over.
+// Closing it closes socket only if no other listener took the socket over.
+type socketListener struct {
+	socket    *listenerSocket
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (sl *socketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sl.conns:
+		return conn, nil
+	case <-sl.done:
+		return nil, net.ErrClosed
+	case <-sl.socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (sl *socketListener) Close() error {
+	err := net.ErrClosed
+	sl.closeOnce.Do(func() {
+		close(sl.done)
+		sl.socket.release(sl)
+		err = nil
+	})
+	return err
+}
+
+func (sl *socketListener) Addr() net.Addr {
+	return sl.socket.ln.Addr()
+}
@@ -1,27 +1,63 @@
 package src
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
 type Target struct {
-	Address     string
-	proxy       *httputil.ReverseProxy
-	Weight      int
+	Address  string
+	proxy    *httputil.ReverseProxy
+	Weight   int
+	Timeouts UpstreamTimeouts
+	// In-flight requests, maintained atomically by the balancer's admission controller
 	Connections int64
-	Alive       bool
+	// Maximum in-flight requests for this target. 0 means unlimited.
+	MaxConnections int64
+	// 1 while target is considered reachable, maintained atomically as health checks run in background
+	alive int32
+	// Holds func called when target is brought back up, so that requests waiting for it are admitted
+	onReachable atomic.Value
+	// Failed requests within the last `TARGET_ERROR_WINDOW_SECONDS`
+	errors recentCounter
+	// Set when target is created and never changed
+	Labels map[string]string
+	// 1 while target takes no new requests, maintained atomically
+	draining    int32
+	drainMu     sync.Mutex
+	drainDone   chan struct{}
+	drainCancel chan struct{}
 }
 
 type TargetYAMLConfig struct {
-	Address string `yaml:"address"`
-	Weight  int    `yaml:"weight"`
+	Address        string `yaml:"address"`
+	Weight         int    `yaml:"weight"`
+	MaxConnections int    `yaml:"maxConnections"`
+	// Overrides route level timeouts
+	Timeouts *TimeoutsYAMLConfig `yaml:"timeouts"`
+	// Target is added in draining state and receives no new requests
+	Draining bool `yaml:"draining"`
+	// Time after which draining target is removed even if requests are still in flight
+	DrainTimeoutMs int `yaml:"drainTimeoutMs"`
+	// Describe target to operators, shown by admin API
+	Labels map[string]string `yaml:"labels"`
+	// Targets are resolved from DNS records instead of `address`, other settings apply to each of them
+	DNS *DNSDiscoveryYAMLConfig `yaml:"dns"`
+	// Targets are read from a file instead of `address`, other settings apply to each of them
+	File *FileDiscoveryYAMLConfig `yaml:"file"`
+	// Targets are healthy instances of service registered with catalog, other settings apply to each of them
+	Consul *ConsulDiscoveryYAMLConfig `yaml:"consul"`
+	// Targets are ready endpoints of Kubernetes service, other settings apply to each of them
+	Kubernetes *KubernetesDiscoveryYAMLConfig `yaml:"kubernetes"`
 }
 
 func NewTarget(targetConfig *TargetYAMLConfig) *Target {
@@ -32,19 +68,29 @@ func NewTarget(targetConfig *TargetYAMLConfig) *Target {
 	}
 	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
 
+	timeouts := NewUpstreamTimeouts(targetConfig.Timeouts)
 	proxy.Transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   TARGET_CONNECTION_TIMEOUT,
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Connect,
 			KeepAlive: TARGET_CONNECTION_KEEPALIVE,
-		}).Dial,
-		TLSHandshakeTimeout: 180 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		IdleConnTimeout:       timeouts.Idle,
 	}
 
 	target := &Target{
-		Address: targetConfig.Address,
-		Weight:  targetConfig.Weight,
-		proxy:   proxy,
+		Address:  targetConfig.Address,
+		Weight:   targetConfig.Weight,
+		Timeouts: timeouts,
+		Labels:   targetConfig.Labels,
+		proxy:    proxy,
+	}
+	proxy.ErrorHandler = target.handleProxyError
+
+	if targetConfig.MaxConnections > 0 {
+		target.MaxConnections = int64(targetConfig.MaxConnections)
 	}
 
 	if targetConfig.Weight > 0 {
@@ -58,36 +104,148 @@ func NewTarget(targetConfig *TargetYAMLConfig) *Target {
 
 func (s *Target) IsAlive() bool {
 	// TODO: Check whether s.Address is reachable
-	return s.Alive
+	return atomic.LoadInt32(&s.alive) == 1
+}
+
+// Returns true if target is alive, not draining and has not reached its in-flight limit
+func (s *Target) IsAvailable() bool {
+	if !s.IsAlive() || s.IsDraining() {
+		return false
+	}
+	return s.MaxConnections == 0 || s.ActiveConnections() < s.MaxConnections
+}
+
+// Returns the number of in-flight requests on target
+func (s *Target) ActiveConnections() int64 {
+	return atomic.LoadInt64(&s.Connections)
+}
+
+// Returns the number of failed requests within the last `TARGET_ERROR_WINDOW_SECONDS`
+func (s *Target) RecentErrors() int64 {
+	return s.errors.Count(time.Now())
 }
+
 func (s *Target) MarkAsReachable() {
-	s.Alive = true
+	if atomic.SwapInt32(&s.alive, 1) == 0 {
+		if onReachable, ok := s.onReachable.Load().(func()); ok {
+			onReachable()
+		}
+	}
+}
+
+// Sets func called when target is brought back up. Balancer taking over target of the one it
+// replaces sets its own.
+func (s *Target) setOnReachable(onReachable func()) {
+	s.onReachable.Store(onReachable)
 }
 func (s *Target) MarkAsUnreachable() {
 	log.Info().Msg("Target marked as unavailable")
-	s.Alive = false
+	atomic.StoreInt32(&s.alive, 0)
+}
+
+// Closes connections to target which carry no request
+func (s *Target) closeIdleConnections() {
+	if transport, ok := s.proxy.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// Outcome of a request served by target
+type serveResult struct {
+	isSuccessful bool
+	// Status returned by target, 0 if target did not respond
+	upstreamStatus int
 }
+
 func (s *Target) Serve(rw http.ResponseWriter, req *http.Request) bool {
+	return s.serve(rw, req).isSuccessful
+}
+
+func (s *Target) serve(rw http.ResponseWriter, req *http.Request) serveResult {
 	crw := &CustomResponseWriter{ResponseWriter: rw}
 
-	s.Connections++
-	s.proxy.ServeHTTP(crw, req)
-	s.Connections--
+	outreq := req
+	if s.Timeouts.Request > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.Timeouts.Request)
+		defer cancel()
+		outreq = req.WithContext(ctx)
+	}
+
+	span := startChildSpan(req.Context(), "upstream", SPAN_KIND_CLIENT)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("lb.target", s.Address)
+	injectTraceContext(outreq.Header, span)
+	s.proxy.ServeHTTP(crw, outreq)
+	span.SetAttribute("http.status_code", crw.Status)
+	if crw.UpstreamError != "" {
+		span.SetStatus(SPAN_STATUS_ERROR, crw.UpstreamError)
+	}
+	span.Finish()
+
+	result := serveResult{}
+	if crw.UpstreamError == "" {
+		result.upstreamStatus = crw.Status
+	}
 
+	// Request was cancelled by client or by the balancer, target is not at fault
+	if req.Context().Err() != nil {
+		result.isSuccessful = crw.Status != http.StatusBadGateway
+		return result
+	}
 	if crw.Status == http.StatusBadGateway || crw.Status == http.StatusServiceUnavailable {
-		log.Info().Str("address", s.Address).Int("status", crw.Status).Msg("Target is unreachable.\n")
+		requestLogger(req.Context()).Info().Str("address", s.Address).Int("status", crw.Status).Msg("Target is unreachable.\n")
+		s.errors.Add(time.Now())
 		s.MarkAsUnreachable()
-		return false
+		return result
 	}
-	return true
+	if crw.Status == http.StatusGatewayTimeout {
+		s.errors.Add(time.Now())
+		return result
+	}
+	result.isSuccessful = true
+	return result
 }
 
 type CustomResponseWriter struct {
 	http.ResponseWriter
 	Status int
+	// Kind of error if target failed to respond, one of `UPSTREAM_ERROR_*`
+	UpstreamError string
 }
 
 func (scrw *CustomResponseWriter) WriteHeader(code int) {
 	scrw.Status = code
 	scrw.ResponseWriter.WriteHeader(code)
 }
+
+// Counts events over a sliding window of `TARGET_ERROR_WINDOW_SECONDS`, in one second buckets
+type recentCounter struct {
+	mu      sync.Mutex
+	buckets [TARGET_ERROR_WINDOW_SECONDS]int64
+	seconds [TARGET_ERROR_WINDOW_SECONDS]int64
+}
+
+func (rc *recentCounter) Add(now time.Time) {
+	second := now.Unix()
+	index := second % TARGET_ERROR_WINDOW_SECONDS
+	rc.mu.Lock()
+	if rc.seconds[index] != second {
+		rc.seconds[index] = second
+		rc.buckets[index] = 0
+	}
+	rc.buckets[index]++
+	rc.mu.Unlock()
+}
+
+func (rc *recentCounter) Count(now time.Time) int64 {
+	oldest := now.Unix() - TARGET_ERROR_WINDOW_SECONDS
+	var count int64
+	rc.mu.Lock()
+	for index, second := range rc.seconds {
+		if second > oldest {
+			count += rc.buckets[index]
+		}
+	}
+	rc.mu.Unlock()
+	return count
+}
@@ -0,0 +1,311 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Scheme of target addresses of tcp listeners
+	TCP_TARGET_SCHEME = "tcp"
+	// Time connection may carry no bytes in either direction before it is closed
+	DEFAULT_TCP_IDLE_TIMEOUT = 10 * time.Minute
+	// Time open connections are given to finish once listener stops
+	DEFAULT_TCP_SHUTDOWN_TIMEOUT = 30 * time.Second
+	TCP_COPY_BUFFER_SIZE         = 32 * 1024
+)
+
+// Accepts connections of tcp listener and pipes each to a target chosen by listener's balancer
+type tcpProxy struct {
+	listener        *Listener
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	ln              net.Listener
+	conns           map[net.Conn]struct{}
+	closing         bool
+	mu              sync.Mutex
+	active          sync.WaitGroup
+	// Cancelled on shutdown, so that connections waiting for a target give up
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newTCPProxy(listener *Listener, listenerCnf *ListenerYAMLConfig) *tcpProxy {
+	proxy := &tcpProxy{
+		listener:        listener,
+		IdleTimeout:     time.Duration(listenerCnf.IdleTimeoutMs) * time.Millisecond,
+		ShutdownTimeout: time.Duration(listenerCnf.ShutdownTimeoutMs) * time.Millisecond,
+		conns:           map[net.Conn]struct{}{},
+	}
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
+	if proxy.IdleTimeout <= 0 {
+		proxy.IdleTimeout = DEFAULT_TCP_IDLE_TIMEOUT
+	}
+	if proxy.ShutdownTimeout <= 0 {
+		proxy.ShutdownTimeout = DEFAULT_TCP_SHUTDOWN_TIMEOUT
+	}
+	return proxy
+}
+
+// Serves connections of listener's socket until shutdown, which is reported as
+// `http.ErrServerClosed` like http listeners do. Listener is active as soon as it listens.
+func (p *tcpProxy) listenAndServe(startersSync *sync.WaitGroup) error {
+	ln := p.listener.listen()
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		ln.Close()
+		startersSync.Done()
+		return http.ErrServerClosed
+	}
+	p.ln = ln
+	p.mu.Unlock()
+
+	p.listener.setState(LISTENER_STATE_ACTIVE)
+	log.Info().Str("port", p.listener.Port).Str("protocol", p.listener.Protocol).Msg("Listener is active")
+	startersSync.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.isClosing() {
+				return http.ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Warn().Err(err).Str("listener", p.listener.Name()).Msg("Failed to accept connection")
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		if !p.track(conn) {
+			conn.Close()
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *tcpProxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// Registers open connection, returns false if proxy is shutting down
+func (p *tcpProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	p.active.Add(1)
+	return true
+}
+
+func (p *tcpProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	p.active.Done()
+}
+
+func (p *tcpProxy) handle(client net.Conn) {
+	defer p.untrack(client)
+	defer client.Close()
+
+	var balancer *Balancer
+	if p.listener.Protocol == LS_PROTOCOL_TLS {
+		serverName, peeked, err := peekServerName(client)
+		if err != nil {
+			log.Info().Err(err).Str("client", client.RemoteAddr().String()).Msg("Connection rejected. TLS client hello could not be read.")
+			return
+		}
+		client = peeked
+		balancer = p.listener.serverNameBalancer(serverName)
+	} else {
+		balancer = p.listener.routeBalancer()
+	}
+	if balancer == nil {
+		log.Info().Str("client", client.RemoteAddr().String()).Msg("Connection rejected. No available balancer found.")
+		p.listener.Metrics.IncNoMatchingBalancer(p.listener.Name())
+		return
+	}
+	p.forward(client, balancer)
+}
+
+func (p *tcpProxy) forward(client net.Conn, balancer *Balancer) {
+	if err := balancer.serveConn(p.ctx, client, p.IdleTimeout); err != nil {
+		log.Info().Err(err).Str("balancer", balancer.Id).Str("client", client.RemoteAddr().String()).Msg("Connection rejected")
+	}
+}
+
+// Stops accepting connections and waits for open ones to finish. Connections still open
+// once `ShutdownTimeout` passes are closed.
+func (p *tcpProxy) shutdown() {
+	p.mu.Lock()
+	p.closing = true
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	p.mu.Unlock()
+	p.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(p.ShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	p.mu.Lock()
+	log.Warn().Str("listener", p.listener.Name()).Int("connections", len(p.conns)).Msg("Shutdown deadline passed, closing connections")
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	<-done
+}
+
+// Returns balancer traffic of tcp and udp listeners is passed to, nil if none is available
+func (lbs *Listener) routeBalancer() *Balancer {
+	for _, balancer := range lbs.GetBalancers() {
+		if balancer.IsAvailable() {
+			return balancer
+		}
+	}
+	return nil
+}
+
+// Pipes client connection to a target until either side closes it or it idles for
+// `idleTimeout`. Targets which can not be reached are marked unreachable and the next one
+// is tried, as nothing was sent to them yet.
+func (lb *Balancer) serveConn(ctx context.Context, client net.Conn, idleTimeout time.Duration) error {
+	lb.liveConnections.Add(1)
+	defer lb.liveConnections.Done()
+
+	for attempts := len(lb.GetTargets()); ; attempts-- {
+		target, err := lb.Admission.Acquire(ctx, lb)
+		if err != nil {
+			return err
+		}
+		upstream, err := target.dialTCP(ctx)
+		if err != nil {
+			log.Info().Err(err).Str("balancer", lb.Id).Str("address", target.Address).Msg("Target unreachable")
+			target.errors.Add(time.Now())
+			target.MarkAsUnreachable()
+			lb.Admission.Release(target)
+			if attempts <= 1 {
+				return ErrNoTargetsAvailable
+			}
+			continue
+		}
+
+		log.Debug().Str("balancer", lb.Id).Str("client", client.RemoteAddr().String()).Str("to", target.Address).Msg("- Forwarding connection")
+		sent, received := pipeConns(client, upstream, idleTimeout)
+		upstream.Close()
+		lb.Admission.Release(target)
+		log.Debug().Str("balancer", lb.Id).Str("to", target.Address).Int64("bytesIn", sent).Int64("bytesOut", received).Msg("- Connection closed")
+		return nil
+	}
+}
+
+// Opens connection to target of tcp listener
+func (s *Target) dialTCP(ctx context.Context) (net.Conn, error) {
+	address, err := url.Parse(s.Address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: s.Timeouts.Connect, KeepAlive: TARGET_CONNECTION_KEEPALIVE}
+	return dialer.DialContext(ctx, "tcp", address.Host)
+}
+
+// Time of the last byte carried by connection in either direction
+type connActivity struct {
+	last int64
+}
+
+func (ca *connActivity) touch() {
+	atomic.StoreInt64(&ca.last, time.Now().UnixNano())
+}
+
+func (ca *connActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&ca.last)))
+}
+
+// Copies bytes both ways until both sides are done, returning number of bytes sent by each.
+// Side which finishes sending has the other connection closed for writing, so half closed
+// connections keep working; any error closes both.
+func pipeConns(client net.Conn, upstream net.Conn, idleTimeout time.Duration) (sent int64, received int64) {
+	activity := &connActivity{}
+	activity.touch()
+	results := make(chan error, 2)
+	go func() {
+		var err error
+		sent, err = copyIdle(upstream, client, activity, idleTimeout)
+		results <- err
+	}()
+	go func() {
+		var err error
+		received, err = copyIdle(client, upstream, activity, idleTimeout)
+		results <- err
+	}()
+
+	for finished := 0; finished < 2; finished++ {
+		if err := <-results; err != nil {
+			client.Close()
+			upstream.Close()
+		}
+	}
+	return sent, received
+}
+
+// Copies from `src` to `dst` until `src` is done. Read timeout is extended as long as
+// connection is active in either direction.
+func copyIdle(dst net.Conn, src net.Conn, activity *connActivity, idleTimeout time.Duration) (int64, error) {
+	buffer := make([]byte, TCP_COPY_BUFFER_SIZE)
+	var copied int64
+	for {
+		src.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, err := src.Read(buffer)
+		if n > 0 {
+			activity.touch()
+			dst.SetWriteDeadline(time.Now().Add(idleTimeout))
+			written, writeErr := dst.Write(buffer[:n])
+			copied += int64(written)
+			if writeErr != nil {
+				return copied, writeErr
+			}
+		}
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && activity.idle() < idleTimeout {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+				closer.CloseWrite()
+				return copied, nil
+			}
+		}
+		return copied, err
+	}
+}
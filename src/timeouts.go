@@ -0,0 +1,134 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kinds of upstream errors, sent to client in `UPSTREAM_ERROR_HEADER`
+const (
+	UPSTREAM_ERROR_HEADER = "X-Loadbalancer-Error"
+
+	UPSTREAM_ERROR_CONNECT_TIMEOUT         = "connect-timeout"
+	UPSTREAM_ERROR_TLS_HANDSHAKE_TIMEOUT   = "tls-handshake-timeout"
+	UPSTREAM_ERROR_RESPONSE_HEADER_TIMEOUT = "response-header-timeout"
+	UPSTREAM_ERROR_REQUEST_TIMEOUT         = "request-timeout"
+	UPSTREAM_ERROR_UNREACHABLE             = "unreachable"
+	UPSTREAM_ERROR_REQUEST_BODY_TOO_LARGE  = "request-body-too-large"
+)
+
+// Upstream timeouts in milliseconds. Unset fields fall back to route and then to defaults.
+type TimeoutsYAMLConfig struct {
+	ConnectMs        int `yaml:"connectMs"`
+	TLSHandshakeMs   int `yaml:"tlsHandshakeMs"`
+	ResponseHeaderMs int `yaml:"responseHeaderMs"`
+	IdleMs           int `yaml:"idleMs"`
+	RequestMs        int `yaml:"requestMs"`
+}
+
+// Returns timeouts of `tc`, with unset values taken from `fallback`
+func (tc *TimeoutsYAMLConfig) Merge(fallback *TimeoutsYAMLConfig) *TimeoutsYAMLConfig {
+	merged := &TimeoutsYAMLConfig{}
+	if fallback != nil {
+		*merged = *fallback
+	}
+	if tc == nil {
+		return merged
+	}
+	if tc.ConnectMs > 0 {
+		merged.ConnectMs = tc.ConnectMs
+	}
+	if tc.TLSHandshakeMs > 0 {
+		merged.TLSHandshakeMs = tc.TLSHandshakeMs
+	}
+	if tc.ResponseHeaderMs > 0 {
+		merged.ResponseHeaderMs = tc.ResponseHeaderMs
+	}
+	if tc.IdleMs > 0 {
+		merged.IdleMs = tc.IdleMs
+	}
+	if tc.RequestMs > 0 {
+		merged.RequestMs = tc.RequestMs
+	}
+	return merged
+}
+
+// Resolved upstream timeouts of a target. Zero means no timeout.
+type UpstreamTimeouts struct {
+	Connect        time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	Idle           time.Duration
+	Request        time.Duration
+}
+
+func NewUpstreamTimeouts(cnf *TimeoutsYAMLConfig) UpstreamTimeouts {
+	timeouts := UpstreamTimeouts{
+		Connect:      TARGET_CONNECTION_TIMEOUT,
+		TLSHandshake: TARGET_TLS_HANDSHAKE_TIMEOUT,
+	}
+	if cnf == nil {
+		return timeouts
+	}
+	if cnf.ConnectMs > 0 {
+		timeouts.Connect = time.Duration(cnf.ConnectMs) * time.Millisecond
+	}
+	if cnf.TLSHandshakeMs > 0 {
+		timeouts.TLSHandshake = time.Duration(cnf.TLSHandshakeMs) * time.Millisecond
+	}
+	timeouts.ResponseHeader = time.Duration(cnf.ResponseHeaderMs) * time.Millisecond
+	timeouts.Idle = time.Duration(cnf.IdleMs) * time.Millisecond
+	timeouts.Request = time.Duration(cnf.RequestMs) * time.Millisecond
+	return timeouts
+}
+
+// Returns kind of upstream error, one of `UPSTREAM_ERROR_*`. Specific timeouts are checked
+// first, since they also match `context.DeadlineExceeded`.
+func classifyUpstreamError(err error) string {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return UPSTREAM_ERROR_REQUEST_BODY_TOO_LARGE
+	}
+	if strings.Contains(err.Error(), "TLS handshake timeout") {
+		return UPSTREAM_ERROR_TLS_HANDSHAKE_TIMEOUT
+	}
+	if strings.Contains(err.Error(), "timeout awaiting response headers") {
+		return UPSTREAM_ERROR_RESPONSE_HEADER_TIMEOUT
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return UPSTREAM_ERROR_CONNECT_TIMEOUT
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return UPSTREAM_ERROR_REQUEST_TIMEOUT
+	}
+	return UPSTREAM_ERROR_UNREACHABLE
+}
+
+// Error handler of target's reverse proxy. Timeouts are answered with 504 Gateway Timeout,
+// oversized request bodies with 413 and every other failure with 502 Bad Gateway.
+func (s *Target) handleProxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	kind := classifyUpstreamError(err)
+	if req.Context().Err() == context.DeadlineExceeded {
+		kind = UPSTREAM_ERROR_REQUEST_TIMEOUT
+	}
+	requestLogger(req.Context()).Info().Str("address", s.Address).Str("error", kind).Err(err).Msg("Upstream request failed")
+
+	if crw, ok := rw.(*CustomResponseWriter); ok {
+		crw.UpstreamError = kind
+	}
+	rw.Header().Set(UPSTREAM_ERROR_HEADER, kind)
+	switch kind {
+	case UPSTREAM_ERROR_UNREACHABLE:
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	case UPSTREAM_ERROR_REQUEST_BODY_TOO_LARGE:
+		http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(rw, "Gateway Timeout: "+strings.ReplaceAll(kind, "-", " "), http.StatusGatewayTimeout)
+}
@@ -0,0 +1,455 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+
+	DEFAULT_TRACING_SERVICE_NAME       = "loadbalancer"
+	DEFAULT_TRACING_EXPORT_INTERVAL    = 5 * time.Second
+	DEFAULT_TRACING_MAX_EXPORT_BATCH   = 512
+	DEFAULT_TRACING_MAX_QUEUED_SPANS   = 2048
+	TRACING_INSTRUMENTATION_SCOPE_NAME = "github.com/vinay03/loadbalancer"
+)
+
+// Span kinds and status codes as defined by OTLP
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+
+	SPAN_STATUS_UNSET = 0
+	SPAN_STATUS_OK    = 1
+	SPAN_STATUS_ERROR = 2
+)
+
+type TracingYAMLConfig struct {
+	// OTLP/HTTP traces endpoint of the collector, e.g. http://localhost:4318/v1/traces
+	Endpoint         string `yaml:"endpoint"`
+	ServiceName      string `yaml:"serviceName"`
+	ExportIntervalMs int    `yaml:"exportIntervalMs"`
+	// Fraction of new traces to sample, between 0 and 1. Routes may override it.
+	SampleRatio *float64 `yaml:"sampleRatio"`
+}
+
+type spanKey struct{}
+
+// W3C trace context of a span
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Parses `traceparent` header. Returns false if header is missing or malformed. Fields are
+// lowercase hex, and only versions after `00` may be followed by more fields.
+func parseTraceparent(value string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	for _, part := range parts[:4] {
+		if !isLowerHex(part) {
+			return sc, false
+		}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || sc.TraceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&0x01 == 1
+	return sc, true
+}
+
+func isLowerHex(value string) bool {
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type Span struct {
+	mu           sync.Mutex
+	tracer       *Tracer
+	Context      SpanContext
+	ParentSpanID [8]byte
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	StatusCode   int
+	StatusMsg    string
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.Attributes[key] = value
+}
+
+func (span *Span) SetStatus(code int, message string) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.StatusCode = code
+	span.StatusMsg = message
+}
+
+// Ends span and queues it for export if sampled. Safe to call on nil span.
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	span.End = time.Now()
+	span.mu.Unlock()
+	if span.Context.Sampled {
+		span.tracer.enqueue(span)
+	}
+}
+
+func withSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Returns span attached to context, or nil if request is not traced
+func spanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Starts a child span of the span in `ctx`. Returns nil if request is not traced.
+func startChildSpan(ctx context.Context, name string, kind int) *Span {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return nil
+	}
+	span := parent.tracer.newSpan(name, kind)
+	span.Context.TraceID = parent.Context.TraceID
+	span.Context.Sampled = parent.Context.Sampled
+	span.Context.TraceState = parent.Context.TraceState
+	span.ParentSpanID = parent.Context.SpanID
+	return span
+}
+
+// Sets W3C trace context headers of outgoing request to continue from `span`
+func injectTraceContext(header http.Header, span *Span) {
+	if span == nil {
+		return
+	}
+	header.Set(TRACEPARENT_HEADER, span.Context.traceparent())
+	if span.Context.TraceState != "" {
+		header.Set(TRACESTATE_HEADER, span.Context.TraceState)
+	} else {
+		header.Del(TRACESTATE_HEADER)
+	}
+}
+
+// Creates spans and exports sampled ones in batches to an OTLP/HTTP collector
+type Tracer struct {
+	Endpoint       string
+	ServiceName    string
+	SampleRatio    float64
+	ExportInterval time.Duration
+	client         *http.Client
+	mu             sync.Mutex
+	queue          []*Span
+	flush          chan struct{}
+	done           chan struct{}
+	stopped        chan struct{}
+	shutdownOnce   sync.Once
+}
+
+func NewTracer(cnf *TracingYAMLConfig) *Tracer {
+	tracer := &Tracer{
+		Endpoint:       cnf.Endpoint,
+		ServiceName:    cnf.ServiceName,
+		SampleRatio:    1,
+		ExportInterval: DEFAULT_TRACING_EXPORT_INTERVAL,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		flush:          make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	if tracer.ServiceName == "" {
+		tracer.ServiceName = DEFAULT_TRACING_SERVICE_NAME
+	}
+	if cnf.SampleRatio != nil {
+		tracer.SampleRatio = *cnf.SampleRatio
+	}
+	if cnf.ExportIntervalMs > 0 {
+		tracer.ExportInterval = time.Duration(cnf.ExportIntervalMs) * time.Millisecond
+	}
+	go tracer.exportLoop()
+	return tracer
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		log.Error().Err(err).Msg("Failed to generate random identifier")
+	}
+}
+
+func (t *Tracer) newSpan(name string, kind int) *Span {
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+	randomBytes(span.Context.SpanID[:])
+	return span
+}
+
+// Returns true if new trace with given id falls within `ratio`
+func sampleTrace(traceID [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	// Same approach as OpenTelemetry's TraceIdRatioBased sampler
+	bound := uint64(ratio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:16])>>1 < bound
+}
+
+// Starts server span for incoming request, continuing trace from its `traceparent`
+// header if present. New traces are sampled with `sampleRatio`. Safe to call on nil tracer.
+func (t *Tracer) StartServerSpan(req *http.Request, name string, sampleRatio float64) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, SPAN_KIND_SERVER)
+	if parent, ok := parseTraceparent(req.Header.Get(TRACEPARENT_HEADER)); ok {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Context.TraceState = req.Header.Get(TRACESTATE_HEADER)
+		span.ParentSpanID = parent.SpanID
+	} else {
+		randomBytes(span.Context.TraceID[:])
+		span.Context.Sampled = sampleTrace(span.Context.TraceID, sampleRatio)
+	}
+	return span
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= DEFAULT_TRACING_MAX_QUEUED_SPANS {
+		log.Debug().Msg("Dropping span, export queue is full")
+		return
+	}
+	t.queue = append(t.queue, span)
+	if len(t.queue) >= DEFAULT_TRACING_MAX_EXPORT_BATCH {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	ticker := time.NewTicker(t.ExportInterval)
+	defer ticker.Stop()
+	defer close(t.stopped)
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case <-t.flush:
+			t.export()
+		case <-t.done:
+			t.export()
+			return
+		}
+	}
+}
+
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.mu.Unlock()
+
+	for len(spans) > 0 {
+		batchSize := len(spans)
+		if batchSize > DEFAULT_TRACING_MAX_EXPORT_BATCH {
+			batchSize = DEFAULT_TRACING_MAX_EXPORT_BATCH
+		}
+		if err := t.send(spans[:batchSize]); err != nil {
+			log.Error().Err(err).Str("endpoint", t.Endpoint).Msg("Failed to export spans")
+		}
+		spans = spans[batchSize:]
+	}
+}
+
+func (t *Tracer) send(spans []*Span) error {
+	payload, err := json.Marshal(t.otlpPayload(spans))
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status %v", res.StatusCode)
+	}
+	return nil
+}
+
+// Stops exporter after sending queued spans. Further calls only wait for it to stop.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.shutdownOnce.Do(func() {
+		close(t.done)
+	})
+	<-t.stopped
+}
+
+/****** OTLP/HTTP JSON encoding ******/
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type OTLPTracesPayload struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int:
+		intValue := strconv.Itoa(v)
+		kv.Value.IntValue = &intValue
+	case int64:
+		intValue := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &intValue
+	case float64:
+		kv.Value.DoubleValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		stringValue := fmt.Sprint(v)
+		kv.Value.StringValue = &stringValue
+	}
+	return kv
+}
+
+func (t *Tracer) otlpPayload(spans []*Span) OTLPTracesPayload {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = TRACING_INSTRUMENTATION_SCOPE_NAME
+	for _, span := range spans {
+		span.mu.Lock()
+		encoded := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			TraceState:        span.Context.TraceState,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: span.StatusCode, Message: span.StatusMsg},
+		}
+		if span.ParentSpanID != [8]byte{} {
+			encoded.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		for _, key := range sortedKeys(span.Attributes) {
+			encoded.Attributes = append(encoded.Attributes, otlpAttribute(key, span.Attributes[key]))
+		}
+		span.mu.Unlock()
+		scopeSpans.Spans = append(scopeSpans.Spans, encoded)
+	}
+
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{otlpAttribute("service.name", t.ServiceName)}
+	return OTLPTracesPayload{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+}
@@ -0,0 +1,353 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Scheme of target addresses of udp listeners
+	UDP_TARGET_SCHEME = "udp"
+	// Time session may carry no datagram in either direction before it expires
+	DEFAULT_UDP_SESSION_TIMEOUT = 30 * time.Second
+	// Sessions beyond this count are refused, so that memory held by sessions stays bounded
+	DEFAULT_UDP_MAX_SESSIONS = 10000
+	UDP_MAX_DATAGRAM_SIZE    = 65535
+)
+
+// Datagrams of one client address relayed to the target chosen for it
+type udpSession struct {
+	client   *net.UDPAddr
+	target   *Target
+	balancer *Balancer
+	upstream net.Conn
+	started  time.Time
+	activity connActivity
+	// Datagrams and bytes received from client and from target
+	packetsIn  int64
+	packetsOut int64
+	bytesIn    int64
+	bytesOut   int64
+	closeOnce  sync.Once
+}
+
+// Relays datagrams of udp listener. Each client address gets a session holding its own
+// socket towards the chosen target, so that responses find their way back.
+type udpProxy struct {
+	listener     *Listener
+	IdleTimeout  time.Duration
+	MaxSessions  int
+	HashClientIP bool
+	conn         net.PacketConn
+	sessions     map[string]*udpSession
+	closing      bool
+	// Closed on shutdown
+	done chan struct{}
+	mu   sync.Mutex
+	// Goroutines relaying responses of open sessions
+	relays sync.WaitGroup
+	// Datagrams dropped as no session could be opened for them
+	rejected int64
+}
+
+func newUDPProxy(listener *Listener, listenerCnf *ListenerYAMLConfig) *udpProxy {
+	proxy := &udpProxy{
+		listener:     listener,
+		IdleTimeout:  time.Duration(listenerCnf.IdleTimeoutMs) * time.Millisecond,
+		MaxSessions:  listenerCnf.MaxSessions,
+		HashClientIP: listenerCnf.HashClientIP,
+		sessions:     map[string]*udpSession{},
+		done:         make(chan struct{}),
+	}
+	if proxy.IdleTimeout <= 0 {
+		proxy.IdleTimeout = DEFAULT_UDP_SESSION_TIMEOUT
+	}
+	if proxy.MaxSessions <= 0 {
+		proxy.MaxSessions = DEFAULT_UDP_MAX_SESSIONS
+	}
+	return proxy
+}
+
+// Relays datagrams of listener's socket until shutdown, which is reported as
+// `http.ErrServerClosed` like http listeners do
+func (p *udpProxy) listenAndServe(startersSync *sync.WaitGroup) error {
+	socket := p.listener.socket
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		socket.release(nil)
+		startersSync.Done()
+		return http.ErrServerClosed
+	}
+	p.conn = socket.conn
+	socket.serveDatagrams(p, p.relay)
+	p.mu.Unlock()
+
+	p.listener.setState(LISTENER_STATE_ACTIVE)
+	log.Info().Str("port", p.listener.Port).Str("protocol", p.listener.Protocol).Msg("Listener is active")
+	startersSync.Done()
+
+	<-p.done
+	return http.ErrServerClosed
+}
+
+// Relays datagram received from client to target of its session
+func (p *udpProxy) relay(data []byte, addr net.Addr) {
+	client, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	session := p.session(client)
+	if session == nil {
+		atomic.AddInt64(&p.rejected, 1)
+		return
+	}
+	session.activity.touch()
+	atomic.AddInt64(&session.packetsIn, 1)
+	atomic.AddInt64(&session.bytesIn, int64(len(data)))
+	if _, err := session.upstream.Write(data); err != nil {
+		log.Debug().Err(err).Str("client", client.String()).Str("to", session.target.Address).Msg("Failed to relay datagram")
+	}
+}
+
+func (p *udpProxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// Returns session of client, opening one if it has none. Returns nil if session limit is
+// reached or no target is available.
+func (p *udpProxy) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+	p.mu.Lock()
+	session, found := p.sessions[key]
+	sessions := len(p.sessions)
+	p.mu.Unlock()
+	if found {
+		return session
+	}
+	if sessions >= p.MaxSessions {
+		log.Debug().Str("client", key).Int("limit", p.MaxSessions).Msg("Datagram dropped. Session limit reached.")
+		return nil
+	}
+
+	balancer := p.listener.routeBalancer()
+	if balancer == nil {
+		log.Debug().Str("client", key).Msg("Datagram dropped. No available balancer found.")
+		p.listener.Metrics.IncNoMatchingBalancer(p.listener.Name())
+		return nil
+	}
+	var target *Target
+	if p.HashClientIP {
+		target = balancer.acquireHashed(client.IP.String())
+	} else {
+		target = balancer.Admission.TryAcquire(balancer, nil)
+	}
+	if target == nil {
+		log.Debug().Str("client", key).Str("balancer", balancer.Id).Msg("Datagram dropped. No target available.")
+		return nil
+	}
+	upstream, err := target.dialUDP()
+	if err != nil {
+		log.Info().Err(err).Str("balancer", balancer.Id).Str("address", target.Address).Msg("Target unreachable")
+		target.errors.Add(time.Now())
+		balancer.Admission.Release(target)
+		return nil
+	}
+
+	session = &udpSession{
+		client:   client,
+		target:   target,
+		balancer: balancer,
+		upstream: upstream,
+		started:  time.Now(),
+	}
+	session.activity.touch()
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		p.closeSession(session)
+		return nil
+	}
+	p.sessions[key] = session
+	p.relays.Add(1)
+	p.mu.Unlock()
+	log.Debug().Str("balancer", balancer.Id).Str("client", key).Str("to", target.Address).Msg("- Session opened")
+	go p.relayResponses(session)
+	return session
+}
+
+// Relays datagrams target sends back to client, until session idles for `IdleTimeout`
+func (p *udpProxy) relayResponses(session *udpSession) {
+	defer p.relays.Done()
+	defer p.expire(session)
+	buffer := make([]byte, UDP_MAX_DATAGRAM_SIZE)
+	for {
+		session.upstream.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+		n, err := session.upstream.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && session.activity.idle() < p.IdleTimeout {
+				continue
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// Nothing listens on target port, client gets a new session with its next datagram
+				log.Info().Err(err).Str("address", session.target.Address).Msg("Target refused datagrams")
+				session.target.errors.Add(time.Now())
+				session.target.MarkAsUnreachable()
+			}
+			return
+		}
+		session.activity.touch()
+		atomic.AddInt64(&session.packetsOut, 1)
+		atomic.AddInt64(&session.bytesOut, int64(n))
+		if _, err := p.conn.WriteTo(buffer[:n], session.client); err != nil && p.isClosing() {
+			return
+		}
+	}
+}
+
+// Removes session and releases its target
+func (p *udpProxy) expire(session *udpSession) {
+	key := session.client.String()
+	p.mu.Lock()
+	if p.sessions[key] == session {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	p.closeSession(session)
+	log.Debug().Str("client", key).Str("to", session.target.Address).
+		Int64("packetsIn", atomic.LoadInt64(&session.packetsIn)).Int64("packetsOut", atomic.LoadInt64(&session.packetsOut)).
+		Msg("- Session closed")
+}
+
+func (p *udpProxy) closeSession(session *udpSession) {
+	session.closeOnce.Do(func() {
+		session.upstream.Close()
+		session.balancer.Admission.Release(session.target)
+	})
+}
+
+// Stops receiving datagrams and closes every session, returning once their relays finished
+func (p *udpProxy) shutdown() {
+	p.mu.Lock()
+	if !p.closing {
+		close(p.done)
+	}
+	p.closing = true
+	if p.conn != nil {
+		p.listener.socket.release(p)
+	}
+	sessions := p.sessions
+	p.sessions = map[string]*udpSession{}
+	p.mu.Unlock()
+	for _, session := range sessions {
+		p.closeSession(session)
+	}
+	p.relays.Wait()
+}
+
+// Returns counters of open sessions, oldest first
+func (p *udpProxy) Sessions() []UDPSessionView {
+	p.mu.Lock()
+	views := make([]UDPSessionView, 0, len(p.sessions))
+	for _, session := range p.sessions {
+		views = append(views, UDPSessionView{
+			Client:     session.client.String(),
+			Target:     session.target.Address,
+			Started:    session.started,
+			LastActive: time.Unix(0, atomic.LoadInt64(&session.activity.last)),
+			PacketsIn:  atomic.LoadInt64(&session.packetsIn),
+			PacketsOut: atomic.LoadInt64(&session.packetsOut),
+			BytesIn:    atomic.LoadInt64(&session.bytesIn),
+			BytesOut:   atomic.LoadInt64(&session.bytesOut),
+		})
+	}
+	p.mu.Unlock()
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Started.Before(views[j].Started)
+	})
+	return views
+}
+
+// Returns open sessions of udp listener, nil for other listeners
+func (lbs *Listener) UDPSessions() []UDPSessionView {
+	if lbs.udp == nil {
+		return nil
+	}
+	return lbs.udp.Sessions()
+}
+
+// Returns number of datagrams udp listener dropped as no session could be opened for them
+func (lbs *Listener) RejectedDatagrams() int64 {
+	if lbs.udp == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&lbs.udp.rejected)
+}
+
+// Reserves available target with the highest hash of `key` and its address, so that the
+// same key keeps its target while that target is available
+func (lb *Balancer) acquireHashed(key string) *Target {
+	type candidate struct {
+		target *Target
+		score  uint64
+	}
+	candidates := []candidate{}
+	for _, target := range lb.GetTargets() {
+		if !target.IsAvailable() {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(key + "|" + target.Address))
+		candidates = append(candidates, candidate{target: target, score: hash.Sum64()})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	for _, candidate := range candidates {
+		if lb.Admission.TryAcquireTarget(candidate.target) {
+			return candidate.target
+		}
+	}
+	return nil
+}
+
+// Opens socket sending datagrams to target of udp listener
+func (s *Target) dialUDP() (net.Conn, error) {
+	address, err := url.Parse(s.Address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeouts.Connect)
+	defer cancel()
+	return (&net.Dialer{}).DialContext(ctx, "udp", address.Host)
+}
+
+// Sends empty datagram to target. Target is considered down only if it answers that its port
+// is closed, as most udp services do not reply to datagrams they can not parse.
+func (s *Target) probeUDP(timeout time.Duration) bool {
+	conn, err := s.dialUDP()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(nil); err != nil {
+		return !errors.Is(err, syscall.ECONNREFUSED)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return !errors.Is(err, syscall.ECONNREFUSED)
+}
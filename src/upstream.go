@@ -0,0 +1,290 @@
+package src
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type UpstreamYAMLConfig struct {
+	// Mode of routes which use the upstream and do not set their own
+	Mode string `yaml:"mode"`
+	// Upstream timeouts of every target, targets may override them
+	Timeouts    *TimeoutsYAMLConfig    `yaml:"timeouts"`
+	HealthCheck *HealthCheckYAMLConfig `yaml:"healthCheck"`
+	Targets     []TargetYAMLConfig     `yaml:"targets"`
+}
+
+// Named set of targets shared by balancers of every route which references it. Those
+// balancers see the same targets, so connection counts, errors and health state are shared
+// too, and targets added or removed through any of them change the upstream.
+type Upstream struct {
+	Name     string
+	Timeouts *TimeoutsYAMLConfig
+	// Replaced, never modified in place, while holding `mu`
+	targets     []*Target
+	balancers   []*Balancer
+	mu          sync.Mutex
+	healthCheck *HealthChecker
+	discovery   targetDiscoveries
+}
+
+func NewUpstream(name string, cnf *UpstreamYAMLConfig) *Upstream {
+	upstream := &Upstream{
+		Name:     name,
+		Timeouts: cnf.Timeouts,
+	}
+	addConfiguredTargets(upstream, cnf.Targets)
+	upstream.healthCheck = NewHealthChecker(cnf.HealthCheck)
+	upstream.healthCheck.Start(upstream.GetTargets)
+	return upstream
+}
+
+// Returns snapshot of upstream's targets
+func (u *Upstream) GetTargets() []*Target {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.targets
+}
+
+// Returns target with given address, or nil if upstream has none
+func (u *Upstream) FindTarget(address string) *Target {
+	return findTarget(u.GetTargets(), address)
+}
+
+// Makes balancer use upstream's targets
+func (u *Upstream) attach(lb *Balancer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	lb.Upstream = u
+	for _, target := range u.targets {
+		lb.appendTarget(target, false)
+	}
+	balancers := make([]*Balancer, 0, len(u.balancers)+1)
+	balancers = append(balancers, u.balancers...)
+	u.balancers = append(balancers, lb)
+}
+
+// Returns protocol of listeners using upstream, which all take targets with the same scheme,
+// or empty string if no balancer uses it
+func (u *Upstream) targetProtocol() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.balancers) == 0 {
+		return ""
+	}
+	return u.balancers[0].Protocol
+}
+
+// Stops propagating target changes to balancer
+func (u *Upstream) detach(lb *Balancer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for index, balancer := range u.balancers {
+		if balancer == lb {
+			balancers := make([]*Balancer, 0, len(u.balancers)-1)
+			balancers = append(balancers, u.balancers[:index]...)
+			u.balancers = append(balancers, u.balancers[index+1:]...)
+			return
+		}
+	}
+}
+
+// Wakes requests queued on any balancer of upstream, as one of its targets became available
+func (u *Upstream) wake() {
+	u.mu.Lock()
+	balancers := u.balancers
+	u.mu.Unlock()
+	for _, balancer := range balancers {
+		balancer.Admission.Wake()
+	}
+}
+
+func (u *Upstream) AddNewServer(targetConfig *TargetYAMLConfig) *Target {
+	target, _ := u.addServer(targetConfig, false)
+	return target
+}
+
+// Adds target to upstream. If `unique` is set, target is not added when one with the same
+// address exists already, which is checked while holding the same lock as the append.
+func (u *Upstream) addServer(targetConfig *TargetYAMLConfig, unique bool) (*Target, error) {
+	target := u.newTarget(targetConfig)
+
+	u.mu.Lock()
+	if unique && findTarget(u.targets, target.Address) != nil {
+		u.mu.Unlock()
+		return nil, ErrTargetExists
+	}
+	targets := make([]*Target, 0, len(u.targets)+1)
+	targets = append(targets, u.targets...)
+	u.targets = append(targets, target)
+	for _, balancer := range u.balancers {
+		balancer.appendTarget(target, false)
+	}
+	u.mu.Unlock()
+
+	if targetConfig.Draining {
+		u.DrainTarget(target.Address, time.Duration(targetConfig.DrainTimeoutMs)*time.Millisecond)
+	}
+	return target, nil
+}
+
+// Creates target which takes upstream's timeouts
+func (u *Upstream) newTarget(targetConfig *TargetYAMLConfig) *Target {
+	targetCnf := *targetConfig
+	targetCnf.Timeouts = targetConfig.Timeouts.Merge(u.Timeouts)
+	target := NewTarget(&targetCnf)
+	target.MarkAsReachable()
+	target.setOnReachable(u.wake)
+	return target
+}
+
+// Removes `removed` targets and adds targets of `added` in a single change of upstream and
+// of each of its balancers
+func (u *Upstream) replaceTargets(removed []*Target, added []*TargetYAMLConfig) {
+	targets := make([]*Target, 0, len(added))
+	for _, targetConfig := range added {
+		targets = append(targets, u.newTarget(targetConfig))
+	}
+
+	u.mu.Lock()
+	kept := make([]*Target, 0, len(u.targets)+len(targets))
+	dropped := []*Target{}
+	for _, target := range u.targets {
+		if containsTarget(removed, target) {
+			dropped = append(dropped, target)
+		} else {
+			kept = append(kept, target)
+		}
+	}
+	u.targets = append(kept, targets...)
+	for _, balancer := range u.balancers {
+		balancer.swapTargets(dropped, targets)
+	}
+	u.mu.Unlock()
+
+	for _, target := range dropped {
+		target.closeIdleConnections()
+		log.Info().Str("upstream", u.Name).Str("address", target.Address).Msg("Target removed")
+	}
+	drainAddedTargets(u, added)
+}
+
+// Adds target to upstream, unless one with the same address exists already
+func (u *Upstream) AddTarget(targetConfig *TargetYAMLConfig) (*Target, error) {
+	if err := validateTargetConfig(targetConfig, u.targetProtocol()); err != nil {
+		return nil, err
+	}
+	target, err := u.addServer(targetConfig, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("upstream", u.Name).Str("address", target.Address).Msg("Target added")
+	return target, nil
+}
+
+// Removes target from upstream and all its balancers. Requests already sent to it are not
+// interrupted, while its idle connections are closed.
+func (u *Upstream) RemoveTarget(address string) error {
+	target := u.FindTarget(address)
+	if target == nil || !u.removeTarget(target) {
+		return ErrTargetNotFound
+	}
+	return nil
+}
+
+// Removes given target, returns false if upstream no longer has it
+func (u *Upstream) removeTarget(removed *Target) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for index, target := range u.targets {
+		if target == removed {
+			targets := make([]*Target, 0, len(u.targets)-1)
+			targets = append(targets, u.targets[:index]...)
+			u.targets = append(targets, u.targets[index+1:]...)
+			for _, balancer := range u.balancers {
+				balancer.dropTarget(target)
+			}
+			target.closeIdleConnections()
+			log.Info().Str("upstream", u.Name).Str("address", target.Address).Msg("Target removed")
+			return true
+		}
+	}
+	return false
+}
+
+// Returns weight of target, which is changed while holding `mu`
+func (u *Upstream) TargetWeight(address string) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if target := findTarget(u.targets, address); target != nil {
+		return target.Weight, nil
+	}
+	return 0, ErrTargetNotFound
+}
+
+func (u *Upstream) SetTargetWeight(address string, weight int) error {
+	if weight < 1 {
+		return ErrInvalidTargetWeight
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Weight is read by balancer logic under balancer's lock, so every balancer is locked
+	for _, balancer := range u.balancers {
+		balancer.targetsMu.Lock()
+		defer balancer.targetsMu.Unlock()
+	}
+	for _, target := range u.targets {
+		if target.Address == address {
+			target.Weight = weight
+			return nil
+		}
+	}
+	return ErrTargetNotFound
+}
+
+// Manually marks target as up or down
+func (u *Upstream) SetTargetAlive(address string, alive bool) error {
+	target := u.FindTarget(address)
+	if target == nil {
+		return ErrTargetNotFound
+	}
+	// Requests waiting in queue are woken up by target once it is brought back up
+	if alive {
+		target.MarkAsReachable()
+	} else {
+		target.MarkAsUnreachable()
+	}
+	return nil
+}
+
+// Drains target with given address, see `Balancer.DrainTarget`
+func (u *Upstream) DrainTarget(address string, deadline time.Duration) error {
+	target := u.FindTarget(address)
+	if target == nil {
+		return ErrTargetNotFound
+	}
+	drainTarget(target, deadline, log.With().Str("upstream", u.Name).Logger(), u.removeTarget)
+	return nil
+}
+
+func (u *Upstream) UndrainTarget(address string) error {
+	target := u.FindTarget(address)
+	if target == nil {
+		return ErrTargetNotFound
+	}
+	target.StopDrain()
+	u.wake()
+	return nil
+}
+
+func (u *Upstream) discoveries() *targetDiscoveries {
+	return &u.discovery
+}
+
+// Stops health checks and target discovery of upstream
+func (u *Upstream) Close() {
+	u.healthCheck.Stop()
+	u.discovery.Stop()
+}
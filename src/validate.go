@@ -0,0 +1,818 @@
+package src
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem found in configuration, positioned at YAML node it concerns. Line and column
+// are 0 when position is unknown, file is empty when configuration was not read from one.
+type ConfigError struct {
+	File    string
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (ce *ConfigError) Error() string {
+	position := ""
+	if ce.Line > 0 {
+		position = fmt.Sprintf("line %v", ce.Line)
+		if ce.Column > 0 {
+			position += fmt.Sprintf(", column %v", ce.Column)
+		}
+		position += ": "
+	}
+	if ce.File != "" {
+		position = ce.File + ": " + position
+	}
+	if ce.Path != "" {
+		return position + ce.Path + ": " + ce.Message
+	}
+	return position + ce.Message
+}
+
+// Validation errors found in configuration
+type ConfigErrors []*ConfigError
+
+func (ce ConfigErrors) Error() string {
+	messages := make([]string, 0, len(ce))
+	for _, err := range ce {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Logs every error on its own line
+func (ce ConfigErrors) Log() {
+	for _, err := range ce {
+		log.Error().Str("file", err.File).Int("line", err.Line).Int("column", err.Column).Str("path", err.Path).Msg(err.Message)
+	}
+}
+
+// Error messages of YAML parser carry line number only
+var yamlErrorLinePattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+func newYAMLError(file string, message string) *ConfigError {
+	configError := &ConfigError{File: file, Message: strings.TrimPrefix(message, "yaml: ")}
+	if match := yamlErrorLinePattern.FindStringSubmatch(message); match != nil {
+		configError.Line, _ = strconv.Atoi(match[1])
+		configError.Message = match[2]
+	}
+	return configError
+}
+
+// Location of a value in configuration, made of mapping keys and sequence indices
+type configPath []any
+
+func (cp configPath) Child(elems ...any) configPath {
+	child := make(configPath, 0, len(cp)+len(elems))
+	child = append(child, cp...)
+	return append(child, elems...)
+}
+
+func (cp configPath) String() string {
+	var sb strings.Builder
+	for _, elem := range cp {
+		switch value := elem.(type) {
+		case int:
+			fmt.Fprintf(&sb, "[%v]", value)
+		default:
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
+			fmt.Fprint(&sb, value)
+		}
+	}
+	return sb.String()
+}
+
+type configValidator struct {
+	root *yaml.Node
+	errs ConfigErrors
+	// File every node was read from, when configuration is split across files
+	files map[*yaml.Node]string
+	// Number of errors in `errs` found while decoding values into their types
+	typeErrors int
+	// Values read from `file://` references
+	secretNodes map[*yaml.Node]bool
+	// Paths of values which are redacted when configuration is printed
+	secretPaths map[string]bool
+}
+
+// Returns node at path, or the closest existing ancestor if path is not present
+func (cv *configValidator) node(path configPath) *yaml.Node {
+	node := cv.root
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range path {
+		var next *yaml.Node
+		switch value := elem.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == value {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && value < len(node.Content) {
+				next = node.Content[value]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+func (cv *configValidator) addf(path configPath, format string, args ...any) {
+	configError := &ConfigError{
+		Path:    path.String(),
+		Message: fmt.Sprintf(format, args...),
+	}
+	if node := cv.node(path); node != nil {
+		configError.File, configError.Line, configError.Column = cv.files[node], node.Line, node.Column
+	}
+	cv.errs = append(cv.errs, configError)
+}
+
+func (cv *configValidator) addNodef(node *yaml.Node, path configPath, format string, args ...any) {
+	cv.errs = append(cv.errs, &ConfigError{
+		File:    cv.files[node],
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path.String(),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Reports mapping keys which do not match any field of the type they are decoded into
+func (cv *configValidator) checkKnownFields(node *yaml.Node, t reflect.Type, path configPath) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			cv.checkKnownFields(child, t, path)
+		}
+	case yaml.AliasNode:
+		cv.checkKnownFields(node.Alias, t, path)
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice {
+			for index, child := range node.Content {
+				cv.checkKnownFields(child, t.Elem(), path.Child(index))
+			}
+		}
+	case yaml.MappingNode:
+		if t.Kind() == reflect.Map {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				cv.checkKnownFields(node.Content[i+1], t.Elem(), path.Child(node.Content[i].Value))
+			}
+			return
+		}
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if name := yamlFieldName(field); name != "-" {
+				fields[name] = field.Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldType, known := fields[key.Value]
+			if !known {
+				cv.errs = append(cv.errs, &ConfigError{
+					File:    cv.files[key],
+					Line:    key.Line,
+					Column:  key.Column,
+					Path:    path.String(),
+					Message: fmt.Sprintf("unknown field '%v'", key.Value),
+				})
+				continue
+			}
+			cv.checkKnownFields(node.Content[i+1], fieldType, path.Child(key.Value))
+		}
+	}
+}
+
+func isValidPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number > 0 && number < 65536
+}
+
+func isValidHTTPURL(address string) bool {
+	parsed, err := url.Parse(address)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// Returns scheme of targets of tcp, udp and tls listeners, or "" for http listeners
+func layer4TargetScheme(protocol string) string {
+	switch protocol {
+	case LS_PROTOCOL_TCP, LS_PROTOCOL_TLS:
+		return TCP_TARGET_SCHEME
+	case LS_PROTOCOL_UDP:
+		return UDP_TARGET_SCHEME
+	}
+	return ""
+}
+
+func isLayer4Scheme(scheme string) bool {
+	return scheme == TCP_TARGET_SCHEME || scheme == UDP_TARGET_SCHEME
+}
+
+// Describes listeners which take targets with given scheme
+func layer4SchemeListeners(scheme string) string {
+	if scheme == TCP_TARGET_SCHEME {
+		return "tcp or tls listener"
+	}
+	return scheme + " listener"
+}
+
+// Returns true if name is a domain name, optionally with `*.` prefix
+func isValidServerName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if address can be a target of listener with given protocol, or of any
+// listener if protocol is empty
+func isValidTargetAddress(address string, protocol string) bool {
+	parsed, err := url.Parse(address)
+	isHostPort := err == nil && isLayer4Scheme(parsed.Scheme) && parsed.Port() != "" && parsed.Hostname() != ""
+	if scheme := layer4TargetScheme(protocol); scheme != "" {
+		return isHostPort && parsed.Scheme == scheme
+	}
+	if protocol == "" {
+		return isHostPort || isValidHTTPURL(address)
+	}
+	return isValidHTTPURL(address)
+}
+
+// Describes target addresses listener with given protocol accepts
+func targetAddressKind(protocol string) string {
+	if scheme := layer4TargetScheme(protocol); scheme != "" {
+		return "a " + scheme + "://host:port URL"
+	}
+	if protocol == "" {
+		return "an absolute http, https, tcp or udp URL"
+	}
+	return "an absolute http or https URL"
+}
+
+func (cv *configValidator) checkFraction(path configPath, value *float64) {
+	if value != nil && (*value < 0 || *value > 1) {
+		cv.addf(path, "value %v must be between 0 and 1", *value)
+	}
+}
+
+// Checks configuration and fills in defaults
+func (cv *configValidator) validate(cnf *LoadBalancerYAMLConfiguration) {
+	if cnf.Admin != nil {
+		cv.addSecret(configPath{"admin", "token"}, cnf.Admin.Token)
+	}
+	if cnf.Admin != nil && !isValidPort(cnf.Admin.Port) {
+		cv.addf(configPath{"admin", "port"}, "admin port '%v' is invalid", cnf.Admin.Port)
+	}
+
+	if cnf.AccessLog != nil {
+		path := configPath{"accessLog"}
+		if cnf.AccessLog.Format != "" && !IsValidAccessLogFormat(cnf.AccessLog.Format) {
+			cv.addf(path.Child("format"), "access log format '%v' is invalid, supported formats are: '%v'", cnf.AccessLog.Format, strings.Join(supportedAccessLogFormats, "', '"))
+		}
+		if cnf.AccessLog.Format == ACCESS_LOG_FORMAT_TEMPLATE {
+			if _, err := template.New("accesslog").Parse(cnf.AccessLog.Template); err != nil || cnf.AccessLog.Template == "" {
+				cv.addf(path.Child("template"), "valid `template` is mandatory if access log format is set to '%v'", ACCESS_LOG_FORMAT_TEMPLATE)
+			}
+		}
+		if cnf.AccessLog.Output != "" && !IsValidAccessLogOutput(cnf.AccessLog.Output) {
+			cv.addf(path.Child("output"), "access log output '%v' is invalid, supported outputs are: '%v'", cnf.AccessLog.Output, strings.Join(supportedAccessLogOutputs, "', '"))
+		}
+		if cnf.AccessLog.Output == ACCESS_LOG_OUTPUT_FILE && cnf.AccessLog.File == "" {
+			cv.addf(path, "`file` field is mandatory if access log output is set to '%v'", ACCESS_LOG_OUTPUT_FILE)
+		}
+		cv.checkFraction(path.Child("sampleRate"), cnf.AccessLog.SampleRate)
+	}
+
+	if cnf.Tracing != nil {
+		if !isValidHTTPURL(cnf.Tracing.Endpoint) {
+			cv.addf(configPath{"tracing", "endpoint"}, "tracing endpoint '%v' must be an absolute http or https URL", cnf.Tracing.Endpoint)
+		}
+		cv.checkFraction(configPath{"tracing", "sampleRatio"}, cnf.Tracing.SampleRatio)
+	}
+
+	// Upstreams are checked first, so that routes can take their mode
+	upstreamNames := make([]string, 0, len(cnf.Upstreams))
+	for name := range cnf.Upstreams {
+		upstreamNames = append(upstreamNames, name)
+	}
+	sort.Strings(upstreamNames)
+	for _, name := range upstreamNames {
+		upstream := cnf.Upstreams[name]
+		cv.validateUpstream(&upstream, configPath{"upstreams", name})
+		cnf.Upstreams[name] = upstream
+	}
+
+	if len(cnf.Listeners) == 0 {
+		log.Info().Msg("No listeners were configured")
+	}
+
+	// Explicit ids are reserved first, so that generated ones can not collide with them
+	balancerIds := map[string]configPath{}
+	for listenerIndex := range cnf.Listeners {
+		for routeIndex, route := range cnf.Listeners[listenerIndex].Routes {
+			if route.Id == "" {
+				continue
+			}
+			path := configPath{"listeners", listenerIndex, "routes", routeIndex}
+			if previous, found := balancerIds[route.Id]; found {
+				cv.addf(path.Child("id"), "balancer id '%v' is already used by %v", route.Id, previous)
+				continue
+			}
+			balancerIds[route.Id] = path
+		}
+	}
+
+	ports := map[string]configPath{}
+	for listenerIndex := range cnf.Listeners {
+		listener := &cnf.Listeners[listenerIndex]
+		path := configPath{"listeners", listenerIndex}
+
+		// check protocol field
+		if listener.Protocol == "" {
+			log.Info().Msgf("Protocol field not set, hence setting to default '%v'", DefaultListenerProtocol)
+			listener.Protocol = DefaultListenerProtocol
+		} else if !IsValidListenerProtocol(listener.Protocol) {
+			cv.addf(path.Child("protocol"), "listener protocol '%v' is invalid, supported protocols are: '%v'", listener.Protocol, strings.Join(supportedListenerProtocols, "', '"))
+		}
+
+		// Check Port field
+		if listener.Port == "" {
+			log.Info().Msgf("Port not specified, hence setting to default port '%v'", DefaultListenerPort)
+			listener.Port = DefaultListenerPort
+		}
+		if !isValidPort(listener.Port) {
+			cv.addf(path.Child("port"), "port '%v' is invalid", listener.Port)
+		} else if previous, found := ports[listener.Port]; found {
+			cv.addf(path.Child("port"), "port %v is already used by %v", listener.Port, previous)
+		} else {
+			ports[listener.Port] = path
+		}
+
+		// Check secure listener settings
+		if listener.Protocol == LS_PROTOCOL_HTTPS {
+			if listener.SSLCertificate == "" || listener.SSLCertificateKey == "" {
+				cv.addf(path, "SSL certificate fields are mandatory if protocol is set to '%v'", LS_PROTOCOL_HTTPS)
+			}
+			for field, file := range map[string]string{"ssl_certificate": listener.SSLCertificate, "ssl_certificate_key": listener.SSLCertificateKey} {
+				if _, err := os.Stat(file); file != "" && err != nil {
+					cv.addf(path.Child(field), "file '%v' can not be read: %v", file, err)
+				}
+			}
+		}
+
+		// Check request id settings
+		if listener.RequestID != nil && listener.RequestID.Format != "" && !IsValidRequestIDFormat(listener.RequestID.Format) {
+			cv.addf(path.Child("requestId", "format"), "request id format '%v' is invalid, supported formats are: '%v'", listener.RequestID.Format, strings.Join(supportedRequestIDFormats, "', '"))
+		}
+
+		if layer4TargetScheme(listener.Protocol) != "" {
+			cv.validateLayer4Listener(listener, path)
+		}
+		if listener.Protocol != LS_PROTOCOL_UDP {
+			for _, field := range []struct {
+				name string
+				set  bool
+			}{
+				{"maxSessions", listener.MaxSessions != 0},
+				{"hashClientIP", listener.HashClientIP},
+			} {
+				if field.set {
+					cv.addf(path.Child(field.name), "`%v` can only be set on udp listener", field.name)
+				}
+			}
+		} else if listener.MaxSessions < 0 {
+			cv.addf(path.Child("maxSessions"), "maxSessions must not be negative")
+		}
+
+		routePrefixes := map[string]configPath{}
+		serverNames := map[string]configPath{}
+		for routeIndex := range listener.Routes {
+			route := &listener.Routes[routeIndex]
+			routePath := path.Child("routes", routeIndex)
+			protocol := listener.Protocol
+			if route.Passthrough {
+				cv.validatePassthroughRoute(route, routePath, listener.Protocol, serverNames)
+				protocol = LS_PROTOCOL_TLS
+			} else if len(route.ServerNames) > 0 {
+				cv.addf(routePath.Child("serverNames"), "`serverNames` can only be set on passthrough route")
+			}
+			// Check Id field
+			if route.Id == "" {
+				route.Id = generateBalancerId(listener.Port, route, balancerIds)
+				balancerIds[route.Id] = routePath
+				log.Info().Str("new-id", route.Id).Msg("Id field was not set hence auto-assigning a unique identifier")
+			}
+			cv.validateRoute(route, routePath, protocol, cnf.Upstreams, routePrefixes)
+		}
+	}
+}
+
+func (cv *configValidator) validateUpstream(upstream *UpstreamYAMLConfig, path configPath) {
+	if upstream.Mode == "" {
+		upstream.Mode = DefaultLoadBalancerType
+	} else if !IsValidBalancerMode(upstream.Mode) {
+		cv.addf(path.Child("mode"), "mode '%v' is invalid, supported modes are: '%v'", upstream.Mode, strings.Join(supportedBalancers, "', '"))
+	}
+
+	if healthCheck := upstream.HealthCheck; healthCheck != nil {
+		if healthCheck.Path != "" && !strings.HasPrefix(healthCheck.Path, "/") {
+			cv.addf(path.Child("healthCheck", "path"), "health check path '%v' must start with '/'", healthCheck.Path)
+		}
+		if healthCheck.IntervalMs < 0 {
+			cv.addf(path.Child("healthCheck", "intervalMs"), "intervalMs must not be negative")
+		}
+		if healthCheck.TimeoutMs < 0 {
+			cv.addf(path.Child("healthCheck", "timeoutMs"), "timeoutMs must not be negative")
+		}
+	}
+
+	cv.validateTargets(upstream.Targets, path, "")
+}
+
+// Checks that settings which only apply to HTTP are not set on tcp, udp or tls listener
+func (cv *configValidator) validateLayer4Listener(listener *ListenerYAMLConfig, path configPath) {
+	if listener.Protocol == LS_PROTOCOL_TLS {
+		// Routes of tls listener are chosen by server name
+		for routeIndex := range listener.Routes {
+			listener.Routes[routeIndex].Passthrough = true
+		}
+	} else if len(listener.Routes) != 1 {
+		cv.addf(path.Child("routes"), "%v listener must have exactly one route", listener.Protocol)
+	}
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"requestId", listener.RequestID != nil},
+		// Datagrams are not connections, udp listeners limit sessions instead
+		{"maxConnectionsPerIP", listener.Protocol == LS_PROTOCOL_UDP && listener.MaxConnectionsPerIP != 0},
+		{"shutdownTimeoutMs", listener.Protocol == LS_PROTOCOL_UDP && listener.ShutdownTimeoutMs != 0},
+	} {
+		if field.set {
+			cv.addf(path.Child(field.name), "`%v` can not be set on %v listener", field.name, listener.Protocol)
+		}
+	}
+	for routeIndex := range listener.Routes {
+		cv.checkHTTPRouteFields(&listener.Routes[routeIndex], path.Child("routes", routeIndex), "route of "+listener.Protocol+" listener")
+	}
+}
+
+// Checks that settings which only apply to HTTP are not set on route which pipes connections
+func (cv *configValidator) checkHTTPRouteFields(route *RouteYAMLConfig, path configPath, description string) {
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"routeprefix", route.Routeprefix != ""},
+		{"customHeaders", len(route.CustomHeaders) > 0},
+		{"maxRequestBodyBytes", route.MaxRequestBodyBytes != 0},
+		{"adaptiveConcurrency", route.AdaptiveConcurrency != nil},
+		{"hedging", route.Hedging != nil},
+	} {
+		if field.set {
+			cv.addf(path.Child(field.name), "`%v` can not be set on %v", field.name, description)
+		}
+	}
+}
+
+// Checks server names passthrough route takes connections for. Names already taken by other
+// routes of the listener are collected in `serverNames`, route without names under "".
+func (cv *configValidator) validatePassthroughRoute(route *RouteYAMLConfig, path configPath, protocol string, serverNames map[string]configPath) {
+	switch protocol {
+	case LS_PROTOCOL_HTTPS:
+		cv.checkHTTPRouteFields(route, path, "passthrough route")
+		if len(route.ServerNames) == 0 {
+			cv.addf(path.Child("serverNames"), "passthrough route of https listener must have serverNames")
+		}
+	case LS_PROTOCOL_TLS:
+		if len(route.ServerNames) == 0 {
+			if previous, found := serverNames[""]; found {
+				cv.addf(path.Child("serverNames"), "`serverNames` must be set, as %v already takes connections no other route does", previous)
+			} else {
+				serverNames[""] = path
+			}
+		}
+	default:
+		cv.addf(path.Child("passthrough"), "`passthrough` can only be set on route of https listener")
+		return
+	}
+
+	for index, name := range route.ServerNames {
+		name = strings.ToLower(name)
+		route.ServerNames[index] = name
+		if !isValidServerName(name) {
+			cv.addf(path.Child("serverNames", index), "server name '%v' is invalid", name)
+		} else if previous, found := serverNames[name]; found {
+			cv.addf(path.Child("serverNames", index), "server name '%v' is already used by %v", name, previous)
+		} else {
+			serverNames[name] = path
+		}
+	}
+}
+
+func (cv *configValidator) validateRoute(route *RouteYAMLConfig, path configPath, protocol string, upstreams map[string]UpstreamYAMLConfig, routePrefixes map[string]configPath) {
+	// Check Route Prefix field, passthrough routes are chosen by server name instead
+	if !route.Passthrough {
+		if route.Routeprefix == "" {
+			log.Info().Str("balancer", route.Id).Msg("`routeprefix` field not specified. Set to '/' by default.")
+			route.Routeprefix = DefaultRoutePrefix
+		}
+		if !strings.HasPrefix(route.Routeprefix, "/") {
+			cv.addf(path.Child("routeprefix"), "route prefix '%v' must start with '/'", route.Routeprefix)
+		}
+		if previous, found := routePrefixes[route.Routeprefix]; found {
+			cv.addf(path.Child("routeprefix"), "route prefix '%v' is already used by %v", route.Routeprefix, previous)
+		} else {
+			routePrefixes[route.Routeprefix] = path
+		}
+	}
+
+	// Check upstream field, upstream replaces route's own targets and their settings
+	if route.Upstream != "" {
+		upstream, found := upstreams[route.Upstream]
+		if !found {
+			cv.addf(path.Child("upstream"), "upstream '%v' is not defined", route.Upstream)
+		} else {
+			if route.Mode == "" {
+				route.Mode = upstream.Mode
+			}
+			cv.checkUpstreamProtocol(path.Child("upstream"), route.Upstream, &upstream, protocol)
+		}
+		if route.Targets != nil {
+			cv.addf(path.Child("targets"), "`targets` can not be set on route which uses an upstream")
+		}
+		if route.Timeouts != nil {
+			cv.addf(path.Child("timeouts"), "`timeouts` can not be set on route which uses an upstream, set them on the upstream")
+		}
+		if route.MaxTargetConnections != 0 {
+			cv.addf(path.Child("maxTargetConnections"), "`maxTargetConnections` can not be set on route which uses an upstream, set `maxConnections` of its targets")
+		}
+	}
+
+	// Check Mode field
+	if route.Mode == "" {
+		route.Mode = DefaultLoadBalancerType
+		log.Info().Str("balancer", route.Id).Msgf("Mode field defaults to '%v'", DefaultLoadBalancerType)
+	}
+	if !IsValidBalancerMode(route.Mode) {
+		cv.addf(path.Child("mode"), "mode '%v' is invalid, supported modes are: '%v'", route.Mode, strings.Join(supportedBalancers, "', '"))
+	}
+
+	// Check adaptive concurrency settings
+	if route.AdaptiveConcurrency != nil && !IsValidLimiterAlgorithm(route.AdaptiveConcurrency.Algorithm) {
+		cv.addf(path.Child("adaptiveConcurrency", "algorithm"), "adaptive concurrency algorithm '%v' is invalid, supported algorithms are: '%v'", route.AdaptiveConcurrency.Algorithm, strings.Join(supportedLimiterAlgorithms, "', '"))
+	}
+	cv.checkFraction(path.Child("accessLogSampleRate"), route.AccessLogSampleRate)
+	cv.checkFraction(path.Child("traceSampleRatio"), route.TraceSampleRatio)
+
+	// Check targets field
+	if route.Upstream == "" {
+		cv.validateTargets(route.Targets, path, protocol)
+	}
+}
+
+// Checks that targets of upstream can be used by listener with given protocol
+func (cv *configValidator) checkUpstreamProtocol(path configPath, name string, upstream *UpstreamYAMLConfig, protocol string) {
+	for index := range upstream.Targets {
+		target := &upstream.Targets[index]
+		scheme := ""
+		if target.IsDiscovered() {
+			_, discoveryScheme := target.discoveryScheme()
+			if discoveryScheme == nil {
+				continue
+			}
+			scheme = *discoveryScheme
+			if scheme == "" {
+				scheme = DEFAULT_DISCOVERY_SCHEME
+			}
+		} else if parsed, err := url.Parse(target.Address); err == nil {
+			scheme = parsed.Scheme
+		}
+		if !isLayer4Scheme(scheme) {
+			scheme = ""
+		}
+		if scheme != layer4TargetScheme(protocol) {
+			cv.addf(path, "upstream '%v' has targets which %v listener can not use", name, protocol)
+			return
+		}
+	}
+}
+
+// Checks scheme of discovered targets against protocol of their listener, tcp, udp and tls
+// listeners defaulting to scheme of their targets
+func (cv *configValidator) checkDiscoveryScheme(target *TargetYAMLConfig, path configPath, protocol string) {
+	source, scheme := target.discoveryScheme()
+	if scheme == nil || protocol == "" {
+		return
+	}
+	expected := layer4TargetScheme(protocol)
+	if *scheme == "" && expected != "" {
+		*scheme = expected
+	}
+	if expected != "" && *scheme != expected {
+		cv.addf(path.Child(source, "scheme"), "targets of %v listener must be discovered with scheme '%v'", protocol, expected)
+	} else if expected == "" && isLayer4Scheme(*scheme) {
+		cv.addf(path.Child(source, "scheme"), "scheme '%v' can only be used by targets of %v", *scheme, layer4SchemeListeners(*scheme))
+	}
+}
+
+func (cv *configValidator) validateTargets(targets []TargetYAMLConfig, path configPath, protocol string) {
+	if len(targets) < 1 {
+		cv.addf(path, "no redirection targets mentioned")
+	}
+	addresses := map[string]bool{}
+	discoveries := map[string]bool{}
+	for targetIndex, target := range targets {
+		targetPath := path.Child("targets", targetIndex)
+		if target.IsDiscovered() {
+			cv.validateDiscovery(&target, targetPath)
+			cv.checkDiscoveryScheme(&target, targetPath, protocol)
+			if key := target.discoveryKey(); discoveries[key] {
+				cv.addf(targetPath, "discovery of the same targets is listed more than once")
+			} else {
+				discoveries[key] = true
+			}
+		} else if !isValidTargetAddress(target.Address, protocol) {
+			cv.addf(targetPath.Child("address"), "target address '%v' must be %v", target.Address, targetAddressKind(protocol))
+		} else if addresses[target.Address] {
+			cv.addf(targetPath.Child("address"), "target address '%v' is listed more than once", target.Address)
+		}
+		addresses[target.Address] = true
+		if target.Weight < 0 {
+			cv.addf(targetPath.Child("weight"), "weight must not be negative")
+		}
+		if target.MaxConnections < 0 {
+			cv.addf(targetPath.Child("maxConnections"), "maxConnections must not be negative")
+		}
+	}
+}
+
+// Checks target entry resolved at runtime
+func (cv *configValidator) validateDiscovery(target *TargetYAMLConfig, path configPath) {
+	if target.Address != "" {
+		cv.addf(path.Child("address"), "`address` can not be set on target which is discovered")
+	}
+	if target.Draining {
+		cv.addf(path.Child("draining"), "`draining` can not be set on target which is discovered")
+	}
+	if target.DrainTimeoutMs < 0 {
+		cv.addf(path.Child("drainTimeoutMs"), "drainTimeoutMs must not be negative")
+	}
+	sources := []string{}
+	for name, set := range map[string]bool{"dns": target.DNS != nil, "file": target.File != nil, "consul": target.Consul != nil, "kubernetes": target.Kubernetes != nil} {
+		if set {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) > 1 {
+		sort.Strings(sources)
+		cv.addf(path, "only one of `%v` can be set on a target", strings.Join(sources, "`, `"))
+	}
+
+	if target.DNS != nil {
+		cv.validateDNSDiscovery(target.DNS, path.Child("dns"))
+	}
+	if target.File != nil {
+		cv.validateFileDiscovery(target.File, path.Child("file"))
+	}
+	if target.Consul != nil {
+		cv.validateConsulDiscovery(target.Consul, path.Child("consul"))
+	}
+	if target.Kubernetes != nil {
+		cv.validateKubernetesDiscovery(target.Kubernetes, path.Child("kubernetes"))
+	}
+}
+
+func (cv *configValidator) checkScheme(path configPath, scheme string) {
+	if scheme != "" && scheme != "http" && scheme != "https" && !isLayer4Scheme(scheme) {
+		cv.addf(path, "scheme '%v' is invalid, supported schemes are: 'http', 'https', 'tcp', 'udp'", scheme)
+	}
+}
+
+func (cv *configValidator) validateDNSDiscovery(dns *DNSDiscoveryYAMLConfig, path configPath) {
+	if dns.Name == "" {
+		cv.addf(path, "`name` field is mandatory for DNS discovery")
+	}
+	if dns.Type != "" && !IsValidDNSRecordType(dns.Type) {
+		cv.addf(path.Child("type"), "DNS record type '%v' is invalid, supported types are: '%v'", dns.Type, strings.Join(supportedDNSRecordTypes, "', '"))
+	}
+	if dns.Type != DNS_RECORD_SRV && (dns.Port < 1 || dns.Port > 65535) {
+		cv.addf(path.Child("port"), "port '%v' is invalid, it is mandatory unless records are SRV", dns.Port)
+	}
+	cv.checkScheme(path.Child("scheme"), dns.Scheme)
+	if _, _, err := net.SplitHostPort(dns.Server); dns.Server != "" && err != nil {
+		cv.addf(path.Child("server"), "name server '%v' must be given as host:port", dns.Server)
+	}
+	if dns.MinIntervalMs < 0 {
+		cv.addf(path.Child("minIntervalMs"), "minIntervalMs must not be negative")
+	}
+	if dns.MaxIntervalMs < 0 {
+		cv.addf(path.Child("maxIntervalMs"), "maxIntervalMs must not be negative")
+	}
+}
+
+func (cv *configValidator) validateFileDiscovery(file *FileDiscoveryYAMLConfig, path configPath) {
+	if file.Path == "" {
+		cv.addf(path, "`path` field is mandatory for file discovery")
+	} else {
+		cv.resolvePath(path.Child("path"), &file.Path)
+	}
+	if file.IntervalMs < 0 {
+		cv.addf(path.Child("intervalMs"), "intervalMs must not be negative")
+	}
+}
+
+func (cv *configValidator) validateConsulDiscovery(consul *ConsulDiscoveryYAMLConfig, path configPath) {
+	cv.addSecret(path.Child("token"), consul.Token)
+	if !isValidHTTPURL(consul.Address) {
+		cv.addf(path.Child("address"), "catalog address '%v' must be an absolute http or https URL", consul.Address)
+	}
+	if consul.Service == "" {
+		cv.addf(path, "`service` field is mandatory for consul discovery")
+	}
+	cv.checkScheme(path.Child("scheme"), consul.Scheme)
+	if consul.WaitMs < 0 {
+		cv.addf(path.Child("waitMs"), "waitMs must not be negative")
+	}
+	if consul.RetryIntervalMs < 0 {
+		cv.addf(path.Child("retryIntervalMs"), "retryIntervalMs must not be negative")
+	}
+}
+
+func (cv *configValidator) validateKubernetesDiscovery(kubernetes *KubernetesDiscoveryYAMLConfig, path configPath) {
+	if kubernetes.Service == "" {
+		cv.addf(path, "`service` field is mandatory for kubernetes discovery")
+	}
+	if kubernetes.Kubeconfig != "" {
+		cv.resolvePath(path.Child("kubeconfig"), &kubernetes.Kubeconfig)
+	} else if kubernetes.Context != "" {
+		cv.addf(path.Child("context"), "`context` can only be set along with `kubeconfig`")
+	}
+	cv.checkScheme(path.Child("scheme"), kubernetes.Scheme)
+	if kubernetes.RetryIntervalMs < 0 {
+		cv.addf(path.Child("retryIntervalMs"), "retryIntervalMs must not be negative")
+	}
+}
+
+// Resolves relative file path against configuration file it is set in, like includes
+func (cv *configValidator) resolvePath(path configPath, value *string) {
+	if node := cv.node(path); !filepath.IsAbs(*value) && node != nil && cv.files[node] != "" {
+		*value = filepath.Join(filepath.Dir(cv.files[node]), *value)
+	}
+}
+
+// Returns key of struct field in configuration, as decoder names it. "-" for ignored fields.
+func yamlFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
@@ -0,0 +1,175 @@
+package testing_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Access Log", func() {
+	var LbTestService LoadBalancerService
+	var logDir string
+
+	StartService := func(accessLogConfig string) {
+		LbTestService = LoadBalancerService{}
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "logged-balancer"
+        targets:
+          - address: http://localhost:8091
+      - routeprefix: "/quiet"
+        mode: "RoundRobin"
+        id: "quiet-balancer"
+        accessLogSampleRate: 0
+        targets:
+          - address: http://localhost:8091
+accessLog:
+` + accessLogConfig,
+		}
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+	}
+
+	BeforeEach(func() {
+		var err error
+		logDir, err = os.MkdirTemp("", "lb-accesslog")
+		Expect(err).NotTo(HaveOccurred())
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+		os.RemoveAll(logDir)
+	})
+
+	It("Writes JSON entries to file and honours route sampling", func() {
+		logFile := filepath.Join(logDir, "access.log")
+		StartService(fmt.Sprintf(`  format: json
+  output: file
+  file: %v`, logFile))
+
+		res, _ := Request(LISTENER_8080_URL + "quiet").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		res, _ = Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(0))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := os.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		Expect(lines).To(HaveLen(1))
+
+		entry := AccessLogEntry{}
+		Expect(json.Unmarshal([]byte(lines[0]), &entry)).To(Succeed())
+		Expect(entry.ClientIP).To(Equal("127.0.0.1"))
+		Expect(entry.Method).To(Equal("POST"))
+		Expect(entry.URI).To(Equal("/delayed"))
+		Expect(entry.Listener).To(Equal("http:8080"))
+		Expect(entry.Balancer).To(Equal("logged-balancer"))
+		Expect(entry.Target).To(Equal("http://localhost:8091"))
+		Expect(entry.Status).To(Equal(http.StatusOK))
+		Expect(entry.UpstreamStatus).To(Equal(http.StatusOK))
+		Expect(entry.BytesIn).To(Equal(int64(len(GetDelayedRequestPayload(0)))))
+		Expect(entry.BytesOut).To(BeNumerically(">", 0))
+		Expect(entry.Hedges).To(Equal(0))
+	})
+
+	It("Writes combined format entries to syslog socket", func() {
+		socketPath := filepath.Join(logDir, "syslog.sock")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		StartService(fmt.Sprintf(`  format: combined
+  output: syslog
+  syslogAddress: %v
+  syslogTag: lbtest`, socketPath))
+
+		res, _ := Request(LISTENER_8080_URL + "search").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		Expect(err).NotTo(HaveOccurred())
+		message := string(buf[:n])
+		Expect(message).To(ContainSubstring("lbtest"))
+		Expect(message).To(ContainSubstring(`"GET /search HTTP/1.1" 200`))
+		Expect(message).To(ContainSubstring(`"Go-http-client/1.1"`))
+	})
+
+	It("Formats entries with custom template", func() {
+		logFile := filepath.Join(logDir, "access.log")
+		StartService(fmt.Sprintf(`  format: template
+  template: "{{.Method}} {{.URI}} -> {{.Target}} ({{.Status}})"
+  output: file
+  file: %v`, logFile))
+
+		Request(LISTENER_8080_URL + "search").Get()
+		contents, err := os.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal("GET /search -> http://localhost:8091 (200)\n"))
+	})
+
+	It("Rotates log file by size", func() {
+		StartService(`  output: stdout`)
+
+		logFile := filepath.Join(logDir, "rotated.log")
+		file, err := NewRotatingFile(logFile, 100, 0, 2)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 10; i++ {
+			_, err := file.Write([]byte(strings.Repeat("x", 39) + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(file.Close()).To(Succeed())
+
+		backups, _ := filepath.Glob(logFile + ".*")
+		Expect(backups).To(HaveLen(2))
+		info, err := os.Stat(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically("<=", 100))
+	})
+
+	It("Keeps writing log file which could not be rotated", func() {
+		StartService(`  output: stdout`)
+
+		logFile := filepath.Join(logDir, "removed.log")
+		file, err := NewRotatingFile(logFile, 100, 0, 2)
+		Expect(err).NotTo(HaveOccurred())
+		line := strings.Repeat("x", 39) + "\n"
+		for i := 0; i < 2; i++ {
+			_, err := file.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		// Rotation fails to rename removed file, and entry goes to file opened in its place
+		Expect(os.Remove(logFile)).To(Succeed())
+		n, err := file.Write([]byte(line))
+		Expect(err).To(HaveOccurred())
+		Expect(n).To(Equal(len(line)))
+		_, err = file.Write([]byte(line))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		contents, err := os.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal(line + line))
+	})
+})
@@ -0,0 +1,131 @@
+package testing_test
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Adaptive Concurrency", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "LeastConnectionsRoundRobin"
+        id: "adaptive-balancer"
+        adaptiveConcurrency:
+          algorithm: "AIMD"
+          initialLimit: 1
+          maxLimit: 1
+        targets:
+          - address: http://localhost:8091
+          - address: http://localhost:8092`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(2)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Sheds requests above the limit", func() {
+		endWG := &sync.WaitGroup{}
+		endWG.Add(1)
+
+		go func() {
+			defer GinkgoRecover()
+			res, _ := Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(1))
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			endWG.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		res, _ := Request(LISTENER_8080_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		endWG.Wait()
+		Eventually(func() int {
+			res, _ := Request(LISTENER_8080_URL).Get()
+			return res.StatusCode
+		}).Should(Equal(http.StatusOK))
+	})
+
+	It("Admits no more than the limit out of a concurrent burst", func() {
+		wg := &sync.WaitGroup{}
+		statuses := make(chan int, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				res, _ := Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(1))
+				statuses <- res.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		admitted := 0
+		for status := range statuses {
+			if status == http.StatusOK {
+				admitted++
+			} else {
+				Expect(status).To(Equal(http.StatusServiceUnavailable))
+			}
+		}
+		Expect(admitted).To(Equal(1))
+	})
+
+	It("AIMD limit grows on success and backs off on drops", func() {
+		limiter := NewConcurrencyLimiter(&AdaptiveConcurrencyYAMLConfig{
+			Algorithm:          LIMITER_ALGORITHM_AIMD,
+			InitialLimit:       10,
+			LatencyThresholdMs: 100,
+		})
+		limiter.OnSample(10*time.Millisecond, 10, false)
+		Expect(limiter.Limit()).To(Equal(11))
+
+		// Limit is not grown while mostly unused
+		limiter.OnSample(10*time.Millisecond, 1, false)
+		Expect(limiter.Limit()).To(Equal(11))
+
+		limiter.OnSample(10*time.Millisecond, 10, true)
+		Expect(limiter.Limit()).To(Equal(9))
+
+		limiter.OnSample(200*time.Millisecond, 10, false)
+		Expect(limiter.Limit()).To(Equal(8))
+	})
+
+	It("Gradient limit shrinks when latency rises", func() {
+		limiter := NewConcurrencyLimiter(&AdaptiveConcurrencyYAMLConfig{
+			Algorithm:    LIMITER_ALGORITHM_GRADIENT,
+			InitialLimit: 50,
+		})
+		for i := 0; i < 50; i++ {
+			limiter.OnSample(10*time.Millisecond, 50, false)
+		}
+		steadyLimit := limiter.Limit()
+		Expect(steadyLimit).To(BeNumerically(">=", 50))
+
+		for i := 0; i < 50; i++ {
+			limiter.OnSample(100*time.Millisecond, int64(limiter.Limit()), false)
+		}
+		Expect(limiter.Limit()).To(BeNumerically("<", steadyLimit))
+	})
+})
@@ -0,0 +1,124 @@
+package testing_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+const ADMIN_TOKEN = "secret-admin-token"
+
+func GetAdminAPI(path string, token string, value any) int {
+	req, _ := http.NewRequest("GET", ADMIN_URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0
+	}
+	defer res.Body.Close()
+	if value != nil {
+		json.NewDecoder(res.Body).Decode(value)
+	}
+	return res.StatusCode
+}
+
+var _ = Describe("Admin API", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/api"
+        mode: "RoundRobin"
+        id: "api-balancer"
+        targets:
+          - address: http://localhost:8091
+            weight: 3
+            maxConnections: 10
+      - routeprefix: "/down"
+        mode: "RoundRobin"
+        id: "down-balancer"
+        targets:
+          - address: http://localhost:8099
+  - protocol: http
+    port: 8081
+    routes:
+      - routeprefix: "/"
+        mode: "Random"
+        id: "other-balancer"
+        targets:
+          - address: http://localhost:8091
+admin:
+  port: 8070
+  token: ` + ADMIN_TOKEN,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Requires bearer token", func() {
+		Expect(GetAdminAPI("api/listeners", "", nil)).To(Equal(http.StatusUnauthorized))
+		Expect(GetAdminAPI("api/listeners", "wrong-token", nil)).To(Equal(http.StatusUnauthorized))
+		Expect(GetAdminAPI("metrics", "", nil)).To(Equal(http.StatusUnauthorized))
+		Expect(GetAdminAPI("metrics", ADMIN_TOKEN, nil)).To(Equal(http.StatusOK))
+	})
+
+	It("Lists listeners", func() {
+		listeners := []ListenerView{}
+		Expect(GetAdminAPI("api/listeners", ADMIN_TOKEN, &listeners)).To(Equal(http.StatusOK))
+		Expect(listeners).To(HaveLen(2))
+		Expect(listeners[0].Name).To(Equal("http:8080"))
+		Expect(listeners[0].State).To(Equal("active"))
+		Expect(listeners[0].Balancers).To(Equal([]string{"api-balancer", "down-balancer"}))
+		Expect(listeners[1].Balancers).To(Equal([]string{"other-balancer"}))
+	})
+
+	It("Lists balancers and targets with recent errors", func() {
+		res, _ := Request(LISTENER_8080_URL + "down").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+
+		balancers := []BalancerView{}
+		Expect(GetAdminAPI("api/balancers", ADMIN_TOKEN, &balancers)).To(Equal(http.StatusOK))
+		Expect(balancers).To(HaveLen(3))
+
+		api := balancers[0]
+		Expect(api.Id).To(Equal("api-balancer"))
+		Expect(api.Listener).To(Equal("http:8080"))
+		Expect(api.Mode).To(Equal("RoundRobin"))
+		Expect(api.RoutePrefix).To(Equal("/api"))
+		Expect(api.State).To(Equal("active"))
+		Expect(api.Targets).To(Equal([]TargetView{{
+			Address:        "http://localhost:8091",
+			Weight:         3,
+			Alive:          true,
+			MaxConnections: 10,
+		}}))
+
+		down := BalancerView{}
+		Expect(GetAdminAPI("api/balancers/down-balancer", ADMIN_TOKEN, &down)).To(Equal(http.StatusOK))
+		Expect(down.Targets).To(HaveLen(1))
+		Expect(down.Targets[0].Alive).To(BeFalse())
+		Expect(down.Targets[0].RecentErrors).To(Equal(int64(1)))
+
+		Expect(GetAdminAPI("api/balancers/missing", ADMIN_TOKEN, nil)).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,129 @@
+package testing_test
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Admission Control", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "limited-balancer"
+        maxConnections: 1
+        maxQueueSize: 1
+        maxQueueTime: 1
+        targets:
+          - address: http://localhost:8091
+      - routeprefix: "/patient"
+        mode: "RoundRobin"
+        id: "patient-balancer"
+        maxTargetConnections: 1
+        maxQueueTime: 3
+        targets:
+          - address: http://localhost:8091`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Rejects requests when queue overflows or wait expires", func() {
+		admission := LbTestService.BalancersIdReference["limited-balancer"].Admission
+		endWG := &sync.WaitGroup{}
+		endWG.Add(2)
+
+		go func() {
+			defer GinkgoRecover()
+			res, _ := Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(2))
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			endWG.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		go func() {
+			defer GinkgoRecover()
+			res, _ := Request(LISTENER_8080_URL).Get()
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			endWG.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		Expect(admission.QueueDepth()).To(Equal(1))
+
+		// Queue is already full
+		res, _ := Request(LISTENER_8080_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		endWG.Wait()
+		stats := admission.Stats()
+		Expect(stats.Rejected).To(Equal(int64(1)))
+		Expect(stats.TimedOut).To(Equal(int64(1)))
+		Expect(stats.QueueDepth).To(Equal(0))
+		Expect(stats.MaxWaitTime).To(BeNumerically(">=", time.Second))
+	})
+
+	It("Admits queued requests once a slot is released", func() {
+		admission := LbTestService.BalancersIdReference["patient-balancer"].Admission
+		endWG := &sync.WaitGroup{}
+		endWG.Add(1)
+
+		go func() {
+			defer GinkgoRecover()
+			res, _ := Request(LISTENER_8080_URL + "patient").Post(GetDelayedRequestPayload(1))
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			endWG.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		res, body := Request(LISTENER_8080_URL + "patient").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(1))
+
+		endWG.Wait()
+		stats := admission.Stats()
+		Expect(stats.Queued).To(Equal(int64(1)))
+		Expect(stats.Admitted).To(Equal(int64(2)))
+		Eventually(func() int64 {
+			return admission.Stats().InFlight
+		}).Should(Equal(int64(0)))
+	})
+
+	It("Admits queued requests once a target is brought back up", func() {
+		balancer := LbTestService.BalancersIdReference["patient-balancer"]
+		target := balancer.Targets[0]
+		target.MarkAsUnreachable()
+
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			target.MarkAsReachable()
+		}()
+		start := time.Now()
+		res, body := Request(LISTENER_8080_URL + "patient").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(1))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(balancer.Admission.Stats().Queued).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,339 @@
+package testing_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Config Validation", func() {
+	ParseErrors := func(contents string) ConfigErrors {
+		cnf, err := ParseConfig([]byte(contents))
+		Expect(cnf).To(BeNil())
+		Expect(err).To(BeAssignableToTypeOf(ConfigErrors{}))
+		return err.(ConfigErrors)
+	}
+
+	It("Fills in defaults", func() {
+		cnf, err := ParseConfig([]byte(`listeners:
+  - routes:
+      - targets:
+          - address: http://localhost:8091`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cnf.Listeners[0].Protocol).To(Equal(LS_PROTOCOL_HTTP))
+		Expect(cnf.Listeners[0].Port).To(Equal(DefaultListenerPort))
+		route := cnf.Listeners[0].Routes[0]
+		Expect(route.Id).To(HaveLen(AUTO_GENERATED_BALANCER_ID_LENGTH))
+		Expect(route.Mode).To(Equal(DefaultLoadBalancerType))
+		Expect(route.Routeprefix).To(Equal(DefaultRoutePrefix))
+	})
+
+	It("Reports unknown fields with their position", func() {
+		errs := ParseErrors(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mdoe: "RoundRobin"
+        targets:
+          - address: http://localhost:8091`)
+		Expect(errs).To(HaveLen(1))
+		Expect(*errs[0]).To(Equal(ConfigError{
+			Line:    6,
+			Column:  9,
+			Path:    "listeners[0].routes[0]",
+			Message: "unknown field 'mdoe'",
+		}))
+	})
+
+	It("Reports invalid values, duplicates and target URLs", func() {
+		errs := ParseErrors(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        id: "shared"
+        mode: "Unknown"
+        targets:
+          - address: localhost:8091
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        id: "shared"
+        targets: []`)
+		Expect(errs.Error()).To(ContainSubstring("line 7, column 15: listeners[0].routes[0].mode: mode 'Unknown' is invalid"))
+		Expect(errs.Error()).To(ContainSubstring("line 9, column 22: listeners[0].routes[0].targets[0].address: target address 'localhost:8091' must be an absolute http or https URL"))
+		Expect(errs.Error()).To(ContainSubstring("line 11, column 11: listeners[1].port: port 8080 is already used by listeners[0]"))
+		Expect(errs.Error()).To(ContainSubstring("line 14, column 13: listeners[1].routes[0].id: balancer id 'shared' is already used by listeners[0].routes[0]"))
+		Expect(errs.Error()).To(ContainSubstring("listeners[1].routes[0]: no redirection targets mentioned"))
+		Expect(errs).To(HaveLen(5))
+	})
+
+	It("Requires readable SSL files for https listeners", func() {
+		errs := ParseErrors(`listeners:
+  - protocol: https
+    port: 8443
+    ssl_certificate: /nonexistent/cert.pem
+    routes:
+      - routeprefix: "/"
+        targets:
+          - address: http://localhost:8091`)
+		Expect(errs.Error()).To(ContainSubstring("SSL certificate fields are mandatory"))
+		Expect(errs.Error()).To(ContainSubstring("line 4, column 22: listeners[0].ssl_certificate: file '/nonexistent/cert.pem' can not be read"))
+	})
+
+	It("Reports type errors and invalid YAML with line numbers", func() {
+		errs := ParseErrors(`listeners:
+  - port: 8080
+    maxConnectionsPerIP: many
+    routes:
+      - targets:
+          - address: http://localhost:8091`)
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Line).To(Equal(3))
+		Expect(errs[0].Message).To(ContainSubstring("cannot unmarshal"))
+
+		errs = ParseErrors("listeners:\n  - port: 8080\n    routes: x: y")
+		Expect(errs).To(HaveLen(1))
+		Expect(*errs[0]).To(Equal(ConfigError{Line: 3, Message: "mapping values are not allowed in this context"}))
+	})
+
+	It("Dumps normalized configuration as YAML and JSON", func() {
+		cnf, err := ParseConfig([]byte(`listeners:
+  - routes:
+      - targets:
+          - address: http://localhost:8091`))
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := DumpConfig(cnf, DUMP_FORMAT_YAML)
+		Expect(err).NotTo(HaveOccurred())
+		dumped, err := ParseConfig(contents)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(DumpConfig(dumped, DUMP_FORMAT_YAML)).To(Equal(contents))
+
+		contents, err = DumpConfig(cnf, DUMP_FORMAT_JSON)
+		Expect(err).NotTo(HaveOccurred())
+		document := map[string]any{}
+		Expect(json.Unmarshal(contents, &document)).To(Succeed())
+		route := document["listeners"].([]any)[0].(map[string]any)["routes"].([]any)[0].(map[string]any)
+		Expect(route).To(HaveKeyWithValue("id", cnf.Listeners[0].Routes[0].Id))
+		Expect(route).To(HaveKeyWithValue("mode", DefaultLoadBalancerType))
+		Expect(route).To(HaveKeyWithValue("routeprefix", DefaultRoutePrefix))
+		Expect(route).To(HaveKeyWithValue("targetWaitTimeout", float64(DEFAULT_TARGET_WAIT_TIMEOUT/time.Second)))
+		Expect(route["targets"].([]any)[0]).To(HaveKeyWithValue("weight", float64(DEFAULT_TARGET_WEIGHT)))
+		listener := document["listeners"].([]any)[0].(map[string]any)
+		Expect(listener).To(HaveKeyWithValue("readHeaderTimeoutMs", float64(DEFAULT_LISTENER_READ_HEADER_TIMEOUT/time.Millisecond)))
+		Expect(listener).To(HaveKeyWithValue("idleTimeoutMs", float64(DEFAULT_LISTENER_IDLE_TIMEOUT/time.Millisecond)))
+
+		// Running configuration is left as it was given
+		Expect(cnf.Listeners[0].Routes[0].Targets[0].Weight).To(BeZero())
+
+		_, err = DumpConfig(cnf, "xml")
+		Expect(err).To(MatchError(ContainSubstring("dump format 'xml' is invalid")))
+	})
+
+	It("Interpolates environment variables and secret files", func() {
+		GinkgoT().Setenv("LB_TEST_PORT", "9090")
+		GinkgoT().Setenv("LB_TEST_MAX_CONNECTIONS", "25")
+		configDir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(configDir, "admin-token"), []byte("s3cr3t-token\n"), 0600)).To(Succeed())
+		configFile := filepath.Join(configDir, "config.yaml")
+		Expect(os.WriteFile(configFile, []byte(`admin:
+  port: "8070"
+  token: file://admin-token
+listeners:
+  - port: ${LB_TEST_PORT}
+    maxConnectionsPerIP: ${LB_TEST_MAX_CONNECTIONS}
+    routes:
+      - id: "cost-$$5"
+        targets:
+          - address: http://${LB_TEST_HOST:-localhost}:8091`), 0644)).To(Succeed())
+
+		cnf, err := LoadConfigFromFile(configFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cnf.Listeners[0].Port).To(Equal("9090"))
+		Expect(cnf.Listeners[0].MaxConnectionsPerIP).To(Equal(25))
+		Expect(cnf.Listeners[0].Routes[0].Id).To(Equal("cost-$5"))
+		Expect(cnf.Listeners[0].Routes[0].Targets[0].Address).To(Equal("http://localhost:8091"))
+		Expect(cnf.Admin.Token).To(Equal("s3cr3t-token"))
+
+		Expect(PrettyPrint(cnf)).NotTo(ContainSubstring("s3cr3t-token"))
+		Expect(PrettyPrint(cnf)).To(ContainSubstring(`"Token": "` + REDACTED_VALUE + `"`))
+		contents, err := DumpConfig(cnf, DUMP_FORMAT_YAML)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).NotTo(ContainSubstring("s3cr3t-token"))
+
+		errs := ParseErrors(`admin:
+  port: "8070"
+  token: file:///nonexistent/token
+listeners:
+  - port: ${LB_TEST_UNSET_PORT}
+    routes:
+      - targets:
+          - address: http://localhost:8091`)
+		Expect(errs.Error()).To(ContainSubstring("line 3, column 10: admin.token: secret file '/nonexistent/token' can not be read"))
+		Expect(errs.Error()).To(ContainSubstring("line 5, column 11: listeners[0].port: environment variable 'LB_TEST_UNSET_PORT' is not set"))
+	})
+
+	It("Redacts secrets by their position in configuration", func() {
+		configDir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(configDir, "api-key"), []byte("shared-value"), 0600)).To(Succeed())
+		configFile := filepath.Join(configDir, "config.yaml")
+		Expect(os.WriteFile(configFile, []byte(`include: routes.yaml
+admin:
+  port: "8070"
+  token: admin-token
+listeners:
+  - port: 8080
+    routes:
+      - id: shared-value
+        targets:
+          - address: http://localhost:8091`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(configDir, "routes.yaml"), []byte(`listeners:
+  - port: 8081
+    routes:
+      - customHeaders:
+          - method: any
+            headers:
+              - name: X-Api-Key
+                value: file://api-key
+        targets:
+          - consul:
+              address: http://localhost:8500
+              service: api
+              token: consul-token`), 0644)).To(Succeed())
+
+		cnf, err := LoadConfigFromFile(configFile)
+		Expect(err).NotTo(HaveOccurred())
+		contents, err := DumpConfig(cnf, DUMP_FORMAT_YAML)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).NotTo(ContainSubstring("admin-token"))
+		Expect(string(contents)).NotTo(ContainSubstring("consul-token"))
+		// Secret read from file is redacted where it was loaded, not where the same value is set
+		Expect(string(contents)).To(ContainSubstring("id: shared-value"))
+		Expect(string(contents)).To(ContainSubstring("value: '" + REDACTED_VALUE + "'"))
+		Expect(PrettyPrint(cnf)).To(ContainSubstring(`"Id": "shared-value"`))
+		Expect(PrettyPrint(cnf)).To(ContainSubstring(`"Value": "` + REDACTED_VALUE + `"`))
+
+		// Secrets of configuration loaded before are not redacted in another one
+		other, err := ParseConfig([]byte(`listeners:
+  - routes:
+      - id: admin-token
+        targets:
+          - address: http://localhost:8091`))
+		Expect(err).NotTo(HaveOccurred())
+		contents, err = DumpConfig(other, DUMP_FORMAT_YAML)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(ContainSubstring("id: admin-token"))
+	})
+
+	It("Reports include cycles and conflicting sections with their files", func() {
+		configDir := GinkgoT().TempDir()
+		WriteFile := func(name string, contents string) string {
+			file := filepath.Join(configDir, name)
+			Expect(os.WriteFile(file, []byte(contents), 0644)).To(Succeed())
+			return file
+		}
+		configFile := WriteFile("config.yaml", `include: "part-*.yaml"
+admin:
+  port: "8070"
+listeners:
+  - port: 8080
+    routes:
+      - upstream: missing`)
+		partFile := WriteFile("part-a.yaml", `include: config.yaml
+admin:
+  port: "8071"`)
+
+		_, err := LoadConfigFromFile(configFile)
+		Expect(err).To(BeAssignableToTypeOf(ConfigErrors{}))
+		errs := err.(ConfigErrors)
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0].Error()).To(Equal(partFile + ": line 1, column 10: include: include cycle: " + configFile + " -> " + partFile + " -> " + configFile))
+		Expect(errs[1].Error()).To(Equal(partFile + ": line 2, column 1: section 'admin' is already defined in " + configFile + ", line 3"))
+
+		WriteFile("part-a.yaml", `upstreams:
+  shared:
+    targets:
+      - address: http://localhost:8091`)
+		_, err = LoadConfigFromFile(configFile)
+		Expect(err.Error()).To(Equal(configFile + ": line 7, column 19: listeners[0].routes[0].upstream: upstream 'missing' is not defined"))
+	})
+
+	It("Loads JSON and TOML configuration", func() {
+		configDir := GinkgoT().TempDir()
+		jsonFile := filepath.Join(configDir, "config.json")
+		Expect(os.WriteFile(jsonFile, []byte(`{
+  "include": "routes.toml",
+  "admin": {"port": 8070}
+}`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(configDir, "routes.toml"), []byte(`[[listeners]]
+port = 8080
+
+[[listeners.routes]]
+routeprefix = "/"
+mode = "WeightedRoundRobin"
+
+[[listeners.routes.targets]]
+address = "http://localhost:8091"
+weight = 3
+`), 0644)).To(Succeed())
+
+		cnf, err := LoadConfigFromFile(jsonFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cnf.Admin.Port).To(Equal("8070"))
+		Expect(cnf.Listeners[0].Port).To(Equal("8080"))
+		Expect(cnf.Listeners[0].Routes[0].Mode).To(Equal(LB_MODE_WEIGHTED_ROUNDROBIN))
+		Expect(cnf.Listeners[0].Routes[0].Targets[0].Weight).To(Equal(3))
+
+		_, err = ParseConfigAs([]byte(`{
+  "listeners": [
+    {"port": 8080, "routes": [{"mode": "Unknown"}]}
+  ]
+}`), CONFIG_FORMAT_JSON)
+		Expect(err).To(MatchError(ContainSubstring("line 3, column 40: listeners[0].routes[0].mode: ")))
+
+		_, err = ParseConfigAs([]byte(`[[listeners]]
+port = 8080
+prot = "http"`), CONFIG_FORMAT_TOML)
+		Expect(err).To(MatchError(ContainSubstring("listeners[0]: unknown field 'prot'")))
+	})
+
+	It("Publishes JSON schema of configuration", func() {
+		schema := map[string]any{}
+		Expect(json.Unmarshal(ConfigSchema(), &schema)).To(Succeed())
+		Expect(schema).To(HaveKeyWithValue("additionalProperties", false))
+		Expect(schema["properties"]).To(HaveKey("include"))
+		Expect(schema["properties"]).To(HaveKeyWithValue("listeners", HaveKeyWithValue("items", HaveKeyWithValue("$ref", "#/$defs/Listener"))))
+		defs := schema["$defs"].(map[string]any)
+		Expect(defs["Route"]).To(HaveKeyWithValue("properties", HaveKeyWithValue("mode", HaveKeyWithValue("enum", ContainElement(LB_MODE_ROUNDROBIN)))))
+		Expect(defs["Route"]).To(HaveKeyWithValue("properties", HaveKey("customHeaders")))
+		Expect(defs).To(HaveKey("Upstream"))
+	})
+
+	It("Returns error for missing file and refuses to start on invalid config", func() {
+		_, err := LoadConfigFromFile(filepath.Join(GinkgoT().TempDir(), "missing.yaml"))
+		Expect(err).To(MatchError(ContainSubstring("configuration file not found")))
+
+		LbTestService := LoadBalancerService{}
+		err = LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - port: 8080
+    routes:
+      - mode: "Unknown"
+        targets:
+          - address: http://localhost:8091`,
+		})
+		Expect(err).To(HaveOccurred())
+		LbTestService.Apply()
+		Expect(LbTestService.GetListeners()).To(BeEmpty())
+		LbTestService.Stop()
+	})
+})
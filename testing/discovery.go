@@ -0,0 +1,658 @@
+package testing_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Name server answering queries from records set by test
+type TestNameServer struct {
+	Addr    string
+	conn    net.PacketConn
+	records map[dnsmessage.Type]map[string][]dnsmessage.ResourceBody
+	mu      sync.Mutex
+}
+
+func StartTestNameServer() *TestNameServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	ns := &TestNameServer{
+		Addr:    conn.LocalAddr().String(),
+		conn:    conn,
+		records: map[dnsmessage.Type]map[string][]dnsmessage.ResourceBody{},
+	}
+	go ns.serve()
+	return ns
+}
+
+// Replaces records of given name and type
+func (ns *TestNameServer) SetRecords(name string, recordType dnsmessage.Type, records ...dnsmessage.ResourceBody) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.records[recordType] == nil {
+		ns.records[recordType] = map[string][]dnsmessage.ResourceBody{}
+	}
+	ns.records[recordType][name] = records
+}
+
+func (ns *TestNameServer) serve() {
+	buffer := make([]byte, 512)
+	for {
+		length, addr, err := ns.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		query := dnsmessage.Message{}
+		if query.Unpack(buffer[:length]) != nil || len(query.Questions) != 1 {
+			continue
+		}
+		question := query.Questions[0]
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+			Questions: query.Questions,
+		}
+		ns.mu.Lock()
+		for _, body := range ns.records[question.Type][strings.ToLower(question.Name.String())] {
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 0},
+				Body:   body,
+			})
+		}
+		ns.mu.Unlock()
+		packed, _ := response.Pack()
+		ns.conn.WriteTo(packed, addr)
+	}
+}
+
+func (ns *TestNameServer) Stop() {
+	ns.conn.Close()
+}
+
+func ARecord(ip string) dnsmessage.ResourceBody {
+	record := &dnsmessage.AResource{}
+	copy(record.A[:], net.ParseIP(ip).To4())
+	return record
+}
+
+func SRVRecord(target string, port uint16, weight uint16) dnsmessage.ResourceBody {
+	return &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Weight: weight}
+}
+
+// Instance registered with fake catalog
+type CatalogInstance struct {
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Healthy bool
+}
+
+// Consul-compatible catalog serving health endpoint, with blocking queries
+type FakeCatalog struct {
+	*httptest.Server
+	Token     string
+	instances map[string][]CatalogInstance
+	index     uint64
+	// Closed and replaced whenever instances change
+	changed chan struct{}
+	stop    chan struct{}
+	mu      sync.Mutex
+}
+
+func StartFakeCatalog(token string) *FakeCatalog {
+	catalog := &FakeCatalog{
+		Token:     token,
+		instances: map[string][]CatalogInstance{},
+		index:     1,
+		changed:   make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	catalog.Server = httptest.NewServer(http.HandlerFunc(catalog.serveHealth))
+	return catalog
+}
+
+func (fc *FakeCatalog) SetInstances(service string, instances ...CatalogInstance) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.instances[service] = instances
+	fc.index++
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+}
+
+func (fc *FakeCatalog) serveHealth(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-Consul-Token") != fc.Token {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	service := strings.TrimPrefix(req.URL.Path, "/v1/health/service/")
+	index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(req.URL.Query().Get("wait"))
+
+	fc.mu.Lock()
+	current, changed := fc.index, fc.changed
+	fc.mu.Unlock()
+	if index == current && wait > 0 {
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-fc.stop:
+		case <-req.Context().Done():
+		}
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	entries := []any{}
+	for _, instance := range fc.instances[service] {
+		if req.URL.Query().Get("passing") == "true" && !instance.Healthy {
+			continue
+		}
+		tagged := map[string]bool{}
+		for _, tag := range instance.Tags {
+			tagged[tag] = true
+		}
+		matches := true
+		for _, tag := range req.URL.Query()["tag"] {
+			matches = matches && tagged[tag]
+		}
+		if !matches {
+			continue
+		}
+		entries = append(entries, map[string]any{
+			"Node":    map[string]any{"Node": "node", "Address": "127.0.0.1"},
+			"Service": map[string]any{"Service": service, "Port": instance.Port, "Tags": instance.Tags, "Meta": instance.Meta, "Weights": map[string]any{"Passing": 1}},
+		})
+	}
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(fc.index, 10))
+	json.NewEncoder(rw).Encode(entries)
+}
+
+func (fc *FakeCatalog) Stop() {
+	close(fc.stop)
+	fc.Server.Close()
+}
+
+type KubeEndpoint struct {
+	IP          string
+	Ready       bool
+	Terminating bool
+	Zone        string
+}
+
+type kubeEvent struct {
+	Version int
+	Type    string
+	Slice   map[string]any
+}
+
+// Kubernetes API server serving EndpointSlices of one namespace, with list and watch
+type FakeAPIServer struct {
+	*httptest.Server
+	Token     string
+	Namespace string
+	events    []kubeEvent
+	// Closed and replaced whenever a slice changes
+	changed chan struct{}
+	stop    chan struct{}
+	mu      sync.Mutex
+}
+
+func StartFakeAPIServer(token string, namespace string) *FakeAPIServer {
+	apiServer := &FakeAPIServer{Token: token, Namespace: namespace, changed: make(chan struct{}), stop: make(chan struct{})}
+	apiServer.Server = httptest.NewTLSServer(http.HandlerFunc(apiServer.serveEndpointSlices))
+	return apiServer
+}
+
+// Writes kubeconfig trusting certificate of API server, returning its path
+func (as *FakeAPIServer) WriteKubeconfig(dir string) string {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: as.Certificate().Raw})
+	path := filepath.Join(dir, "kubeconfig")
+	Expect(os.WriteFile(path, []byte(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+  - name: test-cluster
+    cluster:
+      server: `+as.URL+`
+      certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+users:
+  - name: test-user
+    user:
+      token: `+as.Token+`
+contexts:
+  - name: test
+    context:
+      cluster: test-cluster
+      user: test-user
+      namespace: `+as.Namespace), 0600)).To(Succeed())
+	return path
+}
+
+// Creates or replaces slice of service
+func (as *FakeAPIServer) SetSlice(service string, name string, port int, endpoints ...KubeEndpoint) {
+	items := []any{}
+	for _, endpoint := range endpoints {
+		items = append(items, map[string]any{
+			"addresses":  []string{endpoint.IP},
+			"conditions": map[string]any{"ready": endpoint.Ready, "serving": endpoint.Ready || endpoint.Terminating, "terminating": endpoint.Terminating},
+			"zone":       endpoint.Zone,
+		})
+	}
+	as.record("MODIFIED", map[string]any{
+		"metadata":    map[string]any{"name": name, "labels": map[string]any{"kubernetes.io/service-name": service}},
+		"addressType": "IPv4",
+		"endpoints":   items,
+		"ports":       []any{map[string]any{"name": "http", "port": port, "protocol": "TCP"}},
+	})
+}
+
+func (as *FakeAPIServer) DeleteSlice(service string, name string) {
+	as.record("DELETED", map[string]any{
+		"metadata": map[string]any{"name": name, "labels": map[string]any{"kubernetes.io/service-name": service}},
+	})
+}
+
+func (as *FakeAPIServer) record(eventType string, slice map[string]any) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	version := len(as.events) + 1
+	slice["metadata"].(map[string]any)["resourceVersion"] = strconv.Itoa(version)
+	as.events = append(as.events, kubeEvent{Version: version, Type: eventType, Slice: slice})
+	close(as.changed)
+	as.changed = make(chan struct{})
+}
+
+func (as *FakeAPIServer) serveEndpointSlices(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+as.Token {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/"+as.Namespace+"/endpointslices" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	service := strings.TrimPrefix(req.URL.Query().Get("labelSelector"), "kubernetes.io/service-name=")
+	ofService := func(event kubeEvent) bool {
+		labels := event.Slice["metadata"].(map[string]any)["labels"].(map[string]any)
+		return labels["kubernetes.io/service-name"] == service
+	}
+
+	if req.URL.Query().Get("watch") != "true" {
+		as.mu.Lock()
+		defer as.mu.Unlock()
+		slices := map[string]map[string]any{}
+		for _, event := range as.events {
+			name := event.Slice["metadata"].(map[string]any)["name"].(string)
+			if event.Type == "DELETED" || !ofService(event) {
+				delete(slices, name)
+			} else {
+				slices[name] = event.Slice
+			}
+		}
+		items := []any{}
+		for _, slice := range slices {
+			items = append(items, slice)
+		}
+		json.NewEncoder(rw).Encode(map[string]any{
+			"metadata": map[string]any{"resourceVersion": strconv.Itoa(len(as.events))},
+			"items":    items,
+		})
+		return
+	}
+
+	sent, _ := strconv.Atoi(req.URL.Query().Get("resourceVersion"))
+	encoder := json.NewEncoder(rw)
+	for {
+		as.mu.Lock()
+		events, changed := as.events[sent:], as.changed
+		as.mu.Unlock()
+		for _, event := range events {
+			sent = event.Version
+			if ofService(event) {
+				encoder.Encode(map[string]any{"type": event.Type, "object": event.Slice})
+			}
+		}
+		rw.(http.Flusher).Flush()
+		select {
+		case <-changed:
+		case <-as.stop:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (as *FakeAPIServer) Stop() {
+	close(as.stop)
+	as.Server.Close()
+}
+
+var _ = Describe("Target Discovery", func() {
+	var LbTestService LoadBalancerService
+	var NameServer *TestNameServer
+
+	TargetAddresses := func(balancerId string) func() []string {
+		return func() []string {
+			addresses := []string{}
+			for _, target := range LbTestService.GetBalancer(balancerId).GetTargets() {
+				addresses = append(addresses, target.Address)
+			}
+			return addresses
+		}
+	}
+
+	BeforeEach(func() {
+		StartTestServers(3)
+		NameServer = StartTestNameServer()
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+		NameServer.Stop()
+	})
+
+	It("Resolves A records and follows their changes", func() {
+		NameServer.SetRecords("api.test.", dnsmessage.TypeA, ARecord("127.0.0.1"))
+		configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(configFile, []byte(`listeners:
+  - port: 8080
+    routes:
+      - id: "dns-balancer"
+        targets:
+          - dns:
+              name: api.test
+              port: 8091
+              server: `+NameServer.Addr+`
+              minIntervalMs: 50
+            drainTimeoutMs: 1000`), 0644)).To(Succeed())
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode:          DebugMode,
+			YAMLConfigFilePath: configFile,
+		})
+		LbTestService.Apply()
+
+		Eventually(TargetAddresses("dns-balancer"), time.Second).Should(Equal([]string{"http://127.0.0.1:8091"}))
+		_, body := Request(LISTENER_8080_URL).Get()
+		Expect(body.ReplicaId).To(Equal(1))
+		balancer := LbTestService.GetBalancer("dns-balancer")
+		first := balancer.FindTarget("http://127.0.0.1:8091")
+
+		// Unchanged address keeps its target and counters
+		NameServer.SetRecords("api.test.", dnsmessage.TypeA, ARecord("127.0.0.1"), ARecord("127.0.0.2"))
+		Eventually(TargetAddresses("dns-balancer"), time.Second).Should(ConsistOf("http://127.0.0.1:8091", "http://127.0.0.2:8091"))
+		Expect(balancer.FindTarget("http://127.0.0.1:8091")).To(BeIdenticalTo(first))
+
+		// Removed address is drained, then removed
+		NameServer.SetRecords("api.test.", dnsmessage.TypeA, ARecord("127.0.0.2"))
+		Eventually(TargetAddresses("dns-balancer"), time.Second).Should(Equal([]string{"http://127.0.0.2:8091"}))
+
+		// Failed resolution keeps targets
+		NameServer.Stop()
+		Consistently(TargetAddresses("dns-balancer"), 300*time.Millisecond).Should(Equal([]string{"http://127.0.0.2:8091"}))
+	})
+
+	It("Resolves SRV records into targets with their ports and weights", func() {
+		NameServer.SetRecords("_http._tcp.api.test.", dnsmessage.TypeSRV, SRVRecord("node.test.", 8092, 3), SRVRecord("node.test.", 8093, 1))
+		NameServer.SetRecords("node.test.", dnsmessage.TypeA, ARecord("127.0.0.1"))
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `upstreams:
+  discovered:
+    mode: "WeightedRoundRobin"
+    targets:
+      - dns:
+          name: _http._tcp.api.test
+          type: SRV
+          server: ` + NameServer.Addr + `
+          minIntervalMs: 50
+listeners:
+  - port: 8080
+    routes:
+      - id: "srv-balancer"
+        upstream: discovered`,
+		})
+		LbTestService.Apply()
+
+		Eventually(TargetAddresses("srv-balancer"), time.Second).Should(ConsistOf("http://127.0.0.1:8092", "http://127.0.0.1:8093"))
+		upstream := LbTestService.GetUpstream("discovered")
+		Expect(upstream.FindTarget("http://127.0.0.1:8092").Weight).To(Equal(3))
+		Expect(upstream.FindTarget("http://127.0.0.1:8093").Weight).To(Equal(1))
+
+		// Weight changes are applied in place, before targets found later are added
+		target := upstream.FindTarget("http://127.0.0.1:8093")
+		NameServer.SetRecords("_http._tcp.api.test.", dnsmessage.TypeSRV, SRVRecord("node.test.", 8093, 2), SRVRecord("node.test.", 8091, 1))
+		Eventually(TargetAddresses("srv-balancer"), time.Second).Should(ConsistOf("http://127.0.0.1:8093", "http://127.0.0.1:8091"))
+		Expect(upstream.FindTarget("http://127.0.0.1:8093")).To(BeIdenticalTo(target))
+		Expect(target.Weight).To(Equal(2))
+
+		res, _ := Request(LISTENER_8080_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("Reads targets from a watched file and keeps the last valid list", func() {
+		configDir := GinkgoT().TempDir()
+		WriteTargets := func(contents string) {
+			// Replaced by rename, as deploy tooling is expected to do
+			Expect(os.WriteFile(filepath.Join(configDir, "targets.tmp"), []byte(contents), 0644)).To(Succeed())
+			Expect(os.Rename(filepath.Join(configDir, "targets.tmp"), filepath.Join(configDir, "targets.json"))).To(Succeed())
+		}
+		WriteTargets(`[
+  {"address": "http://localhost:8091", "weight": 2, "labels": {"zone": "a"}},
+  {"address": "http://localhost:8092"}
+]`)
+		configFile := filepath.Join(configDir, "config.yaml")
+		Expect(os.WriteFile(configFile, []byte(`listeners:
+  - port: 8080
+    routes:
+      - id: "file-balancer"
+        mode: "WeightedRoundRobin"
+        targets:
+          - file:
+              path: targets.json
+              intervalMs: 50
+            maxConnections: 10`), 0644)).To(Succeed())
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode:          DebugMode,
+			YAMLConfigFilePath: configFile,
+		})
+		LbTestService.Apply()
+
+		Eventually(TargetAddresses("file-balancer"), time.Second).Should(ConsistOf("http://localhost:8091", "http://localhost:8092"))
+		balancer := LbTestService.GetBalancer("file-balancer")
+		first := balancer.FindTarget("http://localhost:8091")
+		Expect(first.Weight).To(Equal(2))
+		Expect(first.MaxConnections).To(Equal(int64(10)))
+		Expect(first.Labels).To(Equal(map[string]string{"zone": "a"}))
+
+		WriteTargets(`- address: http://localhost:8091
+  weight: 2
+  labels:
+    zone: a
+- address: http://localhost:8093`)
+		Eventually(TargetAddresses("file-balancer"), time.Second).Should(ConsistOf("http://localhost:8091", "http://localhost:8093"))
+		Expect(balancer.FindTarget("http://localhost:8091")).To(BeIdenticalTo(first))
+
+		// Targets whose labels changed are replaced together, never leaving balancer with some of them
+		stop := make(chan struct{})
+		partial := make(chan int, 1)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if targets := len(balancer.GetTargets()); targets != 2 {
+					select {
+					case partial <- targets:
+					default:
+					}
+				}
+			}
+		}()
+		WriteTargets(`[
+  {"address": "http://localhost:8091", "weight": 2, "labels": {"zone": "b"}},
+  {"address": "http://localhost:8093", "labels": {"zone": "b"}}
+]`)
+		Eventually(func() map[string]string {
+			return balancer.FindTarget("http://localhost:8093").Labels
+		}, time.Second).Should(Equal(map[string]string{"zone": "b"}))
+		close(stop)
+		Expect(partial).NotTo(Receive())
+		Expect(balancer.FindTarget("http://localhost:8091").Labels).To(Equal(map[string]string{"zone": "b"}))
+
+		// Malformed and invalid updates are ignored as a whole, and so are empty and truncated files
+		for _, contents := range []string{"", "# targets\n", `[{"address": "http://localhost:8092"`, `[{"address": "http://localhost:8092"}, {"address": "localhost:8091"}]`, `[{"adress": "http://localhost:8092"}]`} {
+			WriteTargets(contents)
+			Consistently(TargetAddresses("file-balancer"), 200*time.Millisecond).Should(ConsistOf("http://localhost:8091", "http://localhost:8093"))
+		}
+
+		WriteTargets(`[]`)
+		Eventually(TargetAddresses("file-balancer"), time.Second).Should(BeEmpty())
+	})
+
+	It("Follows healthy instances registered with catalog and survives its outage", func() {
+		catalog := StartFakeCatalog("catalog-token")
+		catalog.SetInstances("api",
+			CatalogInstance{Port: 8091, Tags: []string{"primary"}, Meta: map[string]string{"weight": "3", "zone": "a"}, Healthy: true},
+			CatalogInstance{Port: 8092, Tags: []string{"primary"}, Healthy: true},
+			CatalogInstance{Port: 8093, Tags: []string{"canary"}, Healthy: true},
+		)
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - port: 8080
+    routes:
+      - id: "catalog-balancer"
+        mode: "WeightedRoundRobin"
+        targets:
+          - consul:
+              address: ` + catalog.URL + `
+              service: api
+              tags: ["primary"]
+              token: catalog-token
+              waitMs: 5000
+              retryIntervalMs: 50`,
+		})
+		LbTestService.Apply()
+
+		Eventually(TargetAddresses("catalog-balancer"), time.Second).Should(ConsistOf("http://127.0.0.1:8091", "http://127.0.0.1:8092"))
+		balancer := LbTestService.GetBalancer("catalog-balancer")
+		first := balancer.FindTarget("http://127.0.0.1:8091")
+		Expect(first.Weight).To(Equal(3))
+		Expect(first.Labels).To(HaveKeyWithValue("zone", "a"))
+
+		// Blocking query returns as soon as instance fails its checks
+		catalog.SetInstances("api",
+			CatalogInstance{Port: 8091, Tags: []string{"primary"}, Meta: map[string]string{"weight": "3", "zone": "a"}, Healthy: true},
+			CatalogInstance{Port: 8092, Tags: []string{"primary"}, Healthy: false},
+		)
+		Eventually(TargetAddresses("catalog-balancer"), 500*time.Millisecond).Should(Equal([]string{"http://127.0.0.1:8091"}))
+		Expect(balancer.FindTarget("http://127.0.0.1:8091")).To(BeIdenticalTo(first))
+
+		catalog.Stop()
+		Consistently(TargetAddresses("catalog-balancer"), 300*time.Millisecond).Should(Equal([]string{"http://127.0.0.1:8091"}))
+		_, body := Request(LISTENER_8080_URL).Get()
+		Expect(body.ReplicaId).To(Equal(1))
+	})
+
+	It("Follows ready endpoints of Kubernetes service and drains terminating ones", func() {
+		apiServer := StartFakeAPIServer("service-account-token", "shop")
+		defer apiServer.Stop()
+		apiServer.SetSlice("api", "api-a", 8091, KubeEndpoint{IP: "127.0.0.1", Ready: true, Zone: "zone-a"})
+		apiServer.SetSlice("api", "api-b", 8092, KubeEndpoint{IP: "127.0.0.1", Ready: true}, KubeEndpoint{IP: "127.0.0.2", Ready: false})
+		apiServer.SetSlice("other", "other-a", 8093, KubeEndpoint{IP: "127.0.0.1", Ready: true})
+		kubeconfig := apiServer.WriteKubeconfig(GinkgoT().TempDir())
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: fmt.Sprintf(`listeners:
+  - port: 8080
+    routes:
+      - id: "kubernetes-balancer"
+        mode: "WeightedRoundRobin"
+        targets:
+          - kubernetes:
+              service: api
+              port: http
+              kubeconfig: %v
+              retryIntervalMs: 50
+            drainTimeoutMs: 200`, kubeconfig),
+		})
+		LbTestService.Apply()
+
+		Eventually(TargetAddresses("kubernetes-balancer"), time.Second).Should(ConsistOf("http://127.0.0.1:8091", "http://127.0.0.1:8092"))
+		balancer := LbTestService.GetBalancer("kubernetes-balancer")
+		first := balancer.FindTarget("http://127.0.0.1:8091")
+		Expect(first.Labels).To(Equal(map[string]string{"zone": "zone-a"}))
+
+		// Watch delivers changes as they happen
+		apiServer.SetSlice("api", "api-b", 8092, KubeEndpoint{IP: "127.0.0.1", Terminating: true})
+		Eventually(func() bool {
+			return balancer.FindTarget("http://127.0.0.1:8092").IsDraining()
+		}, 500*time.Millisecond).Should(BeTrue())
+		Consistently(TargetAddresses("kubernetes-balancer"), 300*time.Millisecond).Should(ConsistOf("http://127.0.0.1:8091", "http://127.0.0.1:8092"))
+		for i := 0; i < 4; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			Expect(body.ReplicaId).To(Equal(1))
+		}
+
+		apiServer.DeleteSlice("api", "api-b")
+		apiServer.SetSlice("api", "api-c", 8093, KubeEndpoint{IP: "127.0.0.1", Ready: true})
+		Eventually(TargetAddresses("kubernetes-balancer"), time.Second).Should(ConsistOf("http://127.0.0.1:8091", "http://127.0.0.1:8093"))
+		Expect(balancer.FindTarget("http://127.0.0.1:8091")).To(BeIdenticalTo(first))
+	})
+
+	It("Rejects invalid discovery settings", func() {
+		_, err := ParseConfig([]byte(`listeners:
+  - port: 8080
+    routes:
+      - targets:
+          - address: http://localhost:8091
+            dns:
+              name: api.test
+              type: MX
+              server: localhost
+          - file:
+              path: targets.json
+            consul:
+              address: localhost:8500
+          - kubernetes:
+              context: staging
+              scheme: ftp`))
+		Expect(err).To(MatchError(And(
+			ContainSubstring("listeners[0].routes[0].targets[0].address: `address` can not be set on target which is discovered"),
+			ContainSubstring("listeners[0].routes[0].targets[0].dns.type: DNS record type 'MX' is invalid"),
+			ContainSubstring("listeners[0].routes[0].targets[0].dns.port: port '0' is invalid"),
+			ContainSubstring("listeners[0].routes[0].targets[0].dns.server: name server 'localhost' must be given as host:port"),
+			ContainSubstring("listeners[0].routes[0].targets[1]: only one of `consul`, `file` can be set on a target"),
+			ContainSubstring("listeners[0].routes[0].targets[1].consul.address: catalog address 'localhost:8500' must be an absolute http or https URL"),
+			ContainSubstring("listeners[0].routes[0].targets[1].consul: `service` field is mandatory for consul discovery"),
+			ContainSubstring("listeners[0].routes[0].targets[2].kubernetes: `service` field is mandatory for kubernetes discovery"),
+			ContainSubstring("listeners[0].routes[0].targets[2].kubernetes.context: `context` can only be set along with `kubeconfig`"),
+			ContainSubstring("listeners[0].routes[0].targets[2].kubernetes.scheme: scheme 'ftp' is invalid"),
+		)))
+	})
+})
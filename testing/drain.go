@@ -0,0 +1,129 @@
+package testing_test
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Target Drain", func() {
+	var LbTestService LoadBalancerService
+	const targetsPath = "api/balancers/drained-balancer/targets"
+	const firstTarget = "?address=http://localhost:8091"
+
+	GetTarget := func(address string) TargetView {
+		targets := []TargetView{}
+		CallAdminAPI("GET", targetsPath, "", &targets)
+		for _, target := range targets {
+			if target.Address == address {
+				return target
+			}
+		}
+		return TargetView{}
+	}
+
+	// Sends request which replica #1 answers after `delayMs`
+	StartSlowRequest := func(delayMs string, wg *sync.WaitGroup) {
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			res, body := Request(LISTENER_8080_URL + "slow?replica=1&delayMs=" + delayMs).Get()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body.ReplicaId).To(Equal(1))
+		}()
+		Eventually(func() int64 {
+			return GetTarget("http://localhost:8091").Connections
+		}).Should(Equal(int64(1)))
+	}
+
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "drained-balancer"
+        targets:
+          - address: http://localhost:8091
+          - address: http://localhost:8092
+          - address: http://localhost:8093
+            draining: true
+admin:
+  port: 8070
+  token: ` + ADMIN_TOKEN,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(3)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Skips target configured as draining", func() {
+		for i := 0; i < 6; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			Expect(body.ReplicaId).NotTo(Equal(3))
+		}
+		target := GetTarget("http://localhost:8093")
+		Expect(target.Draining).To(BeTrue())
+		Expect(target.Drained).To(BeTrue())
+	})
+
+	It("Lets in-flight requests finish and reports when drained", func() {
+		wg := &sync.WaitGroup{}
+		StartSlowRequest("800", wg)
+
+		target := TargetView{}
+		Expect(CallAdminAPI("PATCH", targetsPath+firstTarget, `{"draining": true}`, &target)).To(Equal(http.StatusOK))
+		Expect(target.Draining).To(BeTrue())
+		Expect(target.Drained).To(BeFalse())
+
+		for i := 0; i < 4; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			Expect(body.ReplicaId).To(Equal(2))
+		}
+
+		wg.Wait()
+		Eventually(func() bool {
+			return GetTarget("http://localhost:8091").Drained
+		}).Should(BeTrue())
+
+		Expect(CallAdminAPI("PATCH", targetsPath+firstTarget, `{"draining": false}`, &target)).To(Equal(http.StatusOK))
+		Expect(target.Draining).To(BeFalse())
+		replicas := map[int]bool{}
+		for i := 0; i < 4; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			replicas[body.ReplicaId] = true
+		}
+		Expect(replicas).To(HaveKey(1))
+	})
+
+	It("Removes target once drain deadline passes", func() {
+		wg := &sync.WaitGroup{}
+		StartSlowRequest("1500", wg)
+
+		Expect(CallAdminAPI("PATCH", targetsPath+firstTarget, `{"draining": true, "drainTimeoutMs": 200}`, nil)).To(Equal(http.StatusOK))
+		Eventually(func() bool {
+			return LbTestService.BalancersIdReference["drained-balancer"].FindTarget("http://localhost:8091") == nil
+		}, 2*time.Second).Should(BeTrue())
+
+		// Request sent before removal still completes
+		wg.Wait()
+	})
+})
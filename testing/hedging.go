@@ -0,0 +1,113 @@
+package testing_test
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Request Hedging", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "hedged-balancer"
+        hedging:
+          delayMs: 100
+          budgetPercent: 100
+        targets:
+          - address: http://localhost:8091
+          - address: http://localhost:8092
+admin:
+  port: 8070`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(2)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Survives client going away in the middle of hedged response", func() {
+		DisconnectMidBody("localhost:8080", "/stream?durationMs=1000")
+		// Give proxy time to fail writing the rest of the body
+		time.Sleep(300 * time.Millisecond)
+
+		res, _ := Request(LISTENER_8080_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("Returns response of the faster target", func() {
+		start := time.Now()
+		res, body := Request(LISTENER_8080_URL + "search?delayMs=1000&replica=1").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(2))
+		Expect(time.Since(start)).To(BeNumerically("<", 900*time.Millisecond))
+
+		hedges, wins := LbTestService.BalancersIdReference["hedged-balancer"].Hedging.Stats()
+		Expect(hedges).To(Equal(int64(1)))
+		Expect(wins).To(Equal(int64(1)))
+
+		// Cancelled target is not marked as unreachable
+		Expect(LbTestService.BalancersIdReference["hedged-balancer"].Targets[0].IsAlive()).To(BeTrue())
+
+		// Request is accounted to target whose response was used
+		Eventually(func() string {
+			_, body := GetAdminPage("metrics")
+			return body
+		}).Should(ContainSubstring(`loadbalancer_requests_total{listener="http:8080",balancer="hedged-balancer",target="http://localhost:8092",status_class="2xx"} 1`))
+	})
+
+	It("Hedges to another target when balancer would pick the primary again", func() {
+		type hedgedResponse struct {
+			status  int
+			replica int
+		}
+		responses := make(chan hedgedResponse, 1)
+		start := time.Now()
+		go func() {
+			defer GinkgoRecover()
+			res, body := Request(LISTENER_8080_URL + "search?delayMs=1000&replica=1").Get()
+			responses <- hedgedResponse{status: res.StatusCode, replica: body.ReplicaId}
+		}()
+		time.Sleep(30 * time.Millisecond)
+		// Moves round robin back to the primary before the hedge is sent
+		_, body := Request(LISTENER_8080_URL + "search").Get()
+		Expect(body.ReplicaId).To(Equal(2))
+
+		response := <-responses
+		Expect(response.status).To(Equal(http.StatusOK))
+		Expect(response.replica).To(Equal(2))
+		Expect(time.Since(start)).To(BeNumerically("<", 900*time.Millisecond))
+	})
+
+	It("Does not hedge fast or non-idempotent requests", func() {
+		res, body := Request(LISTENER_8080_URL + "search").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(1))
+
+		res, body = Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(1))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(2))
+
+		hedges, _ := LbTestService.BalancersIdReference["hedged-balancer"].Hedging.Stats()
+		Expect(hedges).To(Equal(int64(0)))
+	})
+})
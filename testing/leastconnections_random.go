@@ -3,6 +3,7 @@ package testing_test
 import (
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -51,7 +52,7 @@ var _ = Describe("Least Connections - Random Logic", func() {
 		delayedRequestStartSync := &sync.WaitGroup{}
 
 		totalTargets := 3
-		longRequestReplicaNumber := -1
+		longRequestReplicaNumber := int64(-1)
 
 		delayedRequestEndSync.Add(1)
 		delayedRequestStartSync.Add(1)
@@ -63,7 +64,7 @@ var _ = Describe("Least Connections - Random Logic", func() {
 			// Check status code
 			Expect(res.StatusCode).To(Equal(http.StatusOK))
 
-			longRequestReplicaNumber = body.ReplicaId
+			atomic.StoreInt64(&longRequestReplicaNumber, int64(body.ReplicaId))
 			delayedRequestEndSync.Done()
 		}(delayedRequestEndSync)
 
@@ -74,7 +75,7 @@ var _ = Describe("Least Connections - Random Logic", func() {
 			res, body := Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(0))
 			// Check status code
 			Expect(res.StatusCode).To(Equal(http.StatusOK))
-			replicaIdCheck := (body.ReplicaId >= 1 && body.ReplicaId <= totalTargets && body.ReplicaId != longRequestReplicaNumber)
+			replicaIdCheck := (body.ReplicaId >= 1 && body.ReplicaId <= totalTargets && int64(body.ReplicaId) != atomic.LoadInt64(&longRequestReplicaNumber))
 			Expect(replicaIdCheck).To(BeTrue())
 		}
 
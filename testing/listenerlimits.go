@@ -0,0 +1,108 @@
+package testing_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Listener Limits", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    readHeaderTimeoutMs: 200
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        maxRequestBodyBytes: 5
+        targets:
+          - address: http://localhost:8091
+  - protocol: http
+    port: 8081
+    maxConnectionsPerIP: 1
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        targets:
+          - address: http://localhost:8091`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Closes connections of clients sending headers slowly", func() {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = bufio.NewReader(conn).ReadByte()
+		Expect(err).To(HaveOccurred())
+		Expect(os.IsTimeout(err)).To(BeFalse())
+	})
+
+	It("Rejects request bodies over the route limit", func() {
+		res, _ := Request(LISTENER_8080_URL + "delayed").Post(GetDelayedRequestPayload(0))
+		Expect(res.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+
+		res, body := Request(LISTENER_8080_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(1))
+	})
+
+	It("Limits concurrent connections per client IP", func() {
+		first, err := net.Dial("tcp", "localhost:8081")
+		Expect(err).NotTo(HaveOccurred())
+
+		second, err := net.Dial("tcp", "localhost:8081")
+		Expect(err).NotTo(HaveOccurred())
+		defer second.Close()
+		second.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = bufio.NewReader(second).ReadByte()
+		Expect(err).To(HaveOccurred())
+		Expect(os.IsTimeout(err)).To(BeFalse())
+		Expect(LbTestService.Listeners[1].RejectedConnections()).To(Equal(int64(1)))
+
+		// First connection is still served
+		_, err = first.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		res, err := http.ReadResponse(bufio.NewReader(first), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		first.Close()
+
+		Eventually(func() bool {
+			res, err := http.Get(LISTENER_8081_URL)
+			if err != nil {
+				return false
+			}
+			res.Body.Close()
+			return strings.HasPrefix(res.Status, "200")
+		}).Should(BeTrue())
+	})
+})
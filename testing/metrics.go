@@ -0,0 +1,76 @@
+package testing_test
+
+import (
+	"io"
+	"net/http"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+const ADMIN_URL = "http://localhost:8070/"
+
+func GetAdminPage(path string) (int, string) {
+	res, err := http.Get(ADMIN_URL + path)
+	if err != nil {
+		return 0, ""
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+var _ = Describe("Metrics", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/api"
+        mode: "RoundRobin"
+        id: "api-balancer"
+        targets:
+          - address: http://localhost:8091
+admin:
+  port: 8070`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Exposes request, target and rejection metrics", func() {
+		for i := 0; i < 3; i++ {
+			res, _ := Request(LISTENER_8080_URL + "api").Get()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		}
+		Request(LISTENER_8080_URL + "unknown").Get()
+
+		Eventually(func() int {
+			status, _ := GetAdminPage("metrics")
+			return status
+		}).Should(Equal(http.StatusOK))
+
+		_, body := GetAdminPage("metrics")
+		Expect(body).To(ContainSubstring(`loadbalancer_requests_total{listener="http:8080",balancer="api-balancer",target="http://localhost:8091",status_class="2xx"} 3`))
+		Expect(body).To(ContainSubstring(`loadbalancer_request_duration_seconds_count{listener="http:8080",balancer="api-balancer",target="http://localhost:8091",status_class="2xx"} 3`))
+		Expect(body).To(ContainSubstring(`loadbalancer_no_matching_balancer_total{listener="http:8080"} 1`))
+		Expect(body).To(ContainSubstring(`loadbalancer_target_up{listener="http:8080",balancer="api-balancer",target="http://localhost:8091"} 1`))
+		Expect(body).To(ContainSubstring(`loadbalancer_target_connections{listener="http:8080",balancer="api-balancer",target="http://localhost:8091"} 0`))
+		Expect(body).To(ContainSubstring(`loadbalancer_target_wait_timeouts_total{listener="http:8080",balancer="api-balancer"} 0`))
+	})
+})
@@ -0,0 +1,389 @@
+package testing_test
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Configuration Reload", func() {
+	var LbTestService LoadBalancerService
+	var configFile string
+
+	const initialConfig = `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8091
+      - routeprefix: "/old"
+        mode: "RoundRobin"
+        id: "old-balancer"
+        targets:
+          - address: http://localhost:8091`
+
+	WriteConfig := func(contents string) {
+		Expect(os.WriteFile(configFile, []byte(contents), 0644)).To(Succeed())
+	}
+
+	StartService := func(watchInterval time.Duration) {
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode:           DebugMode,
+			YAMLConfigFilePath:  configFile,
+			WatchConfigInterval: watchInterval,
+		})
+		LbTestService.Apply()
+	}
+
+	// Returns replica which served request, 0 if no balancer matched it
+	GetReplica := func(url string) int {
+		_, body := Request(url).Get()
+		return body.ReplicaId
+	}
+
+	BeforeEach(func() {
+		configFile = filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		WriteConfig(initialConfig)
+
+		// Start Test Servers
+		StartTestServers(2)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Applies added, changed and removed routes and targets in place", func() {
+		StartService(0)
+		mainBalancer := LbTestService.BalancersIdReference["main-balancer"]
+		keptTarget := mainBalancer.FindTarget("http://localhost:8091")
+
+		// Requests keep being served while configuration changes
+		stop := make(chan struct{})
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					res, _ := Request(LISTENER_8080_URL).Get()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				}
+			}
+		}()
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8091
+          - address: http://localhost:8092
+      - routeprefix: "/new"
+        mode: "RoundRobin"
+        id: "new-balancer"
+        targets:
+          - address: http://localhost:8092
+  - protocol: http
+    port: 8081
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "second-listener-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		Expect(LbTestService.Reload()).To(Succeed())
+		close(stop)
+		wg.Wait()
+
+		Expect(LbTestService.BalancersIdReference["main-balancer"]).To(BeIdenticalTo(mainBalancer))
+		Expect(mainBalancer.FindTarget("http://localhost:8091")).To(BeIdenticalTo(keptTarget))
+		replicas := map[int]bool{}
+		for i := 0; i < 4; i++ {
+			replicas[GetReplica(LISTENER_8080_URL)] = true
+		}
+		Expect(replicas).To(Equal(map[int]bool{1: true, 2: true}))
+
+		Expect(GetReplica(LISTENER_8080_URL + "new")).To(Equal(2))
+		Expect(GetReplica(LISTENER_8081_URL)).To(Equal(2))
+		Expect(LbTestService.BalancersIdReference).NotTo(HaveKey("old-balancer"))
+		Expect(LbTestService.GetListeners()).To(HaveLen(2))
+	})
+
+	It("Closes removed balancer after client went away in the middle of its response", func() {
+		StartService(0)
+		mainBalancer := LbTestService.BalancersIdReference["main-balancer"]
+
+		DisconnectMidBody("localhost:8080", "/stream?durationMs=1000")
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/old"
+        mode: "RoundRobin"
+        id: "old-balancer"
+        targets:
+          - address: http://localhost:8091`)
+		Expect(LbTestService.Reload()).To(Succeed())
+		Eventually(mainBalancer.GetState, 3*time.Second).Should(Equal("closed"))
+	})
+
+	It("Keeps balancer of route without id across reloads", func() {
+		const idlessRoute = `
+      - routeprefix: "/idless"
+        mode: "RoundRobin"
+        targets:
+          - address: http://localhost:8091`
+		WriteConfig(initialConfig + idlessRoute)
+		StartService(0)
+		FindIdlessBalancer := func() *Balancer {
+			for _, balancer := range LbTestService.GetListeners()[0].GetBalancers() {
+				if balancer.RoutePrefix == "/idless" {
+					return balancer
+				}
+			}
+			return nil
+		}
+		idlessBalancer := FindIdlessBalancer()
+		Expect(idlessBalancer).NotTo(BeNil())
+
+		WriteConfig(initialConfig + idlessRoute + `
+          - address: http://localhost:8092`)
+		Expect(LbTestService.Reload()).To(Succeed())
+
+		Expect(FindIdlessBalancer()).To(BeIdenticalTo(idlessBalancer))
+		Expect(idlessBalancer.GetTargets()).To(HaveLen(2))
+	})
+
+	It("Replaces balancer whose route settings changed, keeping its targets", func() {
+		StartService(0)
+		mainBalancer := LbTestService.BalancersIdReference["main-balancer"]
+		keptTarget := mainBalancer.FindTarget("http://localhost:8091")
+
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			res, body := Request(LISTENER_8080_URL + "slow?delayMs=500").Get()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body.ReplicaId).To(Equal(1))
+		}()
+		Eventually(keptTarget.ActiveConnections).Should(Equal(int64(1)))
+
+		cnf, err := ParseConfig([]byte(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "LeastConnectionsRandom"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8091`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(LbTestService.ApplyConfig(cnf)).To(Succeed())
+
+		replacement := LbTestService.BalancersIdReference["main-balancer"]
+		Expect(replacement).NotTo(BeIdenticalTo(mainBalancer))
+		Expect(replacement.Mode).To(Equal("LeastConnectionsRandom"))
+		Expect(replacement.FindTarget("http://localhost:8091")).To(BeIdenticalTo(keptTarget))
+
+		// Request in flight on replaced balancer completes
+		wg.Wait()
+		Expect(GetReplica(LISTENER_8080_URL)).To(Equal(1))
+	})
+
+	It("Admits requests queued on replacing balancer once its kept target is brought back up", func() {
+		StartService(0)
+		keptTarget := LbTestService.BalancersIdReference["main-balancer"].FindTarget("http://localhost:8091")
+
+		cnf, err := ParseConfig([]byte(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        maxQueueTime: 3
+        targets:
+          - address: http://localhost:8091`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(LbTestService.ApplyConfig(cnf)).To(Succeed())
+		replacement := LbTestService.BalancersIdReference["main-balancer"]
+		Expect(replacement.FindTarget("http://localhost:8091")).To(BeIdenticalTo(keptTarget))
+
+		keptTarget.MarkAsUnreachable()
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			keptTarget.MarkAsReachable()
+		}()
+		start := time.Now()
+		Expect(GetReplica(LISTENER_8080_URL)).To(Equal(1))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(replacement.Admission.Stats().Queued).To(Equal(int64(1)))
+	})
+
+	It("Rejects invalid configuration and keeps running one", func() {
+		StartService(0)
+		runningConfig := LbTestService.Config
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "Unknown"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		Expect(LbTestService.Reload()).NotTo(Succeed())
+
+		Expect(LbTestService.Config).To(BeIdenticalTo(runningConfig))
+		Expect(GetReplica(LISTENER_8080_URL)).To(Equal(1))
+	})
+
+	It("Restarts listener whose settings changed and closes removed listener", func() {
+		WriteConfig(initialConfig + `
+  - protocol: http
+    port: 8081
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "second-listener-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		StartService(0)
+		Expect(GetReplica(LISTENER_8081_URL)).To(Equal(2))
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    readTimeoutMs: 5000
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		Expect(LbTestService.Reload()).To(Succeed())
+
+		Expect(LbTestService.GetListeners()[0].Srv.ReadTimeout).To(Equal(5 * time.Second))
+		Expect(GetReplica(LISTENER_8080_URL)).To(Equal(2))
+		Eventually(func() error {
+			res, err := http.Get(LISTENER_8081_URL)
+			if err == nil {
+				res.Body.Close()
+			}
+			return err
+		}).Should(HaveOccurred())
+	})
+
+	It("Keeps serving on port of listener while it restarts", func() {
+		StartService(0)
+
+		stop := make(chan struct{})
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					res, _ := Request(LISTENER_8080_URL).Get()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				}
+			}
+		}()
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    readTimeoutMs: 5000
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		Expect(LbTestService.Reload()).To(Succeed())
+		close(stop)
+		wg.Wait()
+
+		Expect(GetReplica(LISTENER_8080_URL)).To(Equal(2))
+	})
+
+	It("Rejects configuration whose listener can not be started and keeps running one", func() {
+		StartService(0)
+		runningConfig := LbTestService.Config
+		mainBalancer := LbTestService.BalancersIdReference["main-balancer"]
+
+		taken, err := net.Listen("tcp", ":8081")
+		Expect(err).NotTo(HaveOccurred())
+		defer taken.Close()
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8092
+  - protocol: http
+    port: 8081
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "second-listener-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		Expect(LbTestService.Reload()).NotTo(Succeed())
+
+		Expect(LbTestService.Config).To(BeIdenticalTo(runningConfig))
+		Expect(LbTestService.GetListeners()).To(HaveLen(1))
+		Expect(LbTestService.BalancersIdReference["main-balancer"]).To(BeIdenticalTo(mainBalancer))
+		Expect(mainBalancer.GetTargets()).To(HaveLen(1))
+		Expect(GetReplica(LISTENER_8080_URL)).To(Equal(1))
+	})
+
+	It("Reloads when watched file changes", func() {
+		StartService(50 * time.Millisecond)
+
+		WriteConfig(`listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "main-balancer"
+        targets:
+          - address: http://localhost:8092`)
+		Eventually(func() int {
+			return GetReplica(LISTENER_8080_URL)
+		}, 2*time.Second).Should(Equal(2))
+	})
+})
@@ -0,0 +1,99 @@
+package testing_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Request ID", func() {
+	var LbTestService LoadBalancerService
+
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidPattern := regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    requestId:
+      enabled: true
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "uuid-balancer"
+        customHeaders:
+          - method: any
+            headers:
+              - name: X-Forwarded-Request
+                value: "[[request.id]]"
+        targets:
+          - address: http://localhost:8091
+  - protocol: http
+    port: 8081
+    requestId:
+      enabled: true
+      header: X-Correlation-ID
+      format: ulid
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "ulid-balancer"
+        targets:
+          - address: http://localhost:8091`,
+		}
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Generates id, forwards it to target and echoes it to client", func() {
+		res, body := Request(LISTENER_8080_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		requestID := res.Header.Get(DEFAULT_REQUEST_ID_HEADER)
+		Expect(requestID).To(MatchRegexp(uuidPattern.String()))
+		Expect(body.Headers["X-Request-Id"]).To(Equal(requestID))
+		Expect(body.Headers["X-Forwarded-Request"]).To(Equal(requestID))
+
+		res, _ = Request(LISTENER_8080_URL).Get()
+		Expect(res.Header.Get(DEFAULT_REQUEST_ID_HEADER)).NotTo(Equal(requestID))
+	})
+
+	It("Keeps id sent by client", func() {
+		req, _ := http.NewRequest("GET", LISTENER_8080_URL, nil)
+		req.Header.Set(DEFAULT_REQUEST_ID_HEADER, "client-supplied-id")
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		body := &TestServerDummyResponse{}
+		json.NewDecoder(res.Body).Decode(body)
+		res.Body.Close()
+
+		Expect(res.Header.Values(DEFAULT_REQUEST_ID_HEADER)).To(Equal([]string{"client-supplied-id"}))
+		Expect(body.Headers["X-Request-Id"]).To(Equal("client-supplied-id"))
+	})
+
+	It("Uses configured header name and ULID format", func() {
+		res, body := Request(LISTENER_8081_URL).Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		requestID := res.Header.Get("X-Correlation-ID")
+		Expect(requestID).To(MatchRegexp(ulidPattern.String()))
+		Expect(body.Headers["X-Correlation-Id"]).To(Equal(requestID))
+		Expect(res.Header.Get(DEFAULT_REQUEST_ID_HEADER)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,170 @@
+package testing_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+func CallAdminAPI(method string, path string, body string, value any) int {
+	req, _ := http.NewRequest(method, ADMIN_URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0
+	}
+	defer res.Body.Close()
+	if value != nil {
+		json.NewDecoder(res.Body).Decode(value)
+	}
+	return res.StatusCode
+}
+
+var _ = Describe("Runtime Target Management", func() {
+	var LbTestService LoadBalancerService
+	const targetsPath = "api/balancers/managed-balancer/targets"
+
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "WeightedRoundRobin"
+        id: "managed-balancer"
+        targets:
+          - address: http://localhost:8091
+admin:
+  port: 8070
+  token: ` + ADMIN_TOKEN,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(3)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Adds, re-weights and removes targets", func() {
+		target := TargetView{}
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:8092", "weight": 2}`, &target)).To(Equal(http.StatusCreated))
+		Expect(target.Address).To(Equal("http://localhost:8092"))
+		Expect(target.Weight).To(Equal(2))
+		Expect(target.Alive).To(BeTrue())
+
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:8092"}`, nil)).To(Equal(http.StatusConflict))
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "localhost:8093"}`, nil)).To(Equal(http.StatusBadRequest))
+
+		replicas := []int{}
+		for i := 0; i < 6; i++ {
+			res, body := Request(LISTENER_8080_URL).Get()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			replicas = append(replicas, body.ReplicaId)
+		}
+		Expect(replicas).To(Equal([]int{1, 2, 2, 1, 2, 2}))
+
+		Expect(CallAdminAPI("PATCH", targetsPath+"?address=http://localhost:8092", `{"weight": 1}`, &target)).To(Equal(http.StatusOK))
+		Expect(target.Weight).To(Equal(1))
+		Expect(CallAdminAPI("PATCH", targetsPath+"?address=http://localhost:8092", `{"weight": 0}`, nil)).To(Equal(http.StatusBadRequest))
+
+		Expect(CallAdminAPI("DELETE", targetsPath+"?address=http://localhost:8091", "", nil)).To(Equal(http.StatusNoContent))
+		Expect(CallAdminAPI("DELETE", targetsPath+"?address=http://localhost:8091", "", nil)).To(Equal(http.StatusNotFound))
+
+		for i := 0; i < 3; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			Expect(body.ReplicaId).To(Equal(2))
+		}
+
+		targets := []TargetView{}
+		Expect(CallAdminAPI("GET", targetsPath, "", &targets)).To(Equal(http.StatusOK))
+		Expect(targets).To(HaveLen(1))
+		Expect(CallAdminAPI("GET", "api/balancers/missing/targets", "", nil)).To(Equal(http.StatusNotFound))
+	})
+
+	It("Marks targets down and up", func() {
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:8092"}`, nil)).To(Equal(http.StatusCreated))
+
+		target := TargetView{}
+		Expect(CallAdminAPI("PATCH", targetsPath+"?address=http://localhost:8091", `{"alive": false}`, &target)).To(Equal(http.StatusOK))
+		Expect(target.Alive).To(BeFalse())
+		for i := 0; i < 4; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			Expect(body.ReplicaId).To(Equal(2))
+		}
+
+		Expect(CallAdminAPI("PATCH", targetsPath+"?address=http://localhost:8091", `{"alive": true}`, &target)).To(Equal(http.StatusOK))
+		Expect(target.Alive).To(BeTrue())
+		replicas := map[int]bool{}
+		for i := 0; i < 4; i++ {
+			_, body := Request(LISTENER_8080_URL).Get()
+			replicas[body.ReplicaId] = true
+		}
+		Expect(replicas).To(HaveKey(1))
+	})
+
+	It("Adds target only once when the same address is posted concurrently", func() {
+		wg := &sync.WaitGroup{}
+		statuses := make(chan int, 8)
+		for worker := 0; worker < 8; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				statuses <- CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:8092"}`, nil)
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		created := 0
+		for status := range statuses {
+			if status == http.StatusCreated {
+				created++
+			} else {
+				Expect(status).To(Equal(http.StatusConflict))
+			}
+		}
+		Expect(created).To(Equal(1))
+		Expect(LbTestService.BalancersIdReference["managed-balancer"].GetTargets()).To(HaveLen(2))
+	})
+
+	It("Keeps serving while targets change", func() {
+		wg := &sync.WaitGroup{}
+		statuses := make(chan int, 200)
+		for worker := 0; worker < 4; worker++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					res, _ := Request(LISTENER_8080_URL).Get()
+					statuses <- res.StatusCode
+				}
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:8092"}`, nil)
+			CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:8093"}`, nil)
+			CallAdminAPI("DELETE", targetsPath+"?address=http://localhost:8092", "", nil)
+			CallAdminAPI("DELETE", targetsPath+"?address=http://localhost:8093", "", nil)
+		}
+		wg.Wait()
+		close(statuses)
+		for status := range statuses {
+			Expect(status).To(Equal(http.StatusOK))
+		}
+	})
+})
@@ -0,0 +1,323 @@
+package testing_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+const TCP_LISTENER_ADDRESS = "localhost:9090"
+
+// TCP server which greets every connection with its replica id and echoes what it
+// receives. Once client closes its side, server answers "bye" and closes the connection.
+type TestTCPServer struct {
+	net.Listener
+	ReplicaId int
+	conns     sync.WaitGroup
+}
+
+func StartTestTCPServer(replicaId int, port int) *TestTCPServer {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	Expect(err).NotTo(HaveOccurred())
+	server := &TestTCPServer{Listener: ln, ReplicaId: replicaId}
+	go server.serve()
+	return server
+}
+
+func (ts *TestTCPServer) serve() {
+	for {
+		conn, err := ts.Accept()
+		if err != nil {
+			return
+		}
+		ts.conns.Add(1)
+		go func() {
+			defer ts.conns.Done()
+			defer conn.Close()
+			fmt.Fprintf(conn, "replica %d\n", ts.ReplicaId)
+			io.Copy(conn, conn)
+			conn.Write([]byte("bye\n"))
+		}()
+	}
+}
+
+func (ts *TestTCPServer) Stop() {
+	ts.Close()
+}
+
+type TestTCPClient struct {
+	*net.TCPConn
+	reader *bufio.Reader
+}
+
+func DialTCPListener() *TestTCPClient {
+	conn, err := net.DialTimeout("tcp", TCP_LISTENER_ADDRESS, time.Second)
+	Expect(err).NotTo(HaveOccurred())
+	return &TestTCPClient{TCPConn: conn.(*net.TCPConn), reader: bufio.NewReader(conn)}
+}
+
+// Reads next line, without its line break
+func (tc *TestTCPClient) ReadLine() (string, error) {
+	tc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := tc.reader.ReadString('\n')
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// Sends line and returns the echoed one
+func (tc *TestTCPClient) Echo(line string) string {
+	_, err := tc.Write([]byte(line + "\n"))
+	Expect(err).NotTo(HaveOccurred())
+	echoed, err := tc.ReadLine()
+	Expect(err).NotTo(HaveOccurred())
+	return echoed
+}
+
+var _ = Describe("TCP Listener", func() {
+	var LbTestService LoadBalancerService
+	var servers []*TestTCPServer
+
+	StartTCPService := func(mode string, listenerSettings string, targetPorts ...int) {
+		targets := ""
+		for _, port := range targetPorts {
+			targets += fmt.Sprintf("\n          - address: tcp://localhost:%d", port)
+		}
+		LbTestService = LoadBalancerService{}
+		Expect(LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: tcp
+    port: 9090` + listenerSettings + `
+    routes:
+      - id: "tcp-balancer"
+        mode: "` + mode + `"
+        targets:` + targets,
+		})).To(Succeed())
+		LbTestService.Apply()
+	}
+
+	// Opens connection and returns it along with replica which greeted it
+	Connect := func() (*TestTCPClient, string) {
+		client := DialTCPListener()
+		greeting, err := client.ReadLine()
+		Expect(err).NotTo(HaveOccurred())
+		return client, greeting
+	}
+
+	BeforeEach(func() {
+		servers = []*TestTCPServer{}
+		for index := 0; index < 3; index++ {
+			servers = append(servers, StartTestTCPServer(index+1, 9101+index))
+		}
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+
+	It("Pipes connections to targets chosen by balancer mode in both directions", func() {
+		StartTCPService("RoundRobin", "", 9101, 9102, 9103)
+
+		clients := []*TestTCPClient{}
+		for replica := 1; replica <= 3; replica++ {
+			client, greeting := Connect()
+			Expect(greeting).To(Equal(fmt.Sprintf("replica %d", replica)))
+			clients = append(clients, client)
+		}
+		Expect(clients[0].Echo("ping")).To(Equal("ping"))
+
+		// Half close reaches target, which still answers
+		Expect(clients[0].CloseWrite()).To(Succeed())
+		Expect(clients[0].ReadLine()).To(Equal("bye"))
+		_, err := clients[0].ReadLine()
+		Expect(err).To(MatchError(io.EOF))
+
+		for _, client := range clients {
+			client.Close()
+		}
+	})
+
+	It("Counts open connections for least connections modes", func() {
+		StartTCPService("LeastConnectionsRoundRobin", "", 9101, 9102, 9103)
+		balancer := LbTestService.GetBalancer("tcp-balancer")
+		ActiveConnections := func(replica string) func() int64 {
+			address := "tcp://localhost:910" + strings.TrimPrefix(replica, "replica ")
+			return func() int64 {
+				return balancer.FindTarget(address).ActiveConnections()
+			}
+		}
+
+		first, firstReplica := Connect()
+		Eventually(ActiveConnections(firstReplica)).Should(Equal(int64(1)))
+		second, secondReplica := Connect()
+		third, thirdReplica := Connect()
+		Expect([]string{firstReplica, secondReplica, thirdReplica}).To(ConsistOf("replica 1", "replica 2", "replica 3"))
+
+		first.Close()
+		Eventually(ActiveConnections(firstReplica)).Should(Equal(int64(0)))
+		fourth, fourthReplica := Connect()
+		Expect(fourthReplica).To(Equal(firstReplica))
+
+		for _, client := range []*TestTCPClient{second, third, fourth} {
+			client.Close()
+		}
+		for _, replica := range []string{secondReplica, thirdReplica, fourthReplica} {
+			Eventually(ActiveConnections(replica)).Should(Equal(int64(0)))
+		}
+	})
+
+	It("Skips targets which refuse connections", func() {
+		StartTCPService("RoundRobin", "", 9101, 9109)
+
+		for i := 0; i < 3; i++ {
+			client, greeting := Connect()
+			Expect(greeting).To(Equal("replica 1"))
+			client.Close()
+		}
+		Expect(LbTestService.GetBalancer("tcp-balancer").FindTarget("tcp://localhost:9109").IsAlive()).To(BeFalse())
+	})
+
+	It("Closes connections which carry no data for idle timeout", func() {
+		StartTCPService("RoundRobin", "\n    idleTimeoutMs: 300", 9101)
+
+		client, _ := Connect()
+		defer client.Close()
+		// Connection in use outlives idle timeout
+		for i := 0; i < 4; i++ {
+			time.Sleep(150 * time.Millisecond)
+			Expect(client.Echo("ping")).To(Equal("ping"))
+		}
+
+		start := time.Now()
+		_, err := client.ReadLine()
+		Expect(err).To(MatchError(io.EOF))
+		Expect(time.Since(start)).To(BeNumerically("~", 300*time.Millisecond, 200*time.Millisecond))
+	})
+
+	It("Lets open connections finish on stop and refuses new ones", func() {
+		StartTCPService("RoundRobin", "\n    shutdownTimeoutMs: 5000", 9101)
+
+		client, _ := Connect()
+		stopped := make(chan struct{})
+		go func() {
+			LbTestService.Stop()
+			close(stopped)
+		}()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", TCP_LISTENER_ADDRESS)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(HaveOccurred())
+		Expect(client.Echo("still here")).To(Equal("still here"))
+		Consistently(stopped, 200*time.Millisecond).ShouldNot(BeClosed())
+
+		client.Close()
+		Eventually(stopped, time.Second).Should(BeClosed())
+	})
+
+	It("Closes connections still open once shutdown timeout passes", func() {
+		StartTCPService("RoundRobin", "\n    shutdownTimeoutMs: 300", 9101)
+
+		client, _ := Connect()
+		defer client.Close()
+		stopped := make(chan struct{})
+		go func() {
+			LbTestService.Stop()
+			close(stopped)
+		}()
+
+		Eventually(stopped, 2*time.Second).Should(BeClosed())
+		_, err := client.ReadLine()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Takes tcp targets added through admin API", func() {
+		LbTestService = LoadBalancerService{}
+		Expect(LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: tcp
+    port: 9090
+    routes:
+      - id: "tcp-balancer"
+        mode: "RoundRobin"
+        targets:
+          - address: tcp://localhost:9101
+admin:
+  port: 8070
+  token: ` + ADMIN_TOKEN,
+		})).To(Succeed())
+		LbTestService.Apply()
+		const targetsPath = "api/balancers/tcp-balancer/targets"
+
+		Eventually(func() int {
+			return CallAdminAPI("POST", targetsPath, `{"address": "http://localhost:9102"}`, nil)
+		}).Should(Equal(http.StatusBadRequest))
+		target := TargetView{}
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "tcp://localhost:9102"}`, &target)).To(Equal(http.StatusCreated))
+		Expect(target.Address).To(Equal("tcp://localhost:9102"))
+
+		for replica := 1; replica <= 2; replica++ {
+			client, greeting := Connect()
+			Expect(greeting).To(Equal(fmt.Sprintf("replica %d", replica)))
+			client.Close()
+		}
+	})
+
+	It("Rejects settings which do not apply to tcp listeners", func() {
+		_, err := ParseConfig([]byte(`upstreams:
+  web:
+    targets:
+      - address: http://localhost:8091
+listeners:
+  - protocol: tcp
+    port: 9090
+    requestId: {}
+    routes:
+      - routeprefix: /db
+        customHeaders:
+          - method: any
+        targets:
+          - address: http://localhost:9101
+          - address: tcp://localhost
+          - dns:
+              name: db.test
+              port: 5432
+              scheme: http
+      - upstream: web
+  - port: 8080
+    routes:
+      - targets:
+          - address: tcp://localhost:9101
+          - consul:
+              address: http://localhost:8500
+              service: api
+              scheme: tcp`))
+		Expect(err).To(MatchError(And(
+			ContainSubstring("listeners[0].routes: tcp listener must have exactly one route"),
+			ContainSubstring("listeners[0].requestId: `requestId` can not be set on tcp listener"),
+			ContainSubstring("listeners[0].routes[0].routeprefix: `routeprefix` can not be set on route of tcp listener"),
+			ContainSubstring("listeners[0].routes[0].customHeaders: `customHeaders` can not be set on route of tcp listener"),
+			ContainSubstring("listeners[0].routes[0].targets[0].address: target address 'http://localhost:9101' must be a tcp://host:port URL"),
+			ContainSubstring("listeners[0].routes[0].targets[1].address: target address 'tcp://localhost' must be a tcp://host:port URL"),
+			ContainSubstring("listeners[0].routes[0].targets[2].dns.scheme: targets of tcp listener must be discovered with scheme 'tcp'"),
+			ContainSubstring("listeners[0].routes[1].upstream: upstream 'web' has targets which tcp listener can not use"),
+			ContainSubstring("listeners[1].routes[0].targets[0].address: target address 'tcp://localhost:9101' must be an absolute http or https URL"),
+			ContainSubstring("listeners[1].routes[0].targets[1].consul.scheme: scheme 'tcp' can only be used by targets of tcp or tls listener"),
+		)))
+	})
+})
@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -49,6 +51,15 @@ func GetNumberedHandler(testserver *TestServer, ReplicaNumber int, defaultDelayI
 			}
 		}
 
+		// Query parameters `delayMs` and optional `replica` delay GET requests on selected replica
+		if delayMs := req.URL.Query().Get("delayMs"); delayMs != "" {
+			replica := req.URL.Query().Get("replica")
+			if replica == "" || replica == strconv.Itoa(ReplicaNumber) {
+				milliseconds, _ := strconv.Atoi(delayMs)
+				delayInterval = time.Duration(milliseconds) * time.Millisecond
+			}
+		}
+
 		if delayInterval > 0 {
 			log.Info().Msgf("Waiting for %v", delayInterval)
 			time.Sleep(delayInterval)
@@ -71,6 +82,43 @@ func GetNumberedHandler(testserver *TestServer, ReplicaNumber int, defaultDelayI
 	}
 }
 
+// Streams response body in small chunks for `durationMs`, so that client can go away mid-body
+func StreamHandler(rw http.ResponseWriter, req *http.Request) {
+	durationMs, _ := strconv.Atoi(req.URL.Query().Get("durationMs"))
+	rw.WriteHeader(http.StatusOK)
+	deadline := time.Now().Add(time.Duration(durationMs) * time.Millisecond)
+	for time.Now().Before(deadline) {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		rw.Write(bytes.Repeat([]byte("x"), 1024))
+		rw.(http.Flusher).Flush()
+	}
+}
+
+// Sends GET request for `path` to listener at `address` and hangs up once part of response
+// body arrived
+func DisconnectMidBody(address string, path string) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", path, address)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	received := 0
+	buffer := make([]byte, 4096)
+	for received < 8192 {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		received += n
+	}
+}
+
 type TestServer struct {
 	Srv           *http.Server
 	ReplicaNumber int
@@ -89,6 +137,8 @@ func NewTestServer(ReplicaNumber int) *TestServer {
 
 	router := &mux.Router{}
 
+	router.HandleFunc("/stream", StreamHandler).Methods("GET")
+
 	handlerFunc := GetNumberedHandler(testserver, ReplicaNumber, 0*time.Second)
 	router.HandleFunc("/", handlerFunc).Methods("GET")
 	router.HandleFunc("/{path}", handlerFunc).Methods("GET", "POST")
@@ -0,0 +1,72 @@
+package testing_test
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Upstream Timeouts", func() {
+	var LbTestService LoadBalancerService
+	BeforeEach(func() {
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "header-timeout-balancer"
+        timeouts:
+          responseHeaderMs: 200
+        targets:
+          - address: http://localhost:8091
+      - routeprefix: "/override"
+        mode: "RoundRobin"
+        id: "request-timeout-balancer"
+        timeouts:
+          responseHeaderMs: 2000
+        targets:
+          - address: http://localhost:8091
+            timeouts:
+              requestMs: 200`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Returns 504 when response headers are not received in time", func() {
+		res, _ := Request(LISTENER_8080_URL + "slow?delayMs=1000").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusGatewayTimeout))
+		Expect(res.Header.Get(UPSTREAM_ERROR_HEADER)).To(Equal(UPSTREAM_ERROR_RESPONSE_HEADER_TIMEOUT))
+
+		// Timed out target stays available
+		res, body := Request(LISTENER_8080_URL + "fast").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.ReplicaId).To(Equal(1))
+	})
+
+	It("Applies target level overrides", func() {
+		target := LbTestService.BalancersIdReference["request-timeout-balancer"].Targets[0]
+		Expect(target.Timeouts.ResponseHeader.Milliseconds()).To(Equal(int64(2000)))
+		Expect(target.Timeouts.Request.Milliseconds()).To(Equal(int64(200)))
+
+		res, _ := Request(LISTENER_8080_URL + "override?delayMs=1000").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusGatewayTimeout))
+		Expect(res.Header.Get(UPSTREAM_ERROR_HEADER)).To(Equal(UPSTREAM_ERROR_REQUEST_TIMEOUT))
+	})
+})
@@ -0,0 +1,263 @@
+package testing_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+// Creates self signed certificate for given names, returning certificate and key in PEM format
+func NewTestCertificatePEM(names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// Writes certificate for given names to directory, returning certificate and key files
+func WriteTestCertificate(dir string, names ...string) (string, string) {
+	certPEM, keyPEM := NewTestCertificatePEM(names...)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	Expect(os.WriteFile(certFile, certPEM, 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+// Starts TCP server of `StartTestTCPServer` which terminates TLS itself, presenting
+// certificate for server name
+func StartTestTLSServer(replicaId int, port int, serverName string) *TestTCPServer {
+	certificate, err := tls.X509KeyPair(NewTestCertificatePEM(serverName))
+	Expect(err).NotTo(HaveOccurred())
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	Expect(err).NotTo(HaveOccurred())
+	server := &TestTCPServer{
+		Listener:  tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{certificate}}),
+		ReplicaId: replicaId,
+	}
+	go server.serve()
+	return server
+}
+
+// Opens TLS connection asking for server name and returns replica which greeted it along
+// with the name certificate presented to client was issued for
+func DialServerName(serverName string) (*tls.Conn, string, string) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", TCP_LISTENER_ADDRESS, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	Expect(err).NotTo(HaveOccurred())
+	return conn, strings.TrimSuffix(greeting, "\n"), conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+var _ = Describe("TLS Passthrough", func() {
+	var LbTestService LoadBalancerService
+	var servers []*TestTCPServer
+
+	StartService := func(config string) {
+		LbTestService = LoadBalancerService{}
+		Expect(LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode:        DebugMode,
+			YAMLConfigString: config,
+		})).To(Succeed())
+		LbTestService.Apply()
+	}
+
+	BeforeEach(func() {
+		servers = []*TestTCPServer{
+			StartTestTLSServer(1, 9101, "vault.test"),
+			StartTestTLSServer(2, 9102, "primary.db.test"),
+			StartTestTLSServer(3, 9103, "fallback.test"),
+		}
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+
+	It("Routes connections of tls listener by server name without terminating them", func() {
+		StartService(`listeners:
+  - protocol: tls
+    port: 9090
+    routes:
+      - id: vault
+        serverNames: ["Vault.test"]
+        targets:
+          - address: tcp://localhost:9101
+      - id: databases
+        serverNames: ["*.db.test"]
+        targets:
+          - address: tcp://localhost:9102
+      - id: fallback
+        targets:
+          - address: tcp://localhost:9103`)
+
+		conn, replica, certificate := DialServerName("vault.test")
+		Expect(replica).To(Equal("replica 1"))
+		Expect(certificate).To(Equal("vault.test"))
+		_, err := conn.Write([]byte("ping\n"))
+		Expect(err).NotTo(HaveOccurred())
+		echoed, err := bufio.NewReader(conn).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(echoed).To(Equal("ping\n"))
+		conn.Close()
+
+		for serverName, expected := range map[string]string{
+			"primary.db.test": "replica 2",
+			"a.b.db.test":     "replica 3",
+			"db.test":         "replica 3",
+			"other.test":      "replica 3",
+			"":                "replica 3",
+		} {
+			conn, replica, _ := DialServerName(serverName)
+			Expect(replica).To(Equal(expected), serverName)
+			conn.Close()
+		}
+	})
+
+	It("Closes connections whose server name no route takes", func() {
+		StartService(`listeners:
+  - protocol: tls
+    port: 9090
+    routes:
+      - serverNames: ["vault.test"]
+        targets:
+          - address: tcp://localhost:9101`)
+
+		_, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", TCP_LISTENER_ADDRESS, &tls.Config{
+			ServerName:         "other.test",
+			InsecureSkipVerify: true,
+		})
+		Expect(err).To(HaveOccurred())
+
+		conn, err := net.Dial("tcp", TCP_LISTENER_ADDRESS)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadAll(conn)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Shares port of https listener between terminated and passthrough routes", func() {
+		web := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("terminated " + req.URL.Path))
+		}))
+		defer web.Close()
+		certFile, keyFile := WriteTestCertificate(GinkgoT().TempDir(), "localhost")
+		StartService(`listeners:
+  - protocol: https
+    port: 9090
+    ssl_certificate: ` + certFile + `
+    ssl_certificate_key: ` + keyFile + `
+    routes:
+      - routeprefix: /
+        targets:
+          - address: ` + web.URL + `
+      - id: vault
+        passthrough: true
+        serverNames: ["vault.test"]
+        targets:
+          - address: tcp://localhost:9101`)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		res, err := client.Get("https://" + TCP_LISTENER_ADDRESS + "/api")
+		Expect(err).NotTo(HaveOccurred())
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		Expect(string(body)).To(Equal("terminated /api"))
+		Expect(res.TLS.PeerCertificates[0].Subject.CommonName).To(Equal("localhost"))
+
+		conn, replica, certificate := DialServerName("vault.test")
+		defer conn.Close()
+		Expect(replica).To(Equal("replica 1"))
+		Expect(certificate).To(Equal("vault.test"))
+		Eventually(LbTestService.GetBalancer("vault").FindTarget("tcp://localhost:9101").ActiveConnections).Should(Equal(int64(1)))
+	})
+
+	It("Rejects invalid passthrough settings", func() {
+		_, err := ParseConfig([]byte(`listeners:
+  - protocol: tls
+    port: 9090
+    routes:
+      - routeprefix: /
+        serverNames: ["vault.test", "*.*.test"]
+        targets:
+          - address: http://localhost:9101
+      - serverNames: ["VAULT.test"]
+        targets:
+          - address: tcp://localhost:9102
+      - targets:
+          - address: tcp://localhost:9103
+      - targets:
+          - address: tcp://localhost:9104
+  - protocol: https
+    port: 9443
+    routes:
+      - passthrough: true
+        hedging: {}
+        targets:
+          - address: http://localhost:9101
+  - port: 8080
+    routes:
+      - passthrough: true
+        targets:
+          - address: tcp://localhost:9101
+      - routeprefix: /api
+        serverNames: ["api.test"]
+        targets:
+          - dns:
+              name: api.test
+              port: 443
+              scheme: tcp`))
+		Expect(err).To(MatchError(And(
+			ContainSubstring("listeners[0].routes[0].routeprefix: `routeprefix` can not be set on route of tls listener"),
+			ContainSubstring("listeners[0].routes[0].serverNames[1]: server name '*.*.test' is invalid"),
+			ContainSubstring("listeners[0].routes[0].targets[0].address: target address 'http://localhost:9101' must be a tcp://host:port URL"),
+			ContainSubstring("listeners[0].routes[1].serverNames[0]: server name 'vault.test' is already used by listeners[0].routes[0]"),
+			ContainSubstring("listeners[0].routes[3].serverNames: `serverNames` must be set, as listeners[0].routes[2] already takes connections no other route does"),
+			ContainSubstring("listeners[1].routes[0].hedging: `hedging` can not be set on passthrough route"),
+			ContainSubstring("listeners[1].routes[0].serverNames: passthrough route of https listener must have serverNames"),
+			ContainSubstring("listeners[1].routes[0].targets[0].address: target address 'http://localhost:9101' must be a tcp://host:port URL"),
+			ContainSubstring("listeners[2].routes[0].passthrough: `passthrough` can only be set on route of https listener"),
+			ContainSubstring("listeners[2].routes[1].serverNames: `serverNames` can only be set on passthrough route"),
+			ContainSubstring("listeners[2].routes[1].targets[0].dns.scheme: scheme 'tcp' can only be used by targets of tcp or tls listener"),
+		)))
+	})
+})
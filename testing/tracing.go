@@ -0,0 +1,166 @@
+package testing_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+// Stand-in for an OTLP/HTTP collector, keeping received spans in memory
+type FakeCollector struct {
+	Srv   *httptest.Server
+	mu    sync.Mutex
+	spans []map[string]interface{}
+}
+
+func NewFakeCollector() *FakeCollector {
+	collector := &FakeCollector{}
+	collector.Srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		payload := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&payload)
+		collector.mu.Lock()
+		for _, resourceSpans := range payload.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+		collector.mu.Unlock()
+		rw.WriteHeader(http.StatusOK)
+	}))
+	return collector
+}
+
+func (fc *FakeCollector) Spans() []map[string]interface{} {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return append([]map[string]interface{}{}, fc.spans...)
+}
+
+var _ = Describe("Tracing", func() {
+	var LbTestService LoadBalancerService
+	var collector *FakeCollector
+
+	BeforeEach(func() {
+		collector = NewFakeCollector()
+		LbTestService = LoadBalancerService{}
+
+		config := &LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        mode: "RoundRobin"
+        id: "traced-balancer"
+        targets:
+          - address: http://localhost:8091
+      - routeprefix: "/untraced"
+        mode: "RoundRobin"
+        id: "untraced-balancer"
+        traceSampleRatio: 0
+        targets:
+          - address: http://localhost:8091
+tracing:
+  endpoint: ` + collector.Srv.URL + `/v1/traces
+  exportIntervalMs: 50`,
+		}
+
+		LbTestService.SetParams(config)
+		LbTestService.Apply()
+
+		// Start Test Servers
+		StartTestServers(1)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+		collector.Srv.Close()
+	})
+
+	It("Continues incoming trace and exports request spans", func() {
+		traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+		req, _ := http.NewRequest("GET", LISTENER_8080_URL, nil)
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		req.Header.Set("tracestate", "vendor=value")
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		body := &TestServerDummyResponse{}
+		json.NewDecoder(res.Body).Decode(body)
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		// Target receives trace context of the upstream span
+		Expect(body.Headers["Traceparent"]).To(HavePrefix("00-" + traceID + "-"))
+		Expect(body.Headers["Traceparent"]).NotTo(ContainSubstring("00f067aa0ba902b7"))
+		Expect(body.Headers["Tracestate"]).To(Equal("vendor=value"))
+
+		Eventually(func() int {
+			return len(collector.Spans())
+		}).Should(Equal(3))
+
+		spansByName := map[string]map[string]interface{}{}
+		for _, span := range collector.Spans() {
+			Expect(span["traceId"]).To(Equal(traceID))
+			spansByName[span["name"].(string)] = span
+		}
+		Expect(spansByName).To(HaveKey("GET /"))
+		Expect(spansByName).To(HaveKey("select target"))
+		Expect(spansByName).To(HaveKey("upstream"))
+
+		serverSpan := spansByName["GET /"]
+		Expect(serverSpan["parentSpanId"]).To(Equal("00f067aa0ba902b7"))
+		Expect(spansByName["select target"]["parentSpanId"]).To(Equal(serverSpan["spanId"]))
+		Expect(spansByName["upstream"]["parentSpanId"]).To(Equal(serverSpan["spanId"]))
+		Expect(body.Headers["Traceparent"]).To(ContainSubstring(spansByName["upstream"]["spanId"].(string)))
+	})
+
+	It("Starts new trace when incoming traceparent is malformed", func() {
+		traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+		for _, traceparent := range []string{
+			"00-" + strings.ToUpper(traceID) + "-00f067aa0ba902b7-01",
+			"00-" + traceID + "-00F067AA0BA902B7-01",
+			"00-" + traceID + "-00f067aa0ba902b7-01-extra",
+		} {
+			req, _ := http.NewRequest("GET", LISTENER_8080_URL, nil)
+			req.Header.Set("traceparent", traceparent)
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			body := &TestServerDummyResponse{}
+			json.NewDecoder(res.Body).Decode(body)
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body.Headers["Traceparent"]).To(HavePrefix("00-"))
+			Expect(strings.ToLower(body.Headers["Traceparent"])).NotTo(ContainSubstring(traceID))
+		}
+	})
+
+	It("Propagates but does not export unsampled traces", func() {
+		res, body := Request(LISTENER_8080_URL + "untraced").Get()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body.Headers["Traceparent"]).To(HaveSuffix("-00"))
+
+		Consistently(func() int {
+			return len(collector.Spans())
+		}, "200ms").Should(Equal(0))
+	})
+
+	It("Can be shut down more than once", func() {
+		tracer := NewTracer(&TracingYAMLConfig{Endpoint: collector.Srv.URL + "/v1/traces"})
+		tracer.Shutdown()
+		Expect(tracer.Shutdown).NotTo(Panic())
+	})
+})
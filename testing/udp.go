@@ -0,0 +1,284 @@
+package testing_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+const UDP_LISTENER_ADDRESS = "127.0.0.1:9090"
+
+// UDP server which answers every datagram with its replica id followed by the datagram
+type TestUDPServer struct {
+	net.PacketConn
+	ReplicaId int
+}
+
+func StartTestUDPServer(replicaId int, port int) *TestUDPServer {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	Expect(err).NotTo(HaveOccurred())
+	server := &TestUDPServer{PacketConn: conn, ReplicaId: replicaId}
+	go server.serve()
+	return server
+}
+
+func (us *TestUDPServer) serve() {
+	buffer := make([]byte, 1024)
+	for {
+		n, addr, err := us.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		us.WriteTo([]byte(fmt.Sprintf("replica %d: %s", us.ReplicaId, buffer[:n])), addr)
+	}
+}
+
+func (us *TestUDPServer) Stop() {
+	us.Close()
+}
+
+// Client sending datagrams to udp listener from its own address
+type TestUDPClient struct {
+	net.Conn
+}
+
+func DialUDPListener() *TestUDPClient {
+	conn, err := net.Dial("udp", UDP_LISTENER_ADDRESS)
+	Expect(err).NotTo(HaveOccurred())
+	return &TestUDPClient{Conn: conn}
+}
+
+// Sends datagram and returns the answer, or error if none arrives in time
+func (uc *TestUDPClient) Send(payload string) (string, error) {
+	_, err := uc.Write([]byte(payload))
+	Expect(err).NotTo(HaveOccurred())
+	uc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buffer := make([]byte, 1024)
+	n, err := uc.Read(buffer)
+	return string(buffer[:n]), err
+}
+
+// Sends datagram and returns replica which answered it
+func (uc *TestUDPClient) Replica(payload string) string {
+	answer, err := uc.Send(payload)
+	Expect(err).NotTo(HaveOccurred())
+	replica, echoed, _ := strings.Cut(answer, ": ")
+	Expect(echoed).To(Equal(payload))
+	return replica
+}
+
+var _ = Describe("UDP Listener", func() {
+	var LbTestService LoadBalancerService
+	var servers []*TestUDPServer
+
+	StartUDPService := func(mode string, listenerSettings string, targetPorts ...int) {
+		targets := ""
+		for _, port := range targetPorts {
+			targets += fmt.Sprintf("\n          - address: udp://127.0.0.1:%d", port)
+		}
+		LbTestService = LoadBalancerService{}
+		Expect(LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: udp
+    port: 9090` + listenerSettings + `
+    routes:
+      - id: "udp-balancer"
+        mode: "` + mode + `"
+        targets:` + targets,
+		})).To(Succeed())
+		LbTestService.Apply()
+	}
+
+	Sessions := func() []UDPSessionView {
+		return LbTestService.GetListeners()[0].UDPSessions()
+	}
+
+	ActiveConnections := func(port int) func() int64 {
+		return func() int64 {
+			return LbTestService.GetBalancer("udp-balancer").FindTarget(fmt.Sprintf("udp://127.0.0.1:%d", port)).ActiveConnections()
+		}
+	}
+
+	BeforeEach(func() {
+		servers = []*TestUDPServer{}
+		for index := 0; index < 3; index++ {
+			servers = append(servers, StartTestUDPServer(index+1, 9101+index))
+		}
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+
+	It("Relays datagrams of each client address to target chosen by balancer mode", func() {
+		StartUDPService("RoundRobin", "", 9101, 9102, 9103)
+
+		clients := []*TestUDPClient{}
+		for replica := 1; replica <= 3; replica++ {
+			client := DialUDPListener()
+			defer client.Close()
+			Expect(client.Replica("query")).To(Equal(fmt.Sprintf("replica %d", replica)))
+			clients = append(clients, client)
+		}
+		// Client keeps its target for the whole session
+		Expect(clients[0].Replica("again")).To(Equal("replica 1"))
+
+		sessions := Sessions()
+		Expect(sessions).To(HaveLen(3))
+		Expect(sessions[0].Client).To(Equal(clients[0].LocalAddr().String()))
+		Expect(sessions[0].Target).To(Equal("udp://127.0.0.1:9101"))
+		Expect(sessions[0].PacketsIn).To(Equal(int64(2)))
+		Expect(sessions[0].PacketsOut).To(Equal(int64(2)))
+		Expect(sessions[0].BytesIn).To(Equal(int64(len("query") + len("again"))))
+		Expect(sessions[0].BytesOut).To(Equal(int64(len("replica 1: query") + len("replica 1: again"))))
+		Expect(ActiveConnections(9101)()).To(Equal(int64(1)))
+	})
+
+	It("Sends every client IP to the same target when hashing client IP", func() {
+		StartUDPService("RoundRobin", "\n    hashClientIP: true", 9101, 9102, 9103)
+
+		client := DialUDPListener()
+		defer client.Close()
+		replica := client.Replica("query")
+		for i := 0; i < 4; i++ {
+			other := DialUDPListener()
+			Expect(other.Replica("query")).To(Equal(replica))
+			other.Close()
+		}
+		Expect(Sessions()).To(HaveLen(5))
+	})
+
+	It("Expires sessions which carry no datagrams for idle timeout", func() {
+		StartUDPService("RoundRobin", "\n    idleTimeoutMs: 300", 9101, 9102)
+
+		client := DialUDPListener()
+		defer client.Close()
+		// Session in use outlives idle timeout
+		for i := 0; i < 4; i++ {
+			Expect(client.Replica("query")).To(Equal("replica 1"))
+			time.Sleep(150 * time.Millisecond)
+		}
+		Expect(Sessions()).To(HaveLen(1))
+
+		Eventually(Sessions).Should(BeEmpty())
+		Expect(ActiveConnections(9101)()).To(Equal(int64(0)))
+		// Next datagram opens new session
+		Expect(client.Replica("query")).To(Equal("replica 2"))
+	})
+
+	It("Drops datagrams of new clients once session limit is reached", func() {
+		StartUDPService("RoundRobin", "\n    maxSessions: 2", 9101, 9102, 9103)
+
+		first := DialUDPListener()
+		defer first.Close()
+		second := DialUDPListener()
+		defer second.Close()
+		Expect(first.Replica("query")).To(Equal("replica 1"))
+		Expect(second.Replica("query")).To(Equal("replica 2"))
+
+		third := DialUDPListener()
+		defer third.Close()
+		_, err := third.Send("query")
+		Expect(err).To(HaveOccurred())
+		Expect(first.Replica("query")).To(Equal("replica 1"))
+		Expect(LbTestService.GetListeners()[0].RejectedDatagrams()).To(Equal(int64(1)))
+	})
+
+	It("Marks targets which refuse datagrams unreachable", func() {
+		StartUDPService("RoundRobin", "", 9101, 9109)
+
+		first := DialUDPListener()
+		defer first.Close()
+		Expect(first.Replica("query")).To(Equal("replica 1"))
+
+		second := DialUDPListener()
+		defer second.Close()
+		_, err := second.Send("query")
+		Expect(err).To(HaveOccurred())
+		Eventually(func() bool {
+			return LbTestService.GetBalancer("udp-balancer").FindTarget("udp://127.0.0.1:9109").IsAlive()
+		}).Should(BeFalse())
+		Expect(second.Replica("retry")).To(Equal("replica 1"))
+	})
+
+	It("Takes udp targets added through admin API", func() {
+		LbTestService = LoadBalancerService{}
+		Expect(LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode: DebugMode,
+			YAMLConfigString: `listeners:
+  - protocol: udp
+    port: 9090
+    routes:
+      - id: "udp-balancer"
+        mode: "RoundRobin"
+        targets:
+          - address: udp://127.0.0.1:9101
+admin:
+  port: 8070
+  token: ` + ADMIN_TOKEN,
+		})).To(Succeed())
+		LbTestService.Apply()
+		const targetsPath = "api/balancers/udp-balancer/targets"
+
+		Eventually(func() int {
+			return CallAdminAPI("POST", targetsPath, `{"address": "http://127.0.0.1:9102"}`, nil)
+		}).Should(Equal(http.StatusBadRequest))
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "tcp://127.0.0.1:9102"}`, nil)).To(Equal(http.StatusBadRequest))
+		target := TargetView{}
+		Expect(CallAdminAPI("POST", targetsPath, `{"address": "udp://127.0.0.1:9102"}`, &target)).To(Equal(http.StatusCreated))
+		Expect(target.Address).To(Equal("udp://127.0.0.1:9102"))
+
+		for replica := 1; replica <= 2; replica++ {
+			client := DialUDPListener()
+			defer client.Close()
+			Expect(client.Replica("query")).To(Equal(fmt.Sprintf("replica %d", replica)))
+		}
+	})
+
+	It("Rejects settings which do not apply to udp listeners", func() {
+		_, err := ParseConfig([]byte(`listeners:
+  - protocol: udp
+    port: 9090
+    maxConnectionsPerIP: 10
+    shutdownTimeoutMs: 1000
+    maxSessions: -1
+    routes:
+      - routeprefix: /dns
+        targets:
+          - address: tcp://localhost:53
+          - dns:
+              name: resolvers.test
+              port: 53
+              scheme: tcp
+      - targets:
+          - address: udp://localhost:53
+  - port: 8080
+    maxSessions: 10
+    hashClientIP: true
+    routes:
+      - targets:
+          - address: udp://localhost:53`))
+		Expect(err).To(MatchError(And(
+			ContainSubstring("listeners[0].routes: udp listener must have exactly one route"),
+			ContainSubstring("listeners[0].maxConnectionsPerIP: `maxConnectionsPerIP` can not be set on udp listener"),
+			ContainSubstring("listeners[0].shutdownTimeoutMs: `shutdownTimeoutMs` can not be set on udp listener"),
+			ContainSubstring("listeners[0].maxSessions: maxSessions must not be negative"),
+			ContainSubstring("listeners[0].routes[0].routeprefix: `routeprefix` can not be set on route of udp listener"),
+			ContainSubstring("listeners[0].routes[0].targets[0].address: target address 'tcp://localhost:53' must be a udp://host:port URL"),
+			ContainSubstring("listeners[0].routes[0].targets[1].dns.scheme: targets of udp listener must be discovered with scheme 'udp'"),
+			ContainSubstring("listeners[1].maxSessions: `maxSessions` can only be set on udp listener"),
+			ContainSubstring("listeners[1].hashClientIP: `hashClientIP` can only be set on udp listener"),
+			ContainSubstring("listeners[1].routes[0].targets[0].address: target address 'udp://localhost:53' must be an absolute http or https URL"),
+		)))
+	})
+})
@@ -0,0 +1,153 @@
+package testing_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/vinay03/loadbalancer/src"
+)
+
+var _ = Describe("Upstreams", func() {
+	var LbTestService LoadBalancerService
+
+	const upstreamsConfig = `upstreams:
+  shared:
+    mode: "WeightedRoundRobin"
+    healthCheck:
+      path: "/health"
+      intervalMs: 50
+    targets:
+      - address: http://localhost:8091
+      - address: http://localhost:8092
+listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        id: "first-balancer"
+        upstream: shared
+      - routeprefix: "/second"
+        id: "second-balancer"
+        mode: "RoundRobin"
+        upstream: shared
+admin:
+  port: 8070
+  token: ` + ADMIN_TOKEN
+
+	StartService := func(configFile string) {
+		LbTestService = LoadBalancerService{}
+		LbTestService.SetParams(&LoadBalancerServiceParams{
+			DebugMode:          DebugMode,
+			YAMLConfigFilePath: configFile,
+		})
+		LbTestService.Apply()
+	}
+
+	BeforeEach(func() {
+		// Start Test Servers
+		StartTestServers(3)
+	})
+
+	AfterEach(func() {
+		LbTestService.Stop()
+		StopTestServers()
+	})
+
+	It("Shares targets and their state between balancers", func() {
+		configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(configFile, []byte(upstreamsConfig), 0644)).To(Succeed())
+		StartService(configFile)
+
+		first := LbTestService.GetBalancer("first-balancer")
+		second := LbTestService.GetBalancer("second-balancer")
+		Expect(first.Mode).To(Equal(LB_MODE_WEIGHTED_ROUNDROBIN))
+		Expect(second.Mode).To(Equal(LB_MODE_ROUNDROBIN))
+		Expect(first.GetTargets()).To(Equal(second.GetTargets()))
+
+		// Target marked down through one balancer is down for the other
+		Expect(CallAdminAPI("PATCH", "api/balancers/first-balancer/targets?address=http://localhost:8092", `{"alive": false}`, nil)).To(Equal(http.StatusOK))
+		Expect(second.FindTarget("http://localhost:8092").IsAlive()).To(BeFalse())
+		_, body := Request(LISTENER_8080_URL + "second").Get()
+		Expect(body.ReplicaId).To(Equal(1))
+
+		// Health check brings target back
+		Eventually(second.FindTarget("http://localhost:8092").IsAlive, time.Second).Should(BeTrue())
+
+		// Target added through one balancer is added to the upstream
+		Expect(CallAdminAPI("POST", "api/balancers/second-balancer/targets", `{"address": "http://localhost:8093"}`, nil)).To(Equal(http.StatusCreated))
+		Expect(first.FindTarget("http://localhost:8093")).NotTo(BeNil())
+		Expect(LbTestService.GetUpstream("shared").GetTargets()).To(HaveLen(3))
+
+		view := BalancerView{}
+		Expect(CallAdminAPI("DELETE", "api/balancers/first-balancer/targets?address=http://localhost:8091", "", nil)).To(Equal(http.StatusNoContent))
+		Expect(CallAdminAPI("GET", "api/balancers/second-balancer", "", &view)).To(Equal(http.StatusOK))
+		Expect(view.Upstream).To(Equal("shared"))
+		Expect(view.Targets).To(HaveLen(2))
+	})
+
+	It("Reloads upstream targets in place", func() {
+		configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(configFile, []byte(upstreamsConfig), 0644)).To(Succeed())
+		StartService(configFile)
+		first := LbTestService.GetBalancer("first-balancer")
+		upstream := LbTestService.GetUpstream("shared")
+
+		Expect(os.WriteFile(configFile, []byte(`upstreams:
+  shared:
+    mode: "WeightedRoundRobin"
+    healthCheck:
+      path: "/health"
+      intervalMs: 50
+    targets:
+      - address: http://localhost:8093
+listeners:
+  - protocol: http
+    port: 8080
+    routes:
+      - routeprefix: "/"
+        id: "first-balancer"
+        upstream: shared
+      - routeprefix: "/second"
+        id: "second-balancer"
+        mode: "RoundRobin"
+        upstream: shared`), 0644)).To(Succeed())
+		Expect(LbTestService.Reload()).To(Succeed())
+
+		Expect(LbTestService.GetUpstream("shared")).To(BeIdenticalTo(upstream))
+		Expect(LbTestService.GetBalancer("first-balancer")).To(BeIdenticalTo(first))
+		for _, url := range []string{LISTENER_8080_URL, LISTENER_8080_URL + "second"} {
+			_, body := Request(url).Get()
+			Expect(body.ReplicaId).To(Equal(3))
+		}
+	})
+
+	It("Loads upstreams and listeners from included files", func() {
+		configDir := GinkgoT().TempDir()
+		Expect(os.Mkdir(filepath.Join(configDir, "conf.d"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(configDir, "config.yaml"), []byte(`include:
+  - upstreams.yaml
+  - conf.d/`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(configDir, "upstreams.yaml"), []byte(`upstreams:
+  shared:
+    targets:
+      - address: http://localhost:8092`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(configDir, "conf.d", "8080.yaml"), []byte(`listeners:
+  - port: 8080
+    routes:
+      - upstream: shared`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(configDir, "conf.d", "8081.yml"), []byte(`listeners:
+  - port: 8081
+    routes:
+      - upstream: shared`), 0644)).To(Succeed())
+		StartService(filepath.Join(configDir, "config.yaml"))
+
+		for _, url := range []string{LISTENER_8080_URL, LISTENER_8081_URL} {
+			_, body := Request(url).Get()
+			Expect(body.ReplicaId).To(Equal(2))
+		}
+	})
+})